@@ -0,0 +1,56 @@
+package adaptive_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/adaptive"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	ms, err := memorystore.New(&memorystore.Config{
+		Tokens:   100,
+		Interval: time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Allow up to 100 requests per second, halving the limit (down to 10) while
+	// the backend is failing or taking longer than 500ms to respond.
+	store, err := adaptive.New(ms, &adaptive.Config{
+		MaxTokens:        100,
+		MinTokens:        10,
+		Interval:         time.Second,
+		LatencyThreshold: 500 * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	_, _, _, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	outcome := adaptive.OutcomeSuccess
+	if err := callBackend(ctx); err != nil {
+		outcome = adaptive.OutcomeError
+	}
+	if err := store.Report(ctx, "my-key", outcome, time.Since(start)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func callBackend(ctx context.Context) error {
+	return nil
+}
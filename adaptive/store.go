@@ -0,0 +1,524 @@
+// Package adaptive defines a storage system for limiting whose limits adapt to
+// the health of a downstream dependency. Limits shrink multiplicatively when
+// callers report errors or slow responses, and grow back additively while
+// callers report success (AIMD).
+package adaptive
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+var _ limiter.Store = (*Store)(nil)
+
+// Outcome is the result of an operation permitted by the store.
+type Outcome uint8
+
+const (
+	// OutcomeSuccess indicates the operation succeeded.
+	OutcomeSuccess Outcome = iota
+
+	// OutcomeError indicates the operation failed in a way which suggests the
+	// downstream dependency is unhealthy, such as a 5xx response or a timeout.
+	OutcomeError
+)
+
+// Store wraps a limiter.Store and adjusts the number of tokens for each key
+// using Set, based on the outcomes reported with Report.
+type Store struct {
+	store limiter.Store
+
+	minTokens        uint64
+	maxTokens        uint64
+	initialTokens    uint64
+	interval         time.Duration
+	increase         uint64
+	decrease         float64
+	latencyThreshold time.Duration
+	adjustInterval   uint64
+	clock            limiter.Clock
+
+	sweepInterval time.Duration
+	sweepMinTTL   uint64
+
+	data     map[string]*state
+	dataLock sync.RWMutex
+
+	stopped uint32
+	stopCh  chan struct{}
+}
+
+// Config is used as input to New. It defines how limits adapt.
+type Config struct {
+	// MaxTokens is the largest number of tokens a key may have per interval. It
+	// is required.
+	MaxTokens uint64
+
+	// MinTokens is the smallest number of tokens a key may have per interval,
+	// however many errors are reported. The default value is 1.
+	MinTokens uint64
+
+	// InitialTokens is the number of tokens a key starts with. The default value
+	// is MaxTokens.
+	InitialTokens uint64
+
+	// Interval is the interval passed to Set on the underlying store. It should
+	// match the interval the underlying store was configured with. The default
+	// value is 1 second.
+	Interval time.Duration
+
+	// Increase is the number of tokens added to a key's limit after an
+	// adjustment period in which only successes were reported. The default value
+	// is 1.
+	Increase uint64
+
+	// Decrease is the factor by which a key's limit is multiplied after an
+	// adjustment period in which an error was reported. It must be between 0 and
+	// 1. The default value is 0.5.
+	Decrease float64
+
+	// LatencyThreshold is the latency above which a successful outcome is treated
+	// as an error, since a slow dependency is often an overloaded one. The
+	// default value is 0, which disables the latency check.
+	LatencyThreshold time.Duration
+
+	// AdjustInterval is the minimum amount of time between adjustments to a key's
+	// limit. Outcomes reported in between are aggregated. Since Set refills the
+	// key's bucket on the underlying store, this should be at least as long as
+	// Interval. The default value is Interval.
+	AdjustInterval time.Duration
+
+	// SweepInterval is the rate at which to run the garbage collection on stale
+	// entries. The default value is 6 hours.
+	SweepInterval time.Duration
+
+	// SweepMinTTL is the minimum amount of time a key must be inactive before
+	// clearing its adaptive state. The default value is 12 hours.
+	SweepMinTTL time.Duration
+
+	// InitialAlloc is the size to use for the in-memory map. The default value is
+	// 4096.
+	InitialAlloc int
+
+	// DisablePurge disables the purge operation. WARNING: this will cause
+	// unbounded memory growth. Do not enable unless you have a fixed number of
+	// keys.
+	DisablePurge bool
+
+	// Clock is the source of the current time. It is used to decide when to
+	// adjust limits and which entries are stale, but not to schedule the purge.
+	// The default value is the system clock.
+	Clock limiter.Clock
+}
+
+// New creates an adaptive store which wraps s. Closing the adaptive store closes
+// s.
+func New(s limiter.Store, c *Config) (*Store, error) {
+	if s == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+
+	if c == nil {
+		c = new(Config)
+	}
+
+	if c.MaxTokens == 0 {
+		return nil, fmt.Errorf("max tokens is required")
+	}
+	maxTokens := c.MaxTokens
+
+	minTokens := uint64(1)
+	if c.MinTokens > 0 {
+		minTokens = c.MinTokens
+	}
+	if minTokens > maxTokens {
+		return nil, fmt.Errorf("min tokens (%d) cannot be greater than max tokens (%d)", minTokens, maxTokens)
+	}
+
+	initialTokens := maxTokens
+	if c.InitialTokens > 0 {
+		initialTokens = c.InitialTokens
+	}
+	if initialTokens < minTokens || initialTokens > maxTokens {
+		return nil, fmt.Errorf("initial tokens (%d) must be between %d and %d", initialTokens, minTokens, maxTokens)
+	}
+
+	interval := 1 * time.Second
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	increase := uint64(1)
+	if c.Increase > 0 {
+		increase = c.Increase
+	}
+
+	decrease := 0.5
+	if c.Decrease != 0 {
+		decrease = c.Decrease
+	}
+	if decrease <= 0 || decrease >= 1 {
+		return nil, fmt.Errorf("decrease (%v) must be between 0 and 1", decrease)
+	}
+
+	adjustInterval := interval
+	if c.AdjustInterval > 0 {
+		adjustInterval = c.AdjustInterval
+	}
+
+	sweepInterval := 6 * time.Hour
+	if c.SweepInterval > 0 {
+		sweepInterval = c.SweepInterval
+	}
+
+	sweepMinTTL := 12 * time.Hour
+	if c.SweepMinTTL > 0 {
+		sweepMinTTL = c.SweepMinTTL
+	}
+
+	initialAlloc := 4096
+	if c.InitialAlloc > 0 {
+		initialAlloc = c.InitialAlloc
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	as := &Store{
+		store: s,
+
+		minTokens:        minTokens,
+		maxTokens:        maxTokens,
+		initialTokens:    initialTokens,
+		interval:         interval,
+		increase:         increase,
+		decrease:         decrease,
+		latencyThreshold: c.LatencyThreshold,
+		adjustInterval:   uint64(adjustInterval),
+		clock:            clock,
+
+		sweepInterval: sweepInterval,
+		sweepMinTTL:   uint64(sweepMinTTL),
+
+		data:   make(map[string]*state, initialAlloc),
+		stopCh: make(chan struct{}),
+	}
+
+	if !c.DisablePurge {
+		go as.purge()
+	}
+
+	return as, nil
+}
+
+// Take takes a token from the key on the underlying store. The first time a
+// key is seen, its limit is set to InitialTokens. If the underlying store has
+// since lost the key's bucket, for example to eviction, the adapted limit is set
+// again before taking.
+func (s *Store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, 0, false, limiter.ErrStopped
+	}
+
+	if _, err := s.lookup(ctx, key, s.clock.Now()); err != nil {
+		return 0, 0, 0, false, err
+	}
+	return s.store.Take(ctx, key)
+}
+
+// Get gets the current limit and remaining tokens for the key from the
+// underlying store.
+func (s *Store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, limiter.ErrStopped
+	}
+	return s.store.Get(ctx, key)
+}
+
+// Set sets the key's limit on the underlying store. Subsequent adjustments start
+// from the given number of tokens, and are still bounded by MinTokens and
+// MaxTokens.
+func (s *Store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	st, err := s.lookup(ctx, key, s.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if err := s.store.Set(ctx, key, tokens, interval); err != nil {
+		return err
+	}
+	st.tokens = tokens
+	return nil
+}
+
+// Burst adds tokens to the key on the underlying store. It does not change the
+// key's adaptive limit.
+func (s *Store) Burst(ctx context.Context, key string, tokens uint64) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+	return s.store.Burst(ctx, key, tokens)
+}
+
+// Report records the outcome of an operation for the key, which was permitted
+// by Take. latency is how long the operation took; it is only used if
+// LatencyThreshold is set.
+//
+// At most once per AdjustInterval, the key's limit is adjusted: if any errors
+// were reported since the previous adjustment, the limit is multiplied by
+// Decrease, otherwise it grows by Increase. The new limit is applied with Set on
+// the underlying store, which refills the key's bucket, so each adjustment also
+// grants a full interval's worth of tokens at the new limit.
+func (s *Store) Report(ctx context.Context, key string, outcome Outcome, latency time.Duration) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if s.latencyThreshold > 0 && latency > s.latencyThreshold {
+		outcome = OutcomeError
+	}
+	return s.report(ctx, key, outcome, s.clock.Now())
+}
+
+// Close stops the adaptive store and closes the underlying store.
+func (s *Store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	// Close the channel to prevent future purging.
+	close(s.stopCh)
+
+	// Delete all the things.
+	s.dataLock.Lock()
+	for k := range s.data {
+		delete(s.data, k)
+	}
+	s.dataLock.Unlock()
+
+	return s.store.Close(ctx)
+}
+
+// report records the outcome at the given time, adjusting the key's limit if
+// the adjustment interval has elapsed.
+func (s *Store) report(ctx context.Context, key string, outcome Outcome, now uint64) error {
+	st, err := s.lookup(ctx, key, now)
+	if err != nil {
+		return err
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if outcome == OutcomeError {
+		st.errors++
+	} else {
+		st.successes++
+	}
+
+	// The last adjustment may be in the future if the clock was reset.
+	if now < st.lastAdjust {
+		st.lastAdjust = now
+	}
+	if now-st.lastAdjust < s.adjustInterval {
+		return nil
+	}
+
+	tokens := st.tokens
+	if st.errors > 0 {
+		tokens = max(uint64(float64(tokens)*s.decrease), s.minTokens)
+	} else {
+		tokens = min(tokens+s.increase, s.maxTokens)
+	}
+	st.errors, st.successes = 0, 0
+	st.lastAdjust = now
+
+	if tokens == st.tokens {
+		return nil
+	}
+
+	if err := s.store.Set(ctx, key, tokens, s.interval); err != nil {
+		return fmt.Errorf("failed to adjust limit: %w", err)
+	}
+	st.tokens = tokens
+	return nil
+}
+
+// lookup returns the adaptive state for the key, creating it and setting the
+// initial limit on the underlying store if it does not exist.
+func (s *Store) lookup(ctx context.Context, key string, now uint64) (*state, error) {
+	for {
+		// Acquire a read lock first - this allows other to concurrently check
+		// limits without taking a full lock.
+		s.dataLock.RLock()
+		st, ok := s.data[key]
+		s.dataLock.RUnlock()
+		if ok {
+			// If another goroutine is still setting the initial limit, this waits
+			// for it. If that failed, start over.
+			if !st.touch(now) {
+				continue
+			}
+			if err := s.restore(ctx, key, st); err != nil {
+				return nil, err
+			}
+			return st, nil
+		}
+
+		// We did not find the key in the map. Take out a full lock and check
+		// again, since another goroutine may have created it in the meantime.
+		s.dataLock.Lock()
+		if _, ok := s.data[key]; ok {
+			s.dataLock.Unlock()
+			continue
+		}
+
+		// Add the state locked, so that other goroutines wait for the initial
+		// limit, but set it without holding the lock on the map.
+		st = &state{
+			tokens:     s.initialTokens,
+			lastAdjust: now,
+			lastSeen:   now,
+		}
+		st.lock.Lock()
+		s.data[key] = st
+		s.dataLock.Unlock()
+
+		if err := s.store.Set(ctx, key, s.initialTokens, s.interval); err != nil {
+			s.dataLock.Lock()
+			if s.data[key] == st {
+				delete(s.data, key)
+			}
+			s.dataLock.Unlock()
+
+			st.abandoned = true
+			st.lock.Unlock()
+			return nil, fmt.Errorf("failed to set initial limit: %w", err)
+		}
+		st.lock.Unlock()
+		return st, nil
+	}
+}
+
+// restore sets the key's adapted limit on the underlying store again if the
+// underlying store no longer has a bucket for the key, for example because it
+// was purged or evicted. Otherwise the key would silently fall back to the
+// underlying store's default limit.
+func (s *Store) restore(ctx context.Context, key string, st *state) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	tokens, _, err := s.store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get limit: %w", err)
+	}
+	if tokens != 0 {
+		return nil
+	}
+
+	if err := s.store.Set(ctx, key, st.tokens, s.interval); err != nil {
+		return fmt.Errorf("failed to restore limit: %w", err)
+	}
+	return nil
+}
+
+// purge continually iterates over the map and purges the state of keys which
+// have not been used within the sweep TTL. It follows the same model
+// as memorystore.
+func (s *Store) purge() {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		s.dataLock.RLock()
+		now := s.clock.Now()
+		var deletes []string
+		for k, st := range s.data {
+			if st.stale(now, s.sweepMinTTL) {
+				deletes = append(deletes, k)
+			}
+		}
+		s.dataLock.RUnlock()
+
+		// The key may have been used since it was picked, so check again under
+		// the write lock before deleting it.
+		for _, k := range deletes {
+			s.dataLock.Lock()
+			if st, ok := s.data[k]; ok && st.stale(now, s.sweepMinTTL) {
+				delete(s.data, k)
+			}
+			s.dataLock.Unlock()
+		}
+	}
+}
+
+// state is the adaptive state of a single key.
+type state struct {
+	// tokens is the key's current limit.
+	tokens uint64
+
+	// errors and successes are the number of outcomes reported since the last
+	// adjustment.
+	errors    uint64
+	successes uint64
+
+	// lastAdjust and lastSeen are the number of nanoseconds from unix epoch of
+	// the last adjustment and the last time the key was used.
+	lastAdjust uint64
+	lastSeen   uint64
+
+	// abandoned is true if the initial limit could not be set, and the state was
+	// removed from the map.
+	abandoned bool
+
+	// lock guards the mutable fields.
+	lock sync.Mutex
+}
+
+// touch records that the key was used at the given time. It returns false if
+// the state was abandoned.
+func (st *state) touch(now uint64) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.abandoned {
+		return false
+	}
+	if now > st.lastSeen {
+		st.lastSeen = now
+	}
+	return true
+}
+
+// stale returns true if the key has not been used within ttl of now.
+func (st *state) stale(now, ttl uint64) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	// The last use may be in the future if the clock was reset.
+	if st.lastSeen > now {
+		return false
+	}
+	return now-st.lastSeen > ttl
+}
@@ -0,0 +1,425 @@
+package adaptive
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/limitertest"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// blockingStore blocks Set for the key "slow" until release is closed. It
+// signals entered when the first such Set starts.
+type blockingStore struct {
+	limiter.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	if key == "slow" {
+		select {
+		case s.entered <- struct{}{}:
+		default:
+		}
+		<-s.release
+	}
+	return s.Store.Set(ctx, key, tokens, interval)
+}
+
+func newStore(tb testing.TB, c *Config) *Store {
+	tb.Helper()
+
+	ms, err := memorystore.New(&memorystore.Config{
+		Tokens:   c.MaxTokens,
+		Interval: time.Second,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s, err := New(ms, c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return s
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	ms, err := memorystore.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		store limiter.Store
+		c     *Config
+	}{
+		{
+			name:  "nil_store",
+			store: nil,
+			c:     &Config{MaxTokens: 10},
+		},
+		{
+			name:  "no_max",
+			store: ms,
+			c:     &Config{},
+		},
+		{
+			name:  "min_above_max",
+			store: ms,
+			c:     &Config{MaxTokens: 10, MinTokens: 11},
+		},
+		{
+			name:  "initial_out_of_range",
+			store: ms,
+			c:     &Config{MaxTokens: 10, InitialTokens: 11},
+		},
+		{
+			name:  "decrease_too_large",
+			store: ms,
+			c:     &Config{MaxTokens: 10, Decrease: 1},
+		},
+		{
+			name:  "decrease_negative",
+			store: ms,
+			c:     &Config{MaxTokens: 10, Decrease: -0.5},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := New(tc.store, tc.c); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestStore_Take(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s := newStore(t, &Config{
+		MaxTokens:     10,
+		InitialTokens: 4,
+	})
+
+	// The key starts with the initial number of tokens, not the underlying
+	// store's default.
+	limit, remaining, _, ok, err := s.Take(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected take to be allowed")
+	}
+	if got, want := limit, uint64(4); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := remaining, uint64(3); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_Take_evicted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ms, err := memorystore.New(&memorystore.Config{
+		Tokens:   10,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(ms, &Config{
+		MaxTokens:     10,
+		InitialTokens: 4,
+		Interval:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The underlying store loses the bucket, which must not reset the key to the
+	// underlying store's default limit.
+	if err := ms.(limiter.StoreWithDelete).Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	limit, remaining, _, ok, err := s.Take(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected take to be allowed")
+	}
+	if got, want := limit, uint64(4); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := remaining, uint64(3); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_lookup(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ms, err := memorystore.New(&memorystore.Config{
+		Tokens:   10,
+		Interval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := &blockingStore{
+		Store:   ms,
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	s, err := New(bs, &Config{MaxTokens: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, _, _, err := s.Take(ctx, "slow")
+			done <- err
+		}()
+	}
+
+	// Setting the initial limit for one key must not block other keys.
+	<-bs.entered
+	if _, _, _, _, err := s.Take(ctx, "fast"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(bs.release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The initial limit was only set once.
+	if _, remaining, err := s.Get(ctx, "slow"); err != nil || remaining != 8 {
+		t.Errorf("expected 8 remaining, got %d (%v)", remaining, err)
+	}
+}
+
+func TestStore_report(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	type step struct {
+		at      time.Duration
+		outcome Outcome
+		tokens  uint64
+	}
+
+	cases := []struct {
+		name  string
+		c     *Config
+		steps []step
+	}{
+		{
+			name: "additive_increase",
+			c:    &Config{MaxTokens: 10, InitialTokens: 5, Increase: 2},
+			steps: []step{
+				{at: 500 * time.Millisecond, outcome: OutcomeSuccess, tokens: 5},
+				{at: time.Second, outcome: OutcomeSuccess, tokens: 7},
+				{at: 2 * time.Second, outcome: OutcomeSuccess, tokens: 9},
+				{at: 3 * time.Second, outcome: OutcomeSuccess, tokens: 10},
+				{at: 4 * time.Second, outcome: OutcomeSuccess, tokens: 10},
+			},
+		},
+		{
+			name: "multiplicative_decrease",
+			c:    &Config{MaxTokens: 100, MinTokens: 10},
+			steps: []step{
+				{at: time.Second, outcome: OutcomeError, tokens: 50},
+				{at: 2 * time.Second, outcome: OutcomeError, tokens: 25},
+				{at: 3 * time.Second, outcome: OutcomeError, tokens: 12},
+				{at: 4 * time.Second, outcome: OutcomeError, tokens: 10},
+			},
+		},
+		{
+			name: "aggregates_within_interval",
+			c:    &Config{MaxTokens: 100, AdjustInterval: 2 * time.Second},
+			steps: []step{
+				{at: 500 * time.Millisecond, outcome: OutcomeError, tokens: 100},
+				{at: time.Second, outcome: OutcomeSuccess, tokens: 100},
+				{at: 2 * time.Second, outcome: OutcomeSuccess, tokens: 50},
+				{at: 4 * time.Second, outcome: OutcomeSuccess, tokens: 51},
+			},
+		},
+		{
+			name: "recovers",
+			c:    &Config{MaxTokens: 10, Increase: 5},
+			steps: []step{
+				{at: time.Second, outcome: OutcomeError, tokens: 5},
+				{at: 2 * time.Second, outcome: OutcomeSuccess, tokens: 10},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newStore(t, tc.c)
+
+			start := uint64(time.Hour)
+			if _, err := s.lookup(ctx, "key", start); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, step := range tc.steps {
+				if err := s.report(ctx, "key", step.outcome, start+uint64(step.at)); err != nil {
+					t.Fatal(err)
+				}
+
+				limit, _, err := s.Get(ctx, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := limit, step.tokens; got != want {
+					t.Errorf("step %d: expected %d to be %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStore_Report_latency(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	clock := fakeclock.New(time.Unix(0, 0).Add(time.Hour))
+	s := newStore(t, &Config{
+		MaxTokens:        10,
+		LatencyThreshold: 100 * time.Millisecond,
+		AdjustInterval:   time.Nanosecond,
+		Clock:            clock,
+	})
+
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A slow success counts as an error.
+	clock.Advance(time.Millisecond)
+	if err := s.Report(ctx, "key", OutcomeSuccess, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	limit, _, err := s.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := limit, uint64(5); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ms, err := memorystore.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(ms, &Config{MaxTokens: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing twice is fine.
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+	if err := s.Report(ctx, "key", OutcomeSuccess, 0); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	// The underlying store was closed too.
+	if _, _, _, _, err := ms.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		ms, err := memorystore.New(&memorystore.Config{
+			Tokens:   10,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := New(ms, &Config{
+			MaxTokens: 10,
+			Interval:  time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
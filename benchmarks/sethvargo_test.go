@@ -3,7 +3,9 @@ package benchmarks
 import (
 	"context"
 	"math"
+	"math/rand"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -180,3 +182,144 @@ func BenchmarkSethVargoRedis(b *testing.B) {
 		})
 	}
 }
+
+// churnKeys is a large set of keys for the churn benchmarks, so that most takes
+// are for a key the store has not seen recently.
+var churnKeys = func() []string {
+	keys := make([]string, 1<<20)
+	for i := range keys {
+		keys[i] = "churn-" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+// BenchmarkSethVargoMemoryChurn measures parallel takes under high key churn.
+// Keys are swept almost as soon as they are created, so nearly every take
+// creates a new bucket and needs an exclusive lock. With a single shard, that
+// lock is global; with more shards, it only blocks keys in the same shard.
+func BenchmarkSethVargoMemoryChurn(b *testing.B) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		shards int
+	}{
+		{
+			name:   "shards_1",
+			shards: 1,
+		},
+		{
+			name:   "shards_32",
+			shards: 32,
+		},
+		{
+			name:   "shards_256",
+			shards: 256,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		b.Run(tc.name, func(b *testing.B) {
+			store, err := memorystore.New(&memorystore.Config{
+				SweepInterval: SessionSweepInterval,
+				SweepMinTTL:   SessionMinTTL,
+				Interval:      SessionDefaultInterval,
+				Tokens:        SessionDefaultTokens,
+				Shards:        tc.shards,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				if err := store.Close(ctx); err != nil {
+					b.Fatal(err)
+				}
+			})
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				// Start each goroutine at a different offset, so they do not walk the
+				// keys in lockstep.
+				for i := rand.Intn(len(churnKeys)); pb.Next(); i++ {
+					store.Take(ctx, churnKeys[i%len(churnKeys)])
+				}
+			})
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkSethVargoMemorySingleKey measures takes from a single, global key,
+// where every take contends for the same bucket, with the default bucket and
+// the lock-free bucket.
+func BenchmarkSethVargoMemorySingleKey(b *testing.B) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		lockFree bool
+	}{
+		{
+			name:     "locked",
+			lockFree: false,
+		},
+		{
+			name:     "lock_free",
+			lockFree: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		b.Run(tc.name, func(b *testing.B) {
+			b.Run("serial", func(b *testing.B) {
+				store, err := memorystore.New(&memorystore.Config{
+					Interval: time.Second,
+					Tokens:   math.MaxUint32,
+					LockFree: tc.lockFree,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() {
+					if err := store.Close(ctx); err != nil {
+						b.Fatal(err)
+					}
+				})
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					store.Take(ctx, "global")
+				}
+				b.StopTimer()
+			})
+
+			b.Run("parallel", func(b *testing.B) {
+				store, err := memorystore.New(&memorystore.Config{
+					Interval: time.Second,
+					Tokens:   math.MaxUint32,
+					LockFree: tc.lockFree,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() {
+					if err := store.Close(ctx); err != nil {
+						b.Fatal(err)
+					}
+				})
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						store.Take(ctx, "global")
+					}
+				})
+				b.StopTimer()
+			})
+		})
+	}
+}
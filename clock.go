@@ -0,0 +1,21 @@
+package limiter
+
+import "github.com/sethvargo/go-limiter/internal/fasttime"
+
+// Clock is the source of the current time for a store. Stores use
+// SystemClock by default, but accept a Clock so that tests can control time
+// deterministically. See the fakeclock package for a controllable
+// implementation.
+type Clock interface {
+	// Now returns the current time as the number of nanoseconds since the unix
+	// epoch. It must be safe for concurrent use.
+	Now() uint64
+}
+
+// SystemClock is the default Clock, which reads the system's wall clock.
+type SystemClock struct{}
+
+// Now returns the current time in nanoseconds since the unix epoch.
+func (SystemClock) Now() uint64 {
+	return fasttime.Now()
+}
@@ -0,0 +1,43 @@
+package compositestore_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/compositestore"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Allow 10 requests per second, but no more than 1000 per hour.
+	perSecond, err := memorystore.New(&memorystore.Config{
+		Tokens:   10,
+		Interval: time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	perHour, err := memorystore.New(&memorystore.Config{
+		Tokens:   1000,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := compositestore.New(perSecond, perHour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
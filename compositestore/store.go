@@ -0,0 +1,203 @@
+// Package compositestore defines a storage system for limiting which enforces
+// several limits at once, such as 10 per second AND 1000 per hour AND 10000 per
+// day. Each limit is its own store, and a take only succeeds if every store has
+// capacity.
+package compositestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+type store struct {
+	stores []limiter.StoreWithRefund
+}
+
+// New creates a store which takes from each of the given stores for every
+// request. Each store must implement limiter.StoreWithRefund, so that tokens can
+// be returned to the stores which permitted a take when a later store rejects
+// it.
+//
+// Stores are consulted in order, so putting the most restrictive store first
+// avoids unnecessary takes and refunds. Closing the composite store closes all
+// of the underlying stores.
+func New(stores ...limiter.Store) (limiter.Store, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("at least one store is required")
+	}
+
+	s := &store{
+		stores: make([]limiter.StoreWithRefund, 0, len(stores)),
+	}
+	for i, st := range stores {
+		if st == nil {
+			return nil, fmt.Errorf("store %d cannot be nil", i)
+		}
+
+		rs, ok := st.(limiter.StoreWithRefund)
+		if !ok {
+			return nil, fmt.Errorf("store %d does not support refunds: %w", i, errors.ErrUnsupported)
+		}
+		s.stores = append(s.stores, rs)
+	}
+
+	return s, nil
+}
+
+// Take takes a token from every store. It is equivalent to TakeN with n = 1.
+func (s *store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN takes n tokens from every store. If any store rejects the take or
+// returns an error, the tokens already taken from the preceding stores are
+// refunded, so a rejection never consumes tokens from the looser limits.
+//
+// If the take is successful, it returns the limit, remaining tokens, and reset
+// time of the store with the fewest remaining tokens. If it is unsuccessful, it
+// returns the values from the store which rejected it.
+func (s *store) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
+	i, tokens, remaining, reset, ok, err := takeEach(ctx, s.stores, func(int) string { return key }, n)
+	if err != nil {
+		return 0, 0, 0, false, fmt.Errorf("failed to take from store %d: %w", i, err)
+	}
+	return tokens, remaining, reset, ok, nil
+}
+
+// TakeEach is like the composite store's TakeN, but takes from each store under
+// its own key: keys[i] is the key for stores[i]. This applies limits which are
+// keyed differently, such as a per-user limit and a per-organization limit,
+// with a single decision.
+//
+// It also returns the index of the store whose values are returned: the store
+// which rejected the take, the most restrictive store if the take was
+// successful, or the store which returned an error. Errors are not wrapped with
+// the index, so that callers can name the store in their own terms.
+func TakeEach(ctx context.Context, stores []limiter.StoreWithRefund, keys []string, n uint64) (int, uint64, uint64, uint64, bool, error) {
+	if got, want := len(keys), len(stores); got != want {
+		return 0, 0, 0, 0, false, fmt.Errorf("expected %d keys, got %d", want, got)
+	}
+	return takeEach(ctx, stores, func(i int) string { return keys[i] }, n)
+}
+
+// takeEach takes n tokens from every store, using key(i) as the key for the
+// i-th store. Errors are returned with the index of the store which failed,
+// and callers wrap them.
+func takeEach(ctx context.Context, stores []limiter.StoreWithRefund, key func(int) string, n uint64) (int, uint64, uint64, uint64, bool, error) {
+	var index int
+	var tokens, remaining, reset uint64
+	resets := make([]uint64, 0, len(stores))
+
+	for i, st := range stores {
+		t, r, rs, ok, err := limiter.TakeN(ctx, st, key(i), n)
+		if err != nil {
+			return i, 0, 0, 0, false, errors.Join(err, refund(ctx, stores, key, n, resets))
+		}
+		if !ok {
+			if err := refund(ctx, stores, key, n, resets); err != nil {
+				return i, 0, 0, 0, false, err
+			}
+			return i, t, r, rs, false, nil
+		}
+		resets = append(resets, rs)
+
+		// Report the most restrictive limit. If two stores have the same number of
+		// remaining tokens, the one which resets later is more restrictive.
+		if i == 0 || r < remaining || (r == remaining && rs > reset) {
+			index, tokens, remaining, reset = i, t, r, rs
+		}
+	}
+
+	return index, tokens, remaining, reset, true, nil
+}
+
+// refund returns n tokens to the first len(resets) stores.
+func refund(ctx context.Context, stores []limiter.StoreWithRefund, key func(int) string, n uint64, resets []uint64) error {
+	var merr error
+	for i, reset := range resets {
+		if err := stores[i].Refund(ctx, key(i), n, reset); err != nil {
+			merr = errors.Join(merr, fmt.Errorf("failed to refund store %d: %w", i, err))
+		}
+	}
+	return merr
+}
+
+// Get returns the limit and remaining tokens of the store with the fewest
+// remaining tokens. A store which has no record of the key would start it with
+// a full bucket, so its limit is read with a take of zero tokens, if the store
+// supports weighted takes, and counted as remaining. Otherwise, the store is
+// ignored.
+func (s *store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	var tokens, remaining uint64
+	var found bool
+
+	for i, st := range s.stores {
+		t, r, err := st.Get(ctx, key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if t == 0 {
+			sn, ok := st.(limiter.StoreWithTakeN)
+			if !ok {
+				continue
+			}
+			if t, r, _, _, err = sn.TakeN(ctx, key, 0); err != nil {
+				return 0, 0, fmt.Errorf("failed to read the limit of store %d: %w", i, err)
+			}
+		}
+
+		if !found || r < remaining {
+			tokens, remaining, found = t, r, true
+		}
+	}
+
+	return tokens, remaining, nil
+}
+
+// Set is not supported, since it is ambiguous which of the limits to change.
+// Call Set on the underlying stores instead.
+func (s *store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	return fmt.Errorf("set the limit on the underlying stores: %w", errors.ErrUnsupported)
+}
+
+// Burst adds tokens to the key in every store.
+func (s *store) Burst(ctx context.Context, key string, tokens uint64) error {
+	for i, st := range s.stores {
+		if err := st.Burst(ctx, key, tokens); err != nil {
+			return fmt.Errorf("failed to burst store %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the key from every store which supports it.
+func (s *store) Delete(ctx context.Context, key string) error {
+	for i, st := range s.stores {
+		if ds, ok := st.(limiter.StoreWithDelete); ok {
+			if err := ds.Delete(ctx, key); err != nil {
+				return fmt.Errorf("failed to delete from store %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes all of the underlying stores.
+func (s *store) Close(ctx context.Context) error {
+	var merr error
+	for i, st := range s.stores {
+		if err := st.Close(ctx); err != nil {
+			merr = errors.Join(merr, fmt.Errorf("failed to close store %d: %w", i, err))
+		}
+	}
+	return merr
+}
@@ -0,0 +1,332 @@
+package compositestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// takeOnlyStore hides any optional interfaces implemented by the wrapped store.
+type takeOnlyStore struct {
+	limiter.Store
+}
+
+func newMemoryStore(tb testing.TB, tokens uint64, interval time.Duration) limiter.Store {
+	tb.Helper()
+
+	s, err := memorystore.New(&memorystore.Config{
+		Tokens:   tokens,
+		Interval: interval,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		stores []limiter.Store
+		err    error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "nil",
+			stores: []limiter.Store{nil},
+		},
+		{
+			name:   "no_refunds",
+			stores: []limiter.Store{&takeOnlyStore{newMemoryStore(t, 1, time.Second)}},
+			err:    errors.ErrUnsupported,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := New(tc.stores...)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected %v to be %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestStore_Take(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name  string
+		tight bool // whether the tight store is first
+	}{
+		{
+			name:  "tight_first",
+			tight: true,
+		},
+		{
+			name:  "loose_first",
+			tight: false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tight := newMemoryStore(t, 2, time.Hour)
+			loose := newMemoryStore(t, 5, 24*time.Hour)
+
+			stores := []limiter.Store{tight, loose}
+			if !tc.tight {
+				stores = []limiter.Store{loose, tight}
+			}
+
+			s, err := New(stores...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			// The tight store is the most restrictive, so its values are reported.
+			for i := uint64(0); i < 2; i++ {
+				limit, remaining, _, ok, err := s.Take(ctx, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Fatalf("expected take %d to be ok", i)
+				}
+				if got, want := limit, uint64(2); got != want {
+					t.Errorf("limit: expected %d to be %d", got, want)
+				}
+				if got, want := remaining, 1-i; got != want {
+					t.Errorf("remaining: expected %d to be %d", got, want)
+				}
+			}
+
+			limit, remaining, reset, ok, err := s.Take(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				t.Fatal("expected take to be rejected")
+			}
+			if got, want := limit, uint64(2); got != want {
+				t.Errorf("limit: expected %d to be %d", got, want)
+			}
+			if got, want := remaining, uint64(0); got != want {
+				t.Errorf("remaining: expected %d to be %d", got, want)
+			}
+			if got, want := time.Until(time.Unix(0, int64(reset))), time.Hour; got > want {
+				t.Errorf("reset: expected %v to be less than %v", got, want)
+			}
+
+			// The rejected take must not have consumed from the loose store.
+			_, remaining, err = loose.Get(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := remaining, uint64(3); got != want {
+				t.Errorf("loose remaining: expected %d to be %d", got, want)
+			}
+
+			// Get reports the most restrictive store, too.
+			limit, remaining, err = s.Get(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := limit, uint64(2); got != want {
+				t.Errorf("limit: expected %d to be %d", got, want)
+			}
+			if got, want := remaining, uint64(0); got != want {
+				t.Errorf("remaining: expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_TakeN(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	first := newMemoryStore(t, 10, time.Hour)
+	second := newMemoryStore(t, 4, time.Hour)
+
+	s, err := New(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	takeN := s.(limiter.StoreWithTakeN).TakeN
+	if _, _, _, ok, err := takeN(ctx, "key", 3); err != nil || !ok {
+		t.Fatalf("expected ok, got %t (%v)", ok, err)
+	}
+	if _, _, _, ok, err := takeN(ctx, "key", 3); err != nil || ok {
+		t.Fatalf("expected not ok, got %t (%v)", ok, err)
+	}
+
+	// The first store permitted the second take, so it must have been refunded.
+	_, remaining, err := first.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining, uint64(7); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestTakeEach(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	org := newMemoryStore(t, 3, time.Hour).(limiter.StoreWithRefund)
+	user := newMemoryStore(t, 2, time.Hour).(limiter.StoreWithRefund)
+	stores := []limiter.StoreWithRefund{org, user}
+
+	if _, _, _, _, _, err := TakeEach(ctx, stores, []string{"org"}, 1); err == nil {
+		t.Error("expected error")
+	}
+
+	// The user is the most restrictive until its tokens run out.
+	for i, want := range []struct {
+		index     int
+		remaining uint64
+		ok        bool
+	}{
+		{index: 1, remaining: 1, ok: true},
+		{index: 1, remaining: 0, ok: true},
+		{index: 1, remaining: 0, ok: false},
+	} {
+		index, _, remaining, _, ok, err := TakeEach(ctx, stores, []string{"org", "user"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := index, want.index; got != want {
+			t.Errorf("take %d: index: expected %d to be %d", i, got, want)
+		}
+		if got, want := remaining, want.remaining; got != want {
+			t.Errorf("take %d: remaining: expected %d to be %d", i, got, want)
+		}
+		if got, want := ok, want.ok; got != want {
+			t.Errorf("take %d: ok: expected %t to be %t", i, got, want)
+		}
+	}
+
+	// Each store was taken from under its own key, and the rejected take was
+	// refunded.
+	if _, remaining, err := org.Get(ctx, "org"); err != nil || remaining != 1 {
+		t.Errorf("expected org to have 1 token, got %d (%v)", remaining, err)
+	}
+	if _, remaining, err := org.Get(ctx, "user"); err != nil || remaining != 0 {
+		t.Errorf("expected org to have no bucket for user, got %d (%v)", remaining, err)
+	}
+}
+
+func TestStore_Get(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	strict := newMemoryStore(t, 2, time.Second)
+	loose := newMemoryStore(t, 10, time.Hour)
+
+	s, err := New(strict, loose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The strict store has no bucket for the key, so it counts as full, which is
+	// still fewer tokens than the loose store has left.
+	if _, _, _, _, err := loose.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	limit, remaining, err := s.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := limit, uint64(2); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := remaining, uint64(2); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_Burst(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(newMemoryStore(t, 1, time.Hour), newMemoryStore(t, 1, 24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := s.Burst(ctx, "key", 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+			t.Fatalf("take %d: expected ok, got %t (%v)", i, ok, err)
+		}
+	}
+	if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || ok {
+		t.Fatalf("expected not ok, got %t (%v)", ok, err)
+	}
+
+	if err := s.Set(ctx, "key", 1, time.Second); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected %v to be %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(newMemoryStore(t, 1, time.Hour), newMemoryStore(t, 1, 24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+}
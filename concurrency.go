@@ -0,0 +1,40 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrNotAcquired is the error returned when releasing a slot for a key which has
+// no slots acquired.
+var ErrNotAcquired = fmt.Errorf("no slot acquired for key")
+
+// ConcurrencyStore is an interface for limiting the number of operations which
+// are in flight at the same time for a key, such as "at most 10 concurrent
+// requests per user". Unlike a Store, which limits how often an operation may
+// start, a ConcurrencyStore limits how many may be running at once, so slow
+// operations cannot pile up.
+//
+// See the note about keys on the Store interface documentation.
+type ConcurrencyStore interface {
+	// Acquire attempts to acquire a slot for the given key, returning:
+	//
+	// - the configured limit
+	// - the number of slots remaining after this acquisition
+	// - whether the acquisition was successful
+	// - any errors that occurred - these should be backend errors
+	//
+	// If "ok" is true, the caller must call Release exactly once when the
+	// operation finishes. If "ok" is false, no slot was acquired and the caller
+	// should NOT service the request.
+	Acquire(ctx context.Context, key string) (limit, remaining uint64, ok bool, err error)
+
+	// Release returns a slot acquired with Acquire for the given key. It returns
+	// ErrNotAcquired if the key has no slots acquired.
+	Release(ctx context.Context, key string) error
+
+	// Close terminates the store and cleans up any data structures or
+	// connections that may remain open. After a store is stopped, Acquire()
+	// should always return ErrStopped.
+	Close(ctx context.Context) error
+}
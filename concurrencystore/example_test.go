@@ -0,0 +1,33 @@
+package concurrencystore_test
+
+import (
+	"context"
+	"log"
+
+	"github.com/sethvargo/go-limiter/concurrencystore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Allow at most 10 operations in flight for each key.
+	store, err := concurrencystore.New(&concurrencystore.Config{
+		Limit: 10,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	_, _, ok, err := store.Acquire(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		log.Printf("too many operations in flight")
+		return
+	}
+	defer store.Release(ctx, "my-key")
+
+	// Do the work.
+}
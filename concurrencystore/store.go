@@ -0,0 +1,301 @@
+// Package concurrencystore defines an in-memory store which limits the number
+// of operations in flight at the same time for each key.
+package concurrencystore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+var _ limiter.ConcurrencyStore = (*store)(nil)
+
+type store struct {
+	limit uint64
+	clock limiter.Clock
+
+	sweepInterval time.Duration
+	sweepMinTTL   uint64
+
+	data     map[string]*slots
+	dataLock sync.RWMutex
+
+	stopped uint32
+	stopCh  chan struct{}
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Limit is the maximum number of operations which may be in flight at the
+	// same time for a single key. The default value is 1.
+	Limit uint64
+
+	// SweepInterval is the rate at which to run the garbage collection on stale
+	// entries. The default value is 6 hours.
+	SweepInterval time.Duration
+
+	// SweepMinTTL is the minimum amount of time a key must be idle before
+	// clearing it from the entries. Keys with slots acquired are never cleared.
+	// The default value is 12 hours.
+	SweepMinTTL time.Duration
+
+	// InitialAlloc is the size to use for the in-memory map. The default value is
+	// 4096.
+	InitialAlloc int
+
+	// DisablePurge disables the purge operation. WARNING: this will cause
+	// unbounded memory growth. Do not enable unless you have a fixed number of
+	// keys.
+	DisablePurge bool
+
+	// Clock is the source of the current time. It is used to decide which
+	// entries are idle, but not to schedule the purge. The default value is the
+	// system clock.
+	Clock limiter.Clock
+}
+
+// New creates an in-memory concurrency limiter. Each key may have at most Limit
+// slots acquired at once.
+func New(c *Config) (limiter.ConcurrencyStore, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	limit := uint64(1)
+	if c.Limit > 0 {
+		limit = c.Limit
+	}
+
+	sweepInterval := 6 * time.Hour
+	if c.SweepInterval > 0 {
+		sweepInterval = c.SweepInterval
+	}
+
+	sweepMinTTL := 12 * time.Hour
+	if c.SweepMinTTL > 0 {
+		sweepMinTTL = c.SweepMinTTL
+	}
+
+	initialAlloc := 4096
+	if c.InitialAlloc > 0 {
+		initialAlloc = c.InitialAlloc
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	s := &store{
+		limit: limit,
+		clock: clock,
+
+		sweepInterval: sweepInterval,
+		sweepMinTTL:   uint64(sweepMinTTL),
+
+		data:   make(map[string]*slots, initialAlloc),
+		stopCh: make(chan struct{}),
+	}
+
+	if !c.DisablePurge {
+		go s.purge()
+	}
+
+	return s, nil
+}
+
+// Acquire acquires a slot for the key, if fewer than the limit are in use.
+func (s *store) Acquire(ctx context.Context, key string) (uint64, uint64, bool, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, false, limiter.ErrStopped
+	}
+
+	for {
+		now := s.clock.Now()
+
+		// Acquire a read lock first - this allows other to concurrently check
+		// limits without taking a full lock.
+		s.dataLock.RLock()
+		sl, ok := s.data[key]
+		s.dataLock.RUnlock()
+
+		if !ok {
+			// We did not find the key in the map. Take out a full lock and check
+			// again, since another goroutine may have created it in the meantime.
+			s.dataLock.Lock()
+			sl, ok = s.data[key]
+			if !ok {
+				sl = new(slots)
+				s.data[key] = sl
+			}
+			s.dataLock.Unlock()
+		}
+
+		// The entry may have been purged between looking it up and acquiring it,
+		// in which case look it up again.
+		if remaining, ok, live := sl.acquire(now, s.limit); live {
+			return s.limit, remaining, ok, nil
+		}
+	}
+}
+
+// Release returns a slot for the key.
+func (s *store) Release(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	s.dataLock.RLock()
+	sl, ok := s.data[key]
+	s.dataLock.RUnlock()
+
+	if !ok {
+		return limiter.ErrNotAcquired
+	}
+	return sl.release(s.clock.Now())
+}
+
+// Close stops the store and cleans up any outstanding slots.
+func (s *store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	// Close the channel to prevent future purging.
+	close(s.stopCh)
+
+	// Delete all the things.
+	s.dataLock.Lock()
+	for k := range s.data {
+		delete(s.data, k)
+	}
+	s.dataLock.Unlock()
+	return nil
+}
+
+// purge continually iterates over the map and purges idle keys on the provided
+// sweep interval. It follows the same model as memorystore, except that keys
+// with slots acquired are never purged.
+func (s *store) purge() {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		s.sweep(s.clock.Now())
+	}
+}
+
+// sweep deletes the keys which are idle at now.
+func (s *store) sweep(now uint64) {
+	s.dataLock.RLock()
+	var deletes []string
+	for k, sl := range s.data {
+		if sl.idle(now, s.sweepMinTTL) {
+			deletes = append(deletes, k)
+		}
+	}
+	s.dataLock.RUnlock()
+
+	for _, k := range deletes {
+		s.dataLock.Lock()
+		// Check again under the full lock, since the key may have been acquired
+		// in the meantime.
+		if sl, ok := s.data[k]; ok && sl.retire(now, s.sweepMinTTL) {
+			delete(s.data, k)
+		}
+		s.dataLock.Unlock()
+	}
+}
+
+// slots is the state of a single key.
+type slots struct {
+	// inUse is the number of slots currently acquired.
+	inUse uint64
+
+	// last is the number of nanoseconds from unix epoch when the key was last
+	// acquired or released.
+	last uint64
+
+	// retired is true once the entry has been removed from the map. A retired
+	// entry must not be acquired, since it is no longer reachable by Release.
+	retired bool
+
+	// lock guards the mutable fields.
+	lock sync.Mutex
+}
+
+// acquire acquires a slot if fewer than limit are in use. It returns the number
+// of slots remaining, whether the slot was acquired, and whether the entry is
+// still live. If the entry is not live, nothing was acquired.
+func (sl *slots) acquire(now, limit uint64) (uint64, bool, bool) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	if sl.retired {
+		return 0, false, false
+	}
+
+	if sl.inUse >= limit {
+		return 0, false, true
+	}
+
+	sl.inUse++
+	sl.last = now
+	return limit - sl.inUse, true, true
+}
+
+// release returns a slot.
+func (sl *slots) release(now uint64) error {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	if sl.inUse == 0 {
+		return limiter.ErrNotAcquired
+	}
+
+	sl.inUse--
+	sl.last = now
+	return nil
+}
+
+// idle reports whether no slots are acquired and the entry has not been used
+// for longer than ttl.
+func (sl *slots) idle(now, ttl uint64) bool {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.idleLocked(now, ttl)
+}
+
+// retire marks the entry as retired if it is idle, and reports whether it did.
+func (sl *slots) retire(now, ttl uint64) bool {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	if !sl.idleLocked(now, ttl) {
+		return false
+	}
+	sl.retired = true
+	return true
+}
+
+func (sl *slots) idleLocked(now, ttl uint64) bool {
+	if sl.inUse > 0 {
+		return false
+	}
+
+	// The last use may be in the future if the clock was reset.
+	if sl.last > now {
+		return false
+	}
+	return now-sl.last > ttl
+}
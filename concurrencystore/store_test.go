@@ -0,0 +1,237 @@
+package concurrencystore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+)
+
+func TestStore_Acquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Limit:         2,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for i, want := range []uint64{1, 0} {
+		limit, remaining, ok, err := s.Acquire(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected acquire %d to succeed", i)
+		}
+		if got, want := limit, uint64(2); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+		if got := remaining; got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	}
+
+	// The key is at its limit.
+	if _, remaining, ok, err := s.Acquire(ctx, "key"); err != nil || ok || remaining != 0 {
+		t.Errorf("expected acquire to fail, got %d, %t, %v", remaining, ok, err)
+	}
+
+	// Other keys have their own slots.
+	if _, _, ok, err := s.Acquire(ctx, "other"); err != nil || !ok {
+		t.Errorf("expected other key to be acquired, got %t, %v", ok, err)
+	}
+
+	// Releasing a slot makes room for another.
+	if err := s.Release(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, ok, err := s.Acquire(ctx, "key"); err != nil || !ok || remaining != 0 {
+		t.Errorf("expected acquire to succeed, got %d, %t, %v", remaining, ok, err)
+	}
+}
+
+func TestStore_Release(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := s.Release(ctx, "missing"); !errors.Is(err, limiter.ErrNotAcquired) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrNotAcquired)
+	}
+
+	if _, _, ok, err := s.Acquire(ctx, "key"); err != nil || !ok {
+		t.Fatalf("expected acquire to succeed, got %t, %v", ok, err)
+	}
+	if err := s.Release(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing more than was acquired is an error.
+	if err := s.Release(ctx, "key"); !errors.Is(err, limiter.ErrNotAcquired) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrNotAcquired)
+	}
+}
+
+func TestStore_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	const limit = 5
+
+	s, err := New(&Config{
+		Limit: limit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var lock sync.Mutex
+	var inFlight, peak int
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				_, _, ok, err := s.Acquire(ctx, "key")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					continue
+				}
+
+				lock.Lock()
+				inFlight++
+				peak = max(peak, inFlight)
+				lock.Unlock()
+
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+
+				if err := s.Release(ctx, "key"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > limit {
+		t.Errorf("expected at most %d in flight, got %d", limit, peak)
+	}
+}
+
+func TestStore_purge(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	clock := fakeclock.New(time.Unix(0, 0).Add(time.Hour))
+	s, err := New(&Config{
+		SweepMinTTL:  time.Minute,
+		DisablePurge: true,
+		Clock:        clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, _, ok, err := s.Acquire(ctx, "held"); err != nil || !ok {
+		t.Fatalf("expected acquire to succeed, got %t, %v", ok, err)
+	}
+	if _, _, ok, err := s.Acquire(ctx, "idle"); err != nil || !ok {
+		t.Fatalf("expected acquire to succeed, got %t, %v", ok, err)
+	}
+	if err := s.Release(ctx, "idle"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	st := s.(*store)
+	st.sweep(clock.Now())
+
+	st.dataLock.RLock()
+	_, held := st.data["held"]
+	_, idle := st.data["idle"]
+	st.dataLock.RUnlock()
+
+	if !held {
+		t.Error("expected key with acquired slots to be kept")
+	}
+	if idle {
+		t.Error("expected idle key to be purged")
+	}
+
+	// The held slot can still be released.
+	if err := s.Release(ctx, "held"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing twice is fine.
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := s.Acquire(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+	if err := s.Release(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+}
@@ -0,0 +1,46 @@
+// Package fakeclock provides a limiter.Clock whose time only changes when told
+// to, so that tests can move time across interval boundaries, rewind it, and
+// expire entries without sleeping.
+package fakeclock
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+var _ limiter.Clock = (*Clock)(nil)
+
+// Clock is a fake clock. It is safe for concurrent use.
+type Clock struct {
+	// now is the current time in nanoseconds since the unix epoch.
+	now uint64
+}
+
+// New creates a fake clock set to the given time.
+func New(t time.Time) *Clock {
+	return &Clock{now: uint64(t.UnixNano())}
+}
+
+// Now returns the fake clock's current time in nanoseconds since the unix
+// epoch.
+func (c *Clock) Now() uint64 {
+	return atomic.LoadUint64(&c.now)
+}
+
+// Time returns the fake clock's current time.
+func (c *Clock) Time() time.Time {
+	return time.Unix(0, int64(c.Now()))
+}
+
+// Advance moves the clock forward by d. If d is negative, the clock moves
+// backwards, simulating a clock reset.
+func (c *Clock) Advance(d time.Duration) {
+	atomic.AddUint64(&c.now, uint64(d))
+}
+
+// Set sets the clock to the given time, which may be before the current time.
+func (c *Clock) Set(t time.Time) {
+	atomic.StoreUint64(&c.now, uint64(t.UnixNano()))
+}
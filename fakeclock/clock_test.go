@@ -0,0 +1,32 @@
+package fakeclock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(start)
+
+	if got, want := c.Now(), uint64(start.UnixNano()); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	c.Advance(time.Second)
+	if got, want := c.Time(), start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	c.Advance(-2 * time.Second)
+	if got, want := c.Time(), start.Add(-time.Second); !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	c.Set(start)
+	if got, want := c.Time(), start; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package filestore_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/filestore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Allow each user to send 100 emails per day, even if the process restarts.
+	store, err := filestore.New(&filestore.Config{
+		Dir:      "/var/lib/myapp/limits",
+		Tokens:   100,
+		Interval: 24 * time.Hour,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	_, _, _, ok, err := store.Take(ctx, "user:42")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		log.Printf("daily email quota exceeded")
+	}
+}
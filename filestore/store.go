@@ -0,0 +1,794 @@
+// Package filestore defines a store which keeps its buckets in memory, like
+// memorystore, but also records every change in a write-ahead log on local
+// disk. When the store is created, it recovers the buckets from the log, so
+// limits survive restarts and crashes without an external service.
+//
+// The directory holds a snapshot of every bucket, and a log of the operations
+// since the snapshot was taken. The log is compacted into a new snapshot
+// periodically, once it holds CompactSize operations, and when the store is
+// closed. Compaction starts a new log, and removes the old one once the new
+// snapshot is written.
+//
+// Operations which change buckets are serialized by a single lock, so that the
+// log records them in the order they were applied. Each one holds the lock
+// while its record is written, including the fsync if SyncWrites is set, so
+// the store handles far fewer changes per second than memorystore. Gets, and
+// takes which are rejected without changing the bucket, are not logged.
+//
+// A directory must only be used by one store at a time.
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+const (
+	// snapshotName and logName are the names of the snapshot and write-ahead log
+	// in the store's directory.
+	snapshotName = "snapshot.json"
+	logName      = "wal.log"
+
+	// oldLogName is the name of the log being compacted. It is removed once the
+	// snapshot which includes its operations is written.
+	oldLogName = "wal.old.log"
+
+	// snapshotVersion is the version of the snapshot header written by compact.
+	snapshotVersion = 1
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+type store struct {
+	dir        string
+	syncWrites bool
+
+	compactInterval time.Duration
+	compactSize     int
+
+	mem   memorystore.StoreWithSnapshot
+	clock *pinnedClock
+
+	// lock serializes operations, so that the order of the log matches the order
+	// in which operations were applied. It also guards the fields below.
+	lock    sync.Mutex
+	log     *os.File
+	size    int64
+	seq     uint64
+	records int
+
+	// compactLock serializes compactions. It is taken before lock, and guards
+	// hasOld, which is true while the old log exists.
+	compactLock sync.Mutex
+	hasOld      bool
+
+	// compacted receives a value, if there is room, whenever the compact loop
+	// compacts the log.
+	compacted chan struct{}
+
+	stopped uint32
+	stopCh  chan struct{}
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Dir is the directory in which the snapshot and log are kept. It is created
+	// if it does not exist. This value is required.
+	Dir string
+
+	// Tokens is the number of tokens to allow per interval. The default value is
+	// 1.
+	Tokens uint64
+
+	// Interval is the time interval upon which to enforce rate limiting. The
+	// default value is 1 second.
+	Interval time.Duration
+
+	// Algorithm is the rate limiting algorithm to use. A directory must always be
+	// opened with the same algorithm. The default value is
+	// memorystore.AlgorithmFixedWindow.
+	Algorithm memorystore.Algorithm
+
+	// SyncWrites calls fsync after every write to the log. Without it, completed
+	// operations survive the process crashing, but may be lost if the machine
+	// crashes or loses power. With it, they survive both, but every operation
+	// waits for the disk.
+	SyncWrites bool
+
+	// CompactInterval is the rate at which the log is compacted into a new
+	// snapshot. The default value is 1 minute.
+	CompactInterval time.Duration
+
+	// CompactSize is the number of operations in the log after which it is
+	// compacted, regardless of CompactInterval. The default value is 10000.
+	CompactSize int
+
+	// SweepInterval and SweepMinTTL control the garbage collection of stale
+	// buckets, as in memorystore.Config. The default values are 6 hours and 12
+	// hours.
+	SweepInterval time.Duration
+	SweepMinTTL   time.Duration
+
+	// Clock is the source of the current time, as in memorystore.Config. The
+	// default value is the system clock.
+	Clock limiter.Clock
+}
+
+// New creates a file-backed rate limiter in the configured directory. If the
+// directory already holds a snapshot or log, the buckets are recovered from it
+// first. An operation which was being written when the process crashed is
+// discarded, but any other damage to the log is returned as an error.
+func New(c *Config) (limiter.Store, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	if c.Dir == "" {
+		return nil, fmt.Errorf("missing directory")
+	}
+
+	compactInterval := 1 * time.Minute
+	if c.CompactInterval > 0 {
+		compactInterval = c.CompactInterval
+	}
+
+	compactSize := 10000
+	if c.CompactSize > 0 {
+		compactSize = c.CompactSize
+	}
+
+	var base limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		base = c.Clock
+	}
+	clock := &pinnedClock{base: base}
+
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	mem, err := memorystore.New(&memorystore.Config{
+		Tokens:        c.Tokens,
+		Interval:      c.Interval,
+		Algorithm:     c.Algorithm,
+		SweepInterval: c.SweepInterval,
+		SweepMinTTL:   c.SweepMinTTL,
+		Clock:         clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		dir:        c.Dir,
+		syncWrites: c.SyncWrites,
+
+		compactInterval: compactInterval,
+		compactSize:     compactSize,
+
+		mem:   mem.(memorystore.StoreWithSnapshot),
+		clock: clock,
+
+		compacted: make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		_ = mem.Close(context.Background())
+		return nil, err
+	}
+
+	go s.compactLoop()
+
+	return s, nil
+}
+
+// Take attempts to remove a token from the named key. If the take is
+// successful, it returns true, otherwise false. It also returns the configured
+// limit, remaining tokens, and reset time.
+func (s *store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN attempts to remove n tokens from the named key. Successful takes are
+// logged, and so are unsuccessful takes which create the key's bucket. An
+// unsuccessful take from an existing bucket is not logged, since it changes
+// nothing that the next operation on the bucket would not recompute from the
+// time anyway.
+//
+// Unlike the other operations, the take is applied before it is logged, since
+// whether it needs logging depends on the result. If the log cannot be
+// written, the take is undone.
+func (s *store) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
+	tokens, remaining, reset, ok, full, err := s.take(ctx, key, n)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+
+	s.compactIfFull(full)
+	return tokens, remaining, reset, ok, nil
+}
+
+// take applies and, if needed, logs the take for TakeN. It returns whether the
+// log is full.
+func (s *store) take(ctx context.Context, key string, n uint64) (tokens, remaining, reset uint64, ok, full bool, retErr error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, 0, false, false, limiter.ErrStopped
+	}
+
+	r := &record{Op: opTake, Key: key, N: n, Time: s.clock.base.Now()}
+
+	s.clock.pin(r.Time)
+	defer s.clock.unpin()
+
+	limit, _, err := s.mem.Get(ctx, key)
+	if err != nil {
+		return 0, 0, 0, false, false, err
+	}
+	tokens, remaining, reset, ok, err = s.mem.(limiter.StoreWithTakeN).TakeN(ctx, key, n)
+	if err != nil {
+		return 0, 0, 0, false, false, err
+	}
+	if !ok && limit != 0 {
+		return tokens, remaining, reset, ok, false, nil
+	}
+
+	if err := s.append(r); err != nil {
+		if ok {
+			err = errors.Join(err, s.mem.(limiter.StoreWithRefund).Refund(ctx, key, n, reset))
+		} else {
+			err = errors.Join(err, s.mem.(limiter.StoreWithDelete).Delete(ctx, key))
+		}
+		return 0, 0, 0, false, false, err
+	}
+	return tokens, remaining, reset, ok, s.records >= s.compactSize, nil
+}
+
+// Get retrieves the information about the key, if any exists.
+func (s *store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, limiter.ErrStopped
+	}
+	return s.mem.Get(ctx, key)
+}
+
+// Set configures the bucket-specific tokens and interval.
+func (s *store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	return s.apply(&record{Op: opSet, Key: key, N: tokens, Interval: interval}, func() error {
+		return s.mem.Set(ctx, key, tokens, interval)
+	})
+}
+
+// Burst adds the provided value to the bucket's currently available tokens.
+func (s *store) Burst(ctx context.Context, key string, tokens uint64) error {
+	return s.apply(&record{Op: opBurst, Key: key, N: tokens}, func() error {
+		return s.mem.Burst(ctx, key, tokens)
+	})
+}
+
+// Refund returns tokens to the bucket at key, provided the bucket is still in
+// the interval that ends at reset.
+func (s *store) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	return s.apply(&record{Op: opRefund, Key: key, N: tokens, Reset: reset}, func() error {
+		return s.mem.(limiter.StoreWithRefund).Refund(ctx, key, tokens, reset)
+	})
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *store) Delete(ctx context.Context, key string) error {
+	return s.apply(&record{Op: opDelete, Key: key}, func() error {
+		return s.mem.(limiter.StoreWithDelete).Delete(ctx, key)
+	})
+}
+
+// Close compacts the log into a final snapshot and stops the store. You should
+// always call Close() to release the files and the memory consumed by the
+// buckets.
+func (s *store) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		s.lock.Unlock()
+		return nil
+	}
+
+	// Close the channel to prevent future compaction.
+	close(s.stopCh)
+	s.lock.Unlock()
+
+	// Wait for any compaction in progress.
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	var merr error
+	if err := s.compact(); err != nil {
+		merr = errors.Join(merr, err)
+	}
+	if err := s.log.Close(); err != nil {
+		merr = errors.Join(merr, fmt.Errorf("failed to close log: %w", err))
+	}
+	if err := s.mem.Close(ctx); err != nil {
+		merr = errors.Join(merr, err)
+	}
+	return merr
+}
+
+// apply appends the record to the log with the current time, and then runs fn
+// with the clock pinned to that time. If fn fails, the record is removed from
+// the log again, so the log only holds operations which were applied.
+func (s *store) apply(r *record, fn func() error) error {
+	s.lock.Lock()
+
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		s.lock.Unlock()
+		return limiter.ErrStopped
+	}
+
+	r.Time = s.clock.base.Now()
+	if err := s.append(r); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	s.clock.pin(r.Time)
+	err := fn()
+	s.clock.unpin()
+	if err != nil {
+		err = errors.Join(err, s.truncate(s.size-r.size))
+		s.lock.Unlock()
+		return err
+	}
+
+	full := s.records >= s.compactSize
+	s.lock.Unlock()
+
+	s.compactIfFull(full)
+	return nil
+}
+
+// compactIfFull compacts the log if full is true and the log still holds
+// CompactSize operations once the compact lock is held. It must be called
+// without either lock held.
+//
+// The operation is already durable, so a failed compaction is not an error for
+// the caller. It leaves the snapshot and logs in place, and is retried later.
+func (s *store) compactIfFull(full bool) {
+	if !full {
+		return
+	}
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	s.lock.Lock()
+	full = atomic.LoadUint32(&s.stopped) == 0 && s.records >= s.compactSize
+	s.lock.Unlock()
+	if full {
+		_ = s.compact()
+	}
+}
+
+// append writes the record to the log. It must be called with the lock held.
+func (s *store) append(r *record) error {
+	s.seq++
+	r.Seq = s.seq
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode log record: %w", err)
+	}
+	b = append(b, '\n')
+	r.size = int64(len(b))
+
+	// Write the record with a single call, so that a crash leaves at most one
+	// partial record at the end of the log. If the write fails, remove whatever
+	// part of it was written.
+	if _, err := s.log.Write(b); err != nil {
+		err = fmt.Errorf("failed to write log: %w", err)
+		return errors.Join(err, s.truncate(s.size))
+	}
+	if s.syncWrites {
+		if err := s.log.Sync(); err != nil {
+			err = fmt.Errorf("failed to sync log: %w", err)
+			return errors.Join(err, s.truncate(s.size))
+		}
+	}
+
+	s.size += r.size
+	s.records++
+	return nil
+}
+
+// truncate removes everything after the first size bytes of the log. Sequence
+// numbers are not reused, since they only need to increase. It must be called
+// with the lock held.
+func (s *store) truncate(size int64) error {
+	if err := s.log.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+	if size < s.size {
+		s.size = size
+		s.records--
+	}
+	return nil
+}
+
+// compactLoop compacts the log on the compact interval.
+func (s *store) compactLoop() {
+	ticker := time.NewTicker(s.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		s.compactLock.Lock()
+		s.lock.Lock()
+		run := atomic.LoadUint32(&s.stopped) == 0 && (s.records > 0 || s.hasOld)
+		s.lock.Unlock()
+
+		// A failed compaction leaves the snapshot and logs in place, so it is
+		// retried on the next tick.
+		if run && s.compact() == nil {
+			select {
+			case s.compacted <- struct{}{}:
+			default:
+			}
+		}
+		s.compactLock.Unlock()
+	}
+}
+
+// compact writes a new snapshot of every bucket and then removes the old log.
+// It must be called with the compact lock held, but not the lock.
+//
+// The buckets are encoded under the lock, at the same time as the log is moved
+// aside and a new one is started, so that the snapshot records exactly the
+// sequence number of the last operation it includes. Operations block while
+// the buckets are encoded, which takes time proportional to the number of
+// buckets, but not while the snapshot is written and synced to disk. If the
+// process crashes before the old log is removed, recovery replays both logs and
+// skips the operations already in the snapshot.
+func (s *store) compact() error {
+	s.lock.Lock()
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&snapshotHeader{
+		Version: snapshotVersion,
+		Seq:     s.seq,
+	}); err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := s.mem.Snapshot(&buf); err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	// If the old log is still there, a previous compaction failed. Its
+	// operations are not in any snapshot yet, so keep using the current log
+	// instead of replacing the old one.
+	if !s.hasOld {
+		if err := s.rotate(); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		s.hasOld = true
+	}
+	s.records = 0
+	s.lock.Unlock()
+
+	path := filepath.Join(s.dir, snapshotName)
+	tmp := path + ".tmp"
+
+	if err := writeSnapshot(tmp, buf.Bytes()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, oldLogName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old log: %w", err)
+	}
+	s.hasOld = false
+	return nil
+}
+
+// rotate moves the log aside as the old log, and starts a new one. It must be
+// called with the lock held.
+func (s *store) rotate() error {
+	path := filepath.Join(s.dir, logName)
+	if err := os.Rename(path, filepath.Join(s.dir, oldLogName)); err != nil {
+		return fmt.Errorf("failed to move log: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		// Keep appending to the old log, which is where the operations since the
+		// snapshot are.
+		if rerr := os.Rename(filepath.Join(s.dir, oldLogName), path); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return fmt.Errorf("failed to create log: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	// The old log was synced when its operations were written, if SyncWrites is
+	// set, so closing it is all that's left.
+	_ = s.log.Close()
+	s.log = f
+	s.size = 0
+	return nil
+}
+
+// writeSnapshot writes the snapshot to a new file at path.
+func writeSnapshot(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	return nil
+}
+
+// recover restores the snapshot, if any, replays the operations in the old log
+// and the log which are newer than the snapshot, and then compacts them into a
+// new snapshot. It leaves the log open for appending.
+func (s *store) recover() error {
+	if err := s.readSnapshot(filepath.Join(s.dir, snapshotName)); err != nil {
+		return err
+	}
+
+	old, err := os.Open(filepath.Join(s.dir, oldLogName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to open old log: %w", err)
+	}
+	if err == nil {
+		_, err := s.replay(old)
+		old.Close()
+		if err != nil {
+			return fmt.Errorf("old log: %w", err)
+		}
+		s.hasOld = true
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, logName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+
+	size, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Remove any partial record at the end, so that new records start on a new
+	// line.
+	s.log = f
+	if err := s.truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	s.size = size
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	if err := s.compact(); err != nil {
+		s.log.Close()
+		return err
+	}
+	return nil
+}
+
+// readSnapshot restores the buckets from the snapshot at path, if it exists.
+func (s *store) readSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	// The decoder may have read past the header, so restore from what it has
+	// buffered followed by the rest of the file.
+	if err := s.mem.Restore(io.MultiReader(dec.Buffered(), f)); err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	s.seq = header.Seq
+	return nil
+}
+
+// replay applies the operations in the log which are newer than the snapshot.
+// Each operation is applied at the time it was originally applied, or the
+// current time if that is earlier because the clock moved backward. It returns
+// the size of the complete records in the log.
+func (s *store) replay(r io.Reader) (int64, error) {
+	ctx := context.Background()
+
+	var size int64
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("failed to read log: %w", err)
+		}
+
+		// A record without a trailing newline was still being written when the
+		// process stopped, so the operation never completed.
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		size += int64(len(b))
+
+		var rec record
+		if err := json.Unmarshal(bytes.TrimSpace(b), &rec); err != nil {
+			return 0, fmt.Errorf("failed to parse log line %d: %w", line, err)
+		}
+		if rec.Seq <= s.seq {
+			continue
+		}
+
+		s.clock.pin(min(rec.Time, s.clock.base.Now()))
+		err = s.replayRecord(ctx, &rec)
+		s.clock.unpin()
+		if err != nil {
+			return 0, fmt.Errorf("failed to replay log line %d: %w", line, err)
+		}
+
+		s.seq = rec.Seq
+		s.records++
+	}
+}
+
+// replayRecord applies a single operation to the buckets.
+func (s *store) replayRecord(ctx context.Context, r *record) error {
+	switch r.Op {
+	case opTake:
+		_, _, _, _, err := s.mem.(limiter.StoreWithTakeN).TakeN(ctx, r.Key, r.N)
+		return err
+	case opSet:
+		return s.mem.Set(ctx, r.Key, r.N, r.Interval)
+	case opBurst:
+		return s.mem.Burst(ctx, r.Key, r.N)
+	case opRefund:
+		return s.mem.(limiter.StoreWithRefund).Refund(ctx, r.Key, r.N, r.Reset)
+	case opDelete:
+		return s.mem.(limiter.StoreWithDelete).Delete(ctx, r.Key)
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+}
+
+// syncDir calls fsync on the directory, so that a rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// Operations recorded in the log.
+const (
+	opTake   = "take"
+	opSet    = "set"
+	opBurst  = "burst"
+	opRefund = "refund"
+	opDelete = "delete"
+)
+
+// record is a single operation in the log. N is the number of tokens for every
+// operation except delete. Time is in nanoseconds since the unix epoch.
+type record struct {
+	Seq      uint64        `json:"seq"`
+	Time     uint64        `json:"time"`
+	Op       string        `json:"op"`
+	Key      string        `json:"key"`
+	N        uint64        `json:"n,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Reset    uint64        `json:"reset,omitempty"`
+
+	// size is the number of bytes the record takes up in the log.
+	size int64
+}
+
+// snapshotHeader is the first value in the snapshot file. It is followed by a
+// memorystore snapshot.
+type snapshotHeader struct {
+	// Version is the version of the snapshot header.
+	Version int `json:"version"`
+
+	// Seq is the sequence number of the last operation in the snapshot.
+	Seq uint64 `json:"seq"`
+}
+
+// pinnedClock is the clock given to the in-memory buckets. While an operation
+// is applied, the clock is pinned to the time which is recorded in the log, so
+// that replaying the log reproduces the same buckets. Otherwise, it returns
+// the time from base.
+type pinnedClock struct {
+	base   limiter.Clock
+	pinned uint32
+	now    uint64
+}
+
+// Now returns the pinned time, if any, or the current time.
+func (c *pinnedClock) Now() uint64 {
+	if atomic.LoadUint32(&c.pinned) == 1 {
+		return atomic.LoadUint64(&c.now)
+	}
+	return c.base.Now()
+}
+
+// pin fixes the clock at now.
+func (c *pinnedClock) pin(now uint64) {
+	atomic.StoreUint64(&c.now, now)
+	atomic.StoreUint32(&c.pinned, 1)
+}
+
+// unpin returns the clock to the current time.
+func (c *pinnedClock) unpin() {
+	atomic.StoreUint32(&c.pinned, 0)
+}
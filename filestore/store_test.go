@@ -0,0 +1,534 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/limitertest"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// crash stops the store without compacting, leaving the snapshot and log as
+// they would be if the process had crashed.
+func crash(t testing.TB, s limiter.Store) {
+	t.Helper()
+
+	st := s.(*store)
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !atomic.CompareAndSwapUint32(&st.stopped, 0, 1) {
+		return
+	}
+	close(st.stopCh)
+
+	if err := st.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.mem.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newStore creates a store, and closes it when the test finishes.
+func newStore(t testing.TB, c *Config) limiter.Store {
+	t.Helper()
+
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return s
+}
+
+// takeN takes n tokens and checks the result.
+func takeN(t testing.TB, s limiter.Store, key string, n uint64, wantOK bool, wantRemaining uint64) {
+	t.Helper()
+
+	_, remaining, _, ok, err := s.(limiter.StoreWithTakeN).TakeN(context.Background(), key, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ok, wantOK; got != want {
+		t.Errorf("take %q: expected %t to be %t", key, got, want)
+	}
+	if got, want := remaining, wantRemaining; got != want {
+		t.Errorf("take %q: expected %d to be %d", key, got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(nil); err == nil {
+		t.Error("expected error for missing directory")
+	}
+	if _, err := New(&Config{Dir: t.TempDir(), Algorithm: 99}); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+}
+
+func TestStore_recover(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		// clean closes the store instead of crashing it.
+		clean bool
+	}{
+		{
+			name:  "clean",
+			clean: true,
+		},
+		{
+			name:  "crash",
+			clean: false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			dir := t.TempDir()
+			clock := fakeclock.New(time.Unix(1700000000, 0))
+			config := &Config{
+				Dir:      dir,
+				Tokens:   10,
+				Interval: 24 * time.Hour,
+				Clock:    clock,
+			}
+
+			s, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			takeN(t, s, "daily", 4, true, 6)
+			takeN(t, s, "daily", 1, true, 5)
+			if err := s.Set(ctx, "custom", 3, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			takeN(t, s, "custom", 3, true, 0)
+			if err := s.Burst(ctx, "custom", 2); err != nil {
+				t.Fatal(err)
+			}
+			takeN(t, s, "deleted", 1, true, 9)
+			if err := s.(limiter.StoreWithDelete).Delete(ctx, "deleted"); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, reset, _, err := s.Take(ctx, "refunded")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.(limiter.StoreWithRefund).Refund(ctx, "refunded", 1, reset); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.clean {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				crash(t, s)
+			}
+
+			clock.Advance(time.Minute)
+			s = newStore(t, config)
+
+			takeN(t, s, "daily", 1, true, 4)
+			takeN(t, s, "custom", 2, true, 0)
+			takeN(t, s, "deleted", 1, true, 9)
+			takeN(t, s, "refunded", 1, true, 9)
+
+			if limit, _, err := s.Get(ctx, "custom"); err != nil {
+				t.Fatal(err)
+			} else if got, want := limit, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// The windows are unchanged, so the daily quota still resets a day after
+			// the first take.
+			clock.Advance(24*time.Hour - 2*time.Minute)
+			takeN(t, s, "daily", 5, false, 4)
+			clock.Advance(2 * time.Minute)
+			takeN(t, s, "daily", 5, true, 5)
+		})
+	}
+}
+
+func TestStore_recover_tornWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := &Config{
+		Dir:      dir,
+		Tokens:   10,
+		Interval: time.Hour,
+	}
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeN(t, s, "key", 3, true, 7)
+	crash(t, s)
+
+	// Simulate a crash in the middle of writing the next record.
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"seq":2,"time":1,"op":"ta`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(t, config)
+	if _, remaining, err := s.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	} else if got, want := remaining, uint64(7); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// The partial record is discarded, so the log is valid again.
+	takeN(t, s, "key", 1, true, 6)
+	crash(t, s)
+
+	s = newStore(t, config)
+	takeN(t, s, "key", 1, true, 5)
+}
+
+func TestStore_recover_corrupt(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := &Config{
+		Dir:      dir,
+		Tokens:   10,
+		Interval: time.Hour,
+	}
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeN(t, s, "key", 1, true, 9)
+	crash(t, s)
+
+	// Damage which isn't at the end of the log can't be from a crash.
+	path := filepath.Join(dir, logName)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append([]byte("not json\n"), b...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected error for line 1, got %v", err)
+	}
+}
+
+func TestStore_recover_compactionCrash(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := &Config{
+		Dir:      dir,
+		Tokens:   10,
+		Interval: time.Hour,
+	}
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeN(t, s, "key", 2, true, 8)
+	takeN(t, s, "key", 2, true, 6)
+
+	b, err := os.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after the snapshot is replaced, but before the old log is
+	// removed.
+	st := s.(*store)
+	st.compactLock.Lock()
+	if err := st.compact(); err != nil {
+		t.Fatal(err)
+	}
+	st.compactLock.Unlock()
+	takeN(t, s, "key", 1, true, 5)
+	crash(t, s)
+
+	if err := os.WriteFile(filepath.Join(dir, oldLogName), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operations in the snapshot are only applied once.
+	s = newStore(t, config)
+	takeN(t, s, "key", 1, true, 4)
+}
+
+func TestStore_compact(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := &Config{
+		Dir:         dir,
+		Tokens:      100,
+		Interval:    time.Hour,
+		CompactSize: 5,
+	}
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 12; i++ {
+		takeN(t, s, "key", 1, true, 99-i)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "\n"), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	crash(t, s)
+	s = newStore(t, config)
+	takeN(t, s, "key", 1, true, 87)
+}
+
+func TestStore_compactInterval(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := newStore(t, &Config{
+		Dir:             dir,
+		Tokens:          100,
+		Interval:        time.Hour,
+		CompactInterval: 10 * time.Millisecond,
+	})
+	takeN(t, s, "key", 1, true, 99)
+
+	select {
+	case <-s.(*store).compacted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected log to be compacted")
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Size(), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, oldLogName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected old log to be removed, got %v", err)
+	}
+}
+
+func TestStore_apply_rollback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := New(&Config{
+		Dir:      dir,
+		Tokens:   10,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { crash(t, s) })
+	takeN(t, s, "key", 1, true, 9)
+
+	// An operation which fails is removed from the log.
+	if err := s.(*store).mem.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "\n"), 1; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_TakeN_rejected(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := &Config{
+		Dir:      dir,
+		Tokens:   2,
+		Interval: time.Hour,
+	}
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected takes from an existing bucket are not logged.
+	takeN(t, s, "key", 2, true, 0)
+	for i := 0; i < 3; i++ {
+		takeN(t, s, "key", 1, false, 0)
+	}
+
+	// A rejected take which creates the bucket is.
+	takeN(t, s, "other", 3, false, 2)
+
+	b, err := os.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "\n"), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	crash(t, s)
+
+	s = newStore(t, config)
+	takeN(t, s, "key", 1, false, 0)
+	takeN(t, s, "other", 2, true, 0)
+}
+
+func TestStore_algorithms(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		algorithm memorystore.Algorithm
+	}{
+		{
+			name:      "sliding_window_counter",
+			algorithm: memorystore.AlgorithmSlidingWindowCounter,
+		},
+		{
+			name:      "sliding_log",
+			algorithm: memorystore.AlgorithmSlidingLog,
+		},
+		{
+			name:      "gcra",
+			algorithm: memorystore.AlgorithmGCRA,
+		},
+		{
+			name:      "token_bucket",
+			algorithm: memorystore.AlgorithmTokenBucket,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			clock := fakeclock.New(time.Unix(1700000000, 0))
+			config := &Config{
+				Dir:       t.TempDir(),
+				Tokens:    5,
+				Interval:  time.Hour,
+				Algorithm: tc.algorithm,
+				Clock:     clock,
+			}
+
+			s, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+					t.Fatal(err)
+				}
+				clock.Advance(time.Second)
+			}
+			_, want, err := s.Get(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			crash(t, s)
+
+			s = newStore(t, config)
+			if _, got, err := s.Get(ctx, "key"); err != nil {
+				t.Fatal(err)
+			} else if got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+	if err := s.Set(ctx, "key", 1, time.Second); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		s, err := New(&Config{
+			Dir:      t.TempDir(),
+			Tokens:   10,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
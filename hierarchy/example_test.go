@@ -0,0 +1,58 @@
+package hierarchy_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/hierarchy"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Allow 10000 requests per second in total, 100 per second for each
+	// organization, and 10 per second for each user.
+	global, err := memorystore.New(&memorystore.Config{
+		Tokens:   10000,
+		Interval: time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	orgs, err := memorystore.New(&memorystore.Config{
+		Tokens:   100,
+		Interval: time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := memorystore.New(&memorystore.Config{
+		Tokens:   10,
+		Interval: time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := hierarchy.New(
+		hierarchy.Level{Name: "global", Store: global},
+		hierarchy.Level{Name: "org", Store: orgs},
+		hierarchy.Level{Name: "user", Store: users},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close(ctx)
+
+	result, err := l.Take(ctx, "global", "org:42", "user:7")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !result.OK {
+		log.Printf("rate limited by the %s limit", result.Level)
+	}
+}
@@ -0,0 +1,122 @@
+// Package hierarchy defines a limiter which applies nested limits with a single
+// decision, such as a per-user limit inside a per-organization limit inside a
+// global limit. Each level of the hierarchy is backed by its own store, which
+// determines that level's limits.
+package hierarchy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/compositestore"
+)
+
+// Level is a single level of the hierarchy.
+type Level struct {
+	// Name identifies the level in results, for example "global", "org", or
+	// "user".
+	Name string
+
+	// Store holds the buckets for this level. The store's configuration is the
+	// default limit for every key at this level, and individual keys can be
+	// configured with Set. The store must implement limiter.StoreWithRefund.
+	Store limiter.Store
+}
+
+// Result is the outcome of a take across all levels.
+type Result struct {
+	// Tokens, Remaining, and Reset are the values returned by the store at Level.
+	// See limiter.Store for their meaning.
+	Tokens    uint64
+	Remaining uint64
+	Reset     uint64
+
+	// OK is true if every level permitted the take.
+	OK bool
+
+	// Level is the name of the level which rejected the take or, if the take was
+	// successful, the level with the fewest remaining tokens.
+	Level string
+}
+
+// Limiter applies a take to every level of a hierarchy at once. It is a
+// composite of the levels' stores, where each level has its own key.
+type Limiter struct {
+	names  []string
+	stores []limiter.StoreWithRefund
+}
+
+// New creates a hierarchical limiter from the given levels, ordered from the
+// outermost (e.g. global) to the innermost (e.g. user). Each level's store must
+// implement limiter.StoreWithRefund, so that takes from earlier levels can be
+// rolled back when a later level rejects.
+func New(levels ...Level) (*Limiter, error) {
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("at least one level is required")
+	}
+
+	l := &Limiter{
+		names:  make([]string, 0, len(levels)),
+		stores: make([]limiter.StoreWithRefund, 0, len(levels)),
+	}
+	for i, lvl := range levels {
+		if lvl.Store == nil {
+			return nil, fmt.Errorf("level %d (%q) store cannot be nil", i, lvl.Name)
+		}
+
+		rs, ok := lvl.Store.(limiter.StoreWithRefund)
+		if !ok {
+			return nil, fmt.Errorf("level %d (%q) store does not support refunds: %w", i, lvl.Name, errors.ErrUnsupported)
+		}
+		l.names = append(l.names, lvl.Name)
+		l.stores = append(l.stores, rs)
+	}
+
+	return l, nil
+}
+
+// Take takes a token for every level, where keys[i] is the key at level i. For
+// example:
+//
+//	l.Take(ctx, "global", "org:42", "user:7")
+//
+// The number of keys must match the number of levels. Either every level
+// permits the take, or no tokens are taken: if a level rejects the take or
+// returns an error, the tokens already taken from the earlier levels are
+// refunded.
+func (l *Limiter) Take(ctx context.Context, keys ...string) (Result, error) {
+	return l.TakeN(ctx, 1, keys...)
+}
+
+// TakeN is like Take, but takes n tokens from every level. Each level's store
+// must implement limiter.StoreWithTakeN, unless n is 1.
+func (l *Limiter) TakeN(ctx context.Context, n uint64, keys ...string) (Result, error) {
+	if got, want := len(keys), len(l.stores); got != want {
+		return Result{}, fmt.Errorf("expected %d keys, got %d", want, got)
+	}
+
+	i, tokens, remaining, reset, ok, err := compositestore.TakeEach(ctx, l.stores, keys, n)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take from level %q: %w", l.names[i], err)
+	}
+	return Result{
+		Tokens:    tokens,
+		Remaining: remaining,
+		Reset:     reset,
+		OK:        ok,
+		Level:     l.names[i],
+	}, nil
+}
+
+// Close closes the stores for every level.
+func (l *Limiter) Close(ctx context.Context) error {
+	var merr error
+	for i, st := range l.stores {
+		if err := st.Close(ctx); err != nil {
+			merr = errors.Join(merr, fmt.Errorf("failed to close level %d (%q): %w", i, l.names[i], err))
+		}
+	}
+	return merr
+}
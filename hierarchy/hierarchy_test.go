@@ -0,0 +1,250 @@
+package hierarchy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// takeOnlyStore hides any optional interfaces implemented by the wrapped store.
+type takeOnlyStore struct {
+	limiter.Store
+}
+
+// errorStore returns an error from every take.
+type errorStore struct {
+	limiter.StoreWithRefund
+}
+
+func (s *errorStore) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return 0, 0, 0, false, errors.New("boom")
+}
+
+func newMemoryStore(tb testing.TB, tokens uint64) limiter.StoreWithRefund {
+	tb.Helper()
+
+	s, err := memorystore.New(&memorystore.Config{
+		Tokens:   tokens,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s.(limiter.StoreWithRefund)
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		levels []Level
+		err    error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "nil",
+			levels: []Level{{Name: "global"}},
+		},
+		{
+			name:   "no_refunds",
+			levels: []Level{{Name: "global", Store: &takeOnlyStore{newMemoryStore(t, 1)}}},
+			err:    errors.ErrUnsupported,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := New(tc.levels...)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected %v to be %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLimiter_Take(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	global := newMemoryStore(t, 100)
+	org := newMemoryStore(t, 3)
+	user := newMemoryStore(t, 2)
+
+	l, err := New(
+		Level{Name: "global", Store: global},
+		Level{Name: "org", Store: org},
+		Level{Name: "user", Store: user},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The user limit is the tightest.
+	for i := 0; i < 2; i++ {
+		result, err := l.Take(ctx, "global", "org:42", "user:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK {
+			t.Fatalf("expected take %d to be allowed", i)
+		}
+		if got, want := result.Level, "user"; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+		if got, want := result.Remaining, uint64(1-i); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	}
+
+	// The user is out of tokens, which must not consume tokens from the org or
+	// global levels.
+	result, err := l.Take(ctx, "global", "org:42", "user:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK {
+		t.Fatal("expected take to be rejected")
+	}
+	if got, want := result.Level, "user"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if _, remaining, err := global.Get(ctx, "global"); err != nil || remaining != 98 {
+		t.Errorf("expected global to have 98 tokens, got %d (%v)", remaining, err)
+	}
+	if _, remaining, err := org.Get(ctx, "org:42"); err != nil || remaining != 1 {
+		t.Errorf("expected org to have 1 token, got %d (%v)", remaining, err)
+	}
+
+	// Another user in the same org exhausts the org.
+	result, err = l.Take(ctx, "global", "org:42", "user:8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK {
+		t.Fatal("expected take to be allowed")
+	}
+	if got, want := result.Level, "org"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	result, err = l.Take(ctx, "global", "org:42", "user:8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK {
+		t.Fatal("expected take to be rejected")
+	}
+	if got, want := result.Level, "org"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if _, remaining, err := global.Get(ctx, "global"); err != nil || remaining != 97 {
+		t.Errorf("expected global to have 97 tokens, got %d (%v)", remaining, err)
+	}
+
+	// A user in another org is unaffected.
+	result, err = l.Take(ctx, "global", "org:43", "user:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK {
+		t.Fatal("expected take to be allowed")
+	}
+}
+
+func TestLimiter_TakeN(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	global := newMemoryStore(t, 10)
+	user := newMemoryStore(t, 5)
+
+	l, err := New(
+		Level{Name: "global", Store: global},
+		Level{Name: "user", Store: user},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	result, err := l.TakeN(ctx, 4, "global", "user:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK {
+		t.Fatal("expected take to be allowed")
+	}
+	if got, want := result.Remaining, uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	result, err = l.TakeN(ctx, 4, "global", "user:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK {
+		t.Fatal("expected take to be rejected")
+	}
+	if _, remaining, err := global.Get(ctx, "global"); err != nil || remaining != 6 {
+		t.Errorf("expected global to have 6 tokens, got %d (%v)", remaining, err)
+	}
+}
+
+func TestLimiter_Take_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	global := newMemoryStore(t, 10)
+
+	l, err := New(
+		Level{Name: "global", Store: global},
+		Level{Name: "user", Store: &errorStore{newMemoryStore(t, 10)}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := l.Take(ctx, "global"); err == nil {
+		t.Error("expected error for missing key")
+	}
+
+	if _, err := l.Take(ctx, "global", "user:7"); err == nil {
+		t.Error("expected error")
+	} else if got, want := err.Error(), `failed to take from level "user": boom`; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if _, remaining, err := global.Get(ctx, "global"); err != nil || remaining != 10 {
+		t.Errorf("expected global to have 10 tokens, got %d (%v)", remaining, err)
+	}
+}
@@ -0,0 +1,98 @@
+package httplimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sethvargo/go-limiter/adaptive"
+)
+
+// AdaptiveMiddleware is a handler/mux that rate limits HTTP requests like
+// Middleware, and reports the outcome of every permitted request to an
+// adaptive store, so that the limit shrinks while the wrapped handler is
+// failing or slow and grows back when it recovers.
+type AdaptiveMiddleware struct {
+	store   *adaptive.Store
+	keyFunc KeyFunc
+}
+
+// NewAdaptiveMiddleware creates a new adaptive middleware suitable for use as
+// an HTTP handler. This function returns an error if either the Store or KeyFunc
+// are nil.
+func NewAdaptiveMiddleware(s *adaptive.Store, f KeyFunc) (*AdaptiveMiddleware, error) {
+	if s == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("key function cannot be nil")
+	}
+
+	return &AdaptiveMiddleware{
+		store:   s,
+		keyFunc: f,
+	}, nil
+}
+
+// Handle returns the HTTP handler as a middleware. It behaves like
+// Middleware.Handle, and additionally reports an outcome to the store once the
+// remaining middleware returns: responses with a 5xx status code, and handlers
+// which panic, are reported as errors, and all other responses as successes.
+// The time taken by the remaining middleware is reported as the latency.
+func (m *AdaptiveMiddleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Call the key function - if this fails, it's an internal server error.
+		key, err := m.keyFunc(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Take from the store.
+		if !take(w, r, m.store, key) {
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		completed := false
+
+		// Report the outcome once the request finishes, even if the handler panics.
+		// There is nothing useful to do with an error at this point, since the
+		// response may already be written.
+		defer func() {
+			outcome := adaptive.OutcomeSuccess
+			if !completed || sw.status >= 500 {
+				outcome = adaptive.OutcomeError
+			}
+			_ = m.store.Report(context.WithoutCancel(r.Context()), key, outcome, time.Since(start))
+		}()
+
+		next.ServeHTTP(sw, r)
+		completed = true
+	})
+}
+
+// statusWriter records the status code written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records the status code and writes it to the response.
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the underlying response writer, so that http.ResponseController
+// can reach optional interfaces such as http.Flusher.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package httplimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter/adaptive"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+func TestNewAdaptiveMiddleware(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ms, err := memorystore.New(&memorystore.Config{
+		Tokens:   10,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := fakeclock.New(time.Unix(0, 0).Add(time.Hour))
+	store, err := adaptive.New(ms, &adaptive.Config{
+		MaxTokens:      10,
+		Interval:       time.Hour,
+		AdjustInterval: time.Nanosecond,
+		Clock:          clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := httplimit.NewAdaptiveMiddleware(store, httplimit.IPKeyFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/panic":
+			panic("boom")
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		// Let the adjustment interval elapse.
+		clock.Advance(time.Millisecond)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	limit := func() string {
+		t.Helper()
+
+		w := serve("/")
+		return w.Header().Get(httplimit.HeaderRateLimitLimit)
+	}
+
+	// The first request uses the initial limit.
+	if got, want := limit(), "10"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A 5xx halves the limit for the next request.
+	if got, want := serve("/fail").Code, http.StatusBadGateway; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := limit(), "5"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The success reported by the previous request grows the limit again.
+	if got, want := limit(), "6"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A panic is reported as an error.
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		serve("/panic")
+	}()
+	if got, want := limit(), "3"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package httplimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// ConcurrencyMiddleware is a handler/mux that limits the number of HTTP requests
+// in flight for each key. Unlike Middleware, which limits how often requests may
+// start, it limits how many may be running at once, so slow requests cannot pile
+// up.
+type ConcurrencyMiddleware struct {
+	store   limiter.ConcurrencyStore
+	keyFunc KeyFunc
+}
+
+// NewConcurrencyMiddleware creates a new concurrency-limiting middleware
+// suitable for use as an HTTP handler. This function returns an error if either
+// the ConcurrencyStore or KeyFunc are nil.
+func NewConcurrencyMiddleware(s limiter.ConcurrencyStore, f KeyFunc) (*ConcurrencyMiddleware, error) {
+	if s == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("key function cannot be nil")
+	}
+
+	return &ConcurrencyMiddleware{
+		store:   s,
+		keyFunc: f,
+	}, nil
+}
+
+// Handle returns the HTTP handler as a middleware. This handler calls Acquire()
+// on the store and sets the limit and remaining slots on the response. If no
+// slot is available, the middleware chain is halted and the function renders a
+// 429 to the caller. Otherwise the slot is released when the remaining
+// middleware returns, including when it panics.
+func (m *ConcurrencyMiddleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// Call the key function - if this fails, it's an internal server error.
+		key, err := m.keyFunc(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Acquire a slot.
+		limit, remaining, ok, err := m.store.Acquire(ctx, key)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Set headers (we do this regardless of whether the request is permitted).
+		w.Header().Set(HeaderRateLimitLimit, strconv.FormatUint(limit, 10))
+		w.Header().Set(HeaderRateLimitRemaining, strconv.FormatUint(remaining, 10))
+
+		// Fail if there were no slots remaining.
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		// Release the slot once the request finishes, even if the request was
+		// canceled or the handler panics. There is nothing useful to do with an
+		// error at this point, since the response may already be written.
+		defer m.store.Release(context.WithoutCancel(ctx), key)
+
+		// If we got this far, we have a slot, so call the next middleware in the
+		// stack to continue processing.
+		next.ServeHTTP(w, r)
+	})
+}
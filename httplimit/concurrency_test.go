@@ -0,0 +1,135 @@
+package httplimit_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sethvargo/go-limiter/concurrencystore"
+	"github.com/sethvargo/go-limiter/httplimit"
+)
+
+func TestNewConcurrencyMiddleware(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store, err := concurrencystore.New(&concurrencystore.Config{
+		Limit: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := httplimit.NewConcurrencyMiddleware(store, httplimit.IPKeyFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-unblock
+		}
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "hello world")
+	})
+
+	server := httptest.NewServer(middleware.Handle(slow))
+	defer server.Close()
+
+	client := server.Client()
+
+	// Hold the only slot with a slow request.
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(server.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := resp.Header.Get(httplimit.HeaderRateLimitLimit), "1"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Once the slow request finishes, the slot is free again.
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := resp.Header.Get(httplimit.HeaderRateLimitRemaining), "0"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestConcurrencyMiddleware_panic(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store, err := concurrencystore.New(&concurrencystore.Config{
+		Limit: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := httplimit.NewConcurrencyMiddleware(store, httplimit.IPKeyFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	// The slot was released when the handler panicked.
+	if _, _, ok, err := store.Acquire(ctx, "192.0.2.1"); err != nil || !ok {
+		t.Errorf("expected slot to be released, got %t, %v", ok, err)
+	}
+}
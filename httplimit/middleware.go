@@ -90,8 +90,6 @@ func NewMiddleware(s limiter.Store, f KeyFunc) (*Middleware, error) {
 // metadata about when it's safe to retry.
 func (m *Middleware) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-
 		// Call the key function - if this fails, it's an internal server error.
 		key, err := m.keyFunc(r)
 		if err != nil {
@@ -100,23 +98,7 @@ func (m *Middleware) Handle(next http.Handler) http.Handler {
 		}
 
 		// Take from the store.
-		limit, remaining, reset, ok, err := m.store.Take(ctx, key)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-
-		resetTime := time.Unix(0, int64(reset)).UTC().Format(time.RFC1123)
-
-		// Set headers (we do this regardless of whether the request is permitted).
-		w.Header().Set(HeaderRateLimitLimit, strconv.FormatUint(limit, 10))
-		w.Header().Set(HeaderRateLimitRemaining, strconv.FormatUint(remaining, 10))
-		w.Header().Set(HeaderRateLimitReset, resetTime)
-
-		// Fail if there were no tokens remaining.
-		if !ok {
-			w.Header().Set(HeaderRetryAfter, resetTime)
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if !take(w, r, m.store, key) {
 			return
 		}
 
@@ -125,3 +107,29 @@ func (m *Middleware) Handle(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// take takes from the store for the key and sets the common rate limiting
+// headers. If the take is unsuccessful or fails, it renders the error to the
+// caller and returns false.
+func take(w http.ResponseWriter, r *http.Request, s limiter.Store, key string) bool {
+	result, err := limiter.Allow(r.Context(), s, key)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+
+	resetTime := result.ResetAt.UTC().Format(time.RFC1123)
+
+	// Set headers (we do this regardless of whether the request is permitted).
+	w.Header().Set(HeaderRateLimitLimit, strconv.FormatUint(result.Limit, 10))
+	w.Header().Set(HeaderRateLimitRemaining, strconv.FormatUint(result.Remaining, 10))
+	w.Header().Set(HeaderRateLimitReset, resetTime)
+
+	// Fail if there were no tokens remaining.
+	if !result.Allowed {
+		w.Header().Set(HeaderRetryAfter, resetTime)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
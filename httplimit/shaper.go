@@ -0,0 +1,86 @@
+package httplimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// ShapingMiddleware is a handler/mux that shapes HTTP traffic to a constant
+// rate. Instead of rejecting requests that exceed the rate, it holds each
+// request until its slot arrives, and only rejects requests once the key's queue
+// is full.
+type ShapingMiddleware struct {
+	shaper  limiter.Shaper
+	keyFunc KeyFunc
+}
+
+// NewShapingMiddleware creates a new shaping middleware suitable for use as an
+// HTTP handler. This function returns an error if either the Shaper or KeyFunc
+// are nil.
+func NewShapingMiddleware(s limiter.Shaper, f KeyFunc) (*ShapingMiddleware, error) {
+	if s == nil {
+		return nil, fmt.Errorf("shaper cannot be nil")
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("key function cannot be nil")
+	}
+
+	return &ShapingMiddleware{
+		shaper:  s,
+		keyFunc: f,
+	}, nil
+}
+
+// Handle returns the HTTP handler as a middleware. This handler calls Delay()
+// on the shaper and waits for the request's slot before calling the remaining
+// middleware. If the queue is full, the middleware chain is halted and the
+// function renders a 429 to the caller with metadata about when it's safe to
+// retry. If the request is canceled while it is waiting, the function renders a
+// 503.
+func (m *ShapingMiddleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// Call the key function - if this fails, it's an internal server error.
+		key, err := m.keyFunc(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Reserve a slot.
+		delay, ok, err := m.shaper.Delay(ctx, key)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Fail if the queue is full.
+		if !ok {
+			retryAt := time.Now().Add(delay).UTC().Format(time.RFC1123)
+			w.Header().Set(HeaderRetryAfter, retryAt)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		// Hold the request until its slot arrives.
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case <-timer.C:
+			}
+		}
+
+		// If we got this far, it's our turn, so call the next middleware in the
+		// stack to continue processing.
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,82 @@
+package httplimit_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/sethvargo/go-limiter/leakybucket"
+)
+
+func TestNewShapingMiddleware(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	shaper, err := leakybucket.New(&leakybucket.Config{
+		Rate:     10,
+		Interval: time.Second,
+		MaxQueue: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := shaper.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := httplimit.NewShapingMiddleware(shaper, httplimit.IPKeyFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doWork := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "hello world")
+	})
+
+	server := httptest.NewServer(middleware.Handle(doWork))
+	defer server.Close()
+
+	client := server.Client()
+
+	// Reserve the current slot so the request has to wait for the next one,
+	// 100ms from now.
+	if _, _, err := shaper.Delay(ctx, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := time.Since(start), 50*time.Millisecond; got < want {
+		t.Errorf("expected request to be held for at least %s, was %s", want, got)
+	}
+
+	// Fill the queue, so the next request is rejected.
+	if _, _, err := shaper.Delay(ctx, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, err := time.Parse(time.RFC1123, resp.Header.Get(httplimit.HeaderRetryAfter)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package connpool implements the fixed-size connection pool shared by the
+// stores which speak a protocol to a server directly.
+package connpool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Pool is a fixed-size pool of connections. Connections are dialed lazily, and
+// a connection which returned an error is closed instead of being reused.
+type Pool[C io.Closer] struct {
+	dial  func(ctx context.Context) (C, error)
+	conns chan C
+	slots chan struct{}
+
+	// lock guards closed, so that Put can't return a connection to the pool
+	// after Close drained it.
+	lock   sync.Mutex
+	closed bool
+}
+
+// New creates a pool of at most size connections, which are created with dial.
+func New[C io.Closer](size int, dial func(ctx context.Context) (C, error)) *Pool[C] {
+	return &Pool[C]{
+		dial:  dial,
+		conns: make(chan C, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Get returns an idle connection, dials a new one if the pool has room, or
+// waits for one to be returned.
+func (p *Pool[C]) Get(ctx context.Context) (C, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	default:
+	}
+
+	select {
+	case c := <-p.conns:
+		return c, nil
+	case p.slots <- struct{}{}:
+		c, err := p.dial(ctx)
+		if err != nil {
+			<-p.slots
+			return c, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		var zero C
+		return zero, ctx.Err()
+	}
+}
+
+// Put returns the connection to the pool, or closes it if err is not nil or the
+// pool is closed.
+func (p *Pool[C]) Put(c C, err error) {
+	p.lock.Lock()
+	if err == nil && !p.closed {
+		p.conns <- c
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+
+	c.Close()
+	<-p.slots
+}
+
+// Close closes the idle connections. Connections which are in use are closed
+// when they are returned.
+func (p *Pool[C]) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	for {
+		select {
+		case c := <-p.conns:
+			c.Close()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
+
+// Dial connects to addr over TCP, giving up after timeout.
+func Dial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return nc, nil
+}
@@ -0,0 +1,49 @@
+package connpool
+
+import (
+	"context"
+	"testing"
+)
+
+// fakeConn records whether it was closed.
+type fakeConn struct {
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPool_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	p := New(2, func(context.Context) (*fakeConn, error) {
+		return new(fakeConn), nil
+	})
+
+	idle, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(idle, nil)
+
+	// Closing the pool closes the idle connection, and a connection which is
+	// returned afterwards is closed instead of being kept.
+	p.Close()
+	if !idle.closed {
+		t.Error("expected idle connection to be closed")
+	}
+	p.Put(busy, nil)
+	if !busy.closed {
+		t.Error("expected returned connection to be closed")
+	}
+	if got, want := len(p.conns), 0; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
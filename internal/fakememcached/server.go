@@ -0,0 +1,353 @@
+// Package fakememcached is a minimal in-process memcached server for tests. It
+// speaks the text protocol and supports the commands used by memcachedstore:
+// get, gets, set, add, cas, delete, flush_all, and version. Items are kept in
+// memory and expire in real time.
+package fakememcached
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRelativeExptime is the largest expiration time which is relative to now.
+// Larger values are unix timestamps.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// Server is a fake memcached server listening on a local TCP port.
+type Server struct {
+	ln net.Listener
+
+	lock   sync.Mutex
+	data   map[string]*item
+	cas    uint64
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	// conflict fails every add and cas, as if another client had changed the
+	// item.
+	conflict bool
+}
+
+// item is a stored value.
+type item struct {
+	flags   uint32
+	value   []byte
+	cas     uint64
+	expires time.Time
+}
+
+// Start starts a server on a random local port.
+func Start() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		ln:    ln,
+		data:  make(map[string]*item),
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address on which the server is listening.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Keys returns the number of items which have not expired.
+func (s *Server) Keys() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for k := range s.data {
+		if s.lookup(k) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// TTL returns the time until the item at key expires, or zero if it never
+// expires. It reports whether the item exists.
+func (s *Server) TTL(key string) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	it := s.lookup(key)
+	if it == nil {
+		return 0, false
+	}
+	if it.expires.IsZero() {
+		return 0, true
+	}
+	return time.Until(it.expires), true
+}
+
+// Conflict sets whether every add and cas fails, as if another client had
+// changed the item.
+func (s *Server) Conflict(conflict bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conflict = conflict
+}
+
+// Close stops the server and closes every connection. It is safe to call more
+// than once.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// handle runs the commands from a single connection.
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		c.Close()
+	}()
+
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				bw.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+				bw.Flush()
+			}
+			return
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			bw.WriteString("CLIENT_ERROR line must end with CRLF\r\n")
+			bw.Flush()
+			return
+		}
+
+		if err := s.dispatch(br, bw, strings.Fields(line)); err != nil {
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch runs a single command. It returns an error if the connection must be
+// closed.
+func (s *Server) dispatch(br *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) == 0 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, k := range args[1:] {
+			it := s.lookup(k)
+			if it == nil {
+				continue
+			}
+			fmt.Fprintf(w, "VALUE %s %d %d", k, it.flags, len(it.value))
+			if args[0] == "gets" {
+				fmt.Fprintf(w, " %d", it.cas)
+			}
+			w.WriteString("\r\n")
+			w.Write(it.value)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("END\r\n")
+		return nil
+
+	case "set", "add", "cas":
+		want := 5
+		if args[0] == "cas" {
+			want = 6
+		}
+		if len(args) != want && len(args) != want+1 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		noreply := len(args) == want+1 && args[want] == "noreply"
+
+		flags, ferr := strconv.ParseUint(args[2], 10, 32)
+		exptime, eerr := strconv.ParseInt(args[3], 10, 64)
+		n, nerr := strconv.Atoi(args[4])
+		if ferr != nil || eerr != nil || nerr != nil || n < 0 {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return errors.New("bad command line format")
+		}
+		var casID uint64
+		if args[0] == "cas" {
+			var err error
+			if casID, err = strconv.ParseUint(args[5], 10, 64); err != nil {
+				w.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return err
+			}
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		if string(data[n:]) != "\r\n" {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return errors.New("bad data chunk")
+		}
+
+		s.lock.Lock()
+		reply := s.store(args[0], args[1], uint32(flags), exptime, data[:n], casID)
+		s.lock.Unlock()
+		if !noreply {
+			w.WriteString(reply + "\r\n")
+		}
+		return nil
+
+	case "delete":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.lookup(args[1]) == nil {
+			w.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		delete(s.data, args[1])
+		w.WriteString("DELETED\r\n")
+		return nil
+
+	case "flush_all":
+		s.lock.Lock()
+		s.data = make(map[string]*item)
+		s.lock.Unlock()
+		w.WriteString("OK\r\n")
+		return nil
+
+	case "version":
+		w.WriteString("VERSION 0.0.0-fake\r\n")
+		return nil
+
+	default:
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+}
+
+// store runs a storage command, and returns the reply. It must be called with
+// the lock held.
+func (s *Server) store(cmd, key string, flags uint32, exptime int64, value []byte, casID uint64) string {
+	existing := s.lookup(key)
+
+	switch cmd {
+	case "add":
+		if existing != nil || s.conflict {
+			return "NOT_STORED"
+		}
+	case "cas":
+		if existing == nil {
+			return "NOT_FOUND"
+		}
+		if existing.cas != casID || s.conflict {
+			return "EXISTS"
+		}
+	}
+
+	var expires time.Time
+	switch {
+	case exptime < 0:
+		// A negative expiration time expires the item immediately.
+		delete(s.data, key)
+		return "STORED"
+	case exptime == 0:
+	case exptime <= maxRelativeExptime:
+		expires = time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		expires = time.Unix(exptime, 0)
+	}
+
+	s.cas++
+	s.data[key] = &item{
+		flags:   flags,
+		value:   append([]byte(nil), value...),
+		cas:     s.cas,
+		expires: expires,
+	}
+	return "STORED"
+}
+
+// lookup returns the item at key, deleting it if it expired. It must be called
+// with the lock held.
+func (s *Server) lookup(key string) *item {
+	it, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !it.expires.IsZero() && !time.Now().Before(it.expires) {
+		delete(s.data, key)
+		return nil
+	}
+	return it
+}
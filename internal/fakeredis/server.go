@@ -0,0 +1,534 @@
+// Package fakeredis is a minimal in-process Redis server for tests. It speaks
+// RESP and supports the commands used by redisstore: PING, AUTH, SELECT, HSET,
+// HMGET, DEL, PEXPIRE, PTTL, WATCH, UNWATCH, MULTI, EXEC, DISCARD, and
+// FLUSHALL. Keys are kept in memory and expire in real time.
+package fakeredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Redis server listening on a local TCP port.
+type Server struct {
+	ln       net.Listener
+	password string
+
+	lock   sync.Mutex
+	data   map[string]*entry
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	// versions is the server's version when each key was last changed, including
+	// keys which have since been deleted, which is used to detect changes to
+	// watched keys.
+	version  uint64
+	versions map[string]uint64
+
+	// abortExec aborts every transaction with watched keys, as if another client
+	// had changed them. aborted counts the aborted transactions.
+	abortExec bool
+	aborted   int
+}
+
+// entry is a hash and its expiration.
+type entry struct {
+	hash    map[string]string
+	expires time.Time
+}
+
+// Start starts a server on a random local port. If password is not empty,
+// clients must AUTH before running any other command.
+func Start(password string) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		ln:       ln,
+		password: password,
+		data:     make(map[string]*entry),
+		conns:    make(map[net.Conn]struct{}),
+		versions: make(map[string]uint64),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address on which the server is listening.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Keys returns the number of keys which have not expired.
+func (s *Server) Keys() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for k := range s.data {
+		if s.lookup(k) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// AbortExec sets whether every transaction which watches a key is aborted, as if
+// another client had changed the key.
+func (s *Server) AbortExec(abort bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.abortExec = abort
+}
+
+// Aborted returns the number of transactions which were aborted because a
+// watched key changed.
+func (s *Server) Aborted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.aborted
+}
+
+// Close stops the server and closes every connection. It is safe to call more
+// than once.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// session is the per-connection state.
+type session struct {
+	authed  bool
+	watched map[string]uint64
+	queue   [][]string
+	inMulti bool
+	dirty   bool
+}
+
+// handle runs the commands from a single connection.
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		c.Close()
+	}()
+
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	sess := &session{
+		authed:  s.password == "",
+		watched: make(map[string]uint64),
+	}
+
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				writeError(bw, "ERR protocol error: "+err.Error())
+				bw.Flush()
+			}
+			return
+		}
+
+		s.dispatch(bw, sess, args)
+		if err := bw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch runs a single command, handling authentication and transactions.
+func (s *Server) dispatch(w *bufio.Writer, sess *session, args []string) {
+	if len(args) == 0 {
+		writeError(w, "ERR empty command")
+		return
+	}
+	name := strings.ToUpper(args[0])
+
+	if name == "AUTH" {
+		if len(args) < 2 || len(args) > 3 {
+			writeError(w, "ERR wrong number of arguments for 'auth' command")
+			return
+		}
+		if args[len(args)-1] != s.password {
+			writeError(w, "WRONGPASS invalid username-password pair")
+			return
+		}
+		sess.authed = true
+		writeSimple(w, "OK")
+		return
+	}
+	if !sess.authed {
+		writeError(w, "NOAUTH Authentication required.")
+		return
+	}
+
+	switch name {
+	case "MULTI":
+		if sess.inMulti {
+			writeError(w, "ERR MULTI calls can not be nested")
+			return
+		}
+		sess.inMulti = true
+		sess.queue = nil
+		sess.dirty = false
+		writeSimple(w, "OK")
+		return
+	case "DISCARD":
+		if !sess.inMulti {
+			writeError(w, "ERR DISCARD without MULTI")
+			return
+		}
+		sess.reset()
+		writeSimple(w, "OK")
+		return
+	case "EXEC":
+		if !sess.inMulti {
+			writeError(w, "ERR EXEC without MULTI")
+			return
+		}
+		s.exec(w, sess)
+		return
+	case "WATCH":
+		if sess.inMulti {
+			writeError(w, "ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		s.lock.Lock()
+		for _, k := range args[1:] {
+			s.lookup(k)
+			sess.watched[k] = s.versions[k]
+		}
+		s.lock.Unlock()
+		writeSimple(w, "OK")
+		return
+	case "UNWATCH":
+		sess.watched = make(map[string]uint64)
+		writeSimple(w, "OK")
+		return
+	}
+
+	if sess.inMulti {
+		if _, ok := commands[name]; !ok {
+			sess.dirty = true
+			writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+			return
+		}
+		sess.queue = append(sess.queue, args)
+		writeSimple(w, "QUEUED")
+		return
+	}
+
+	s.lock.Lock()
+	reply := s.run(args)
+	s.lock.Unlock()
+	writeReply(w, reply)
+}
+
+// exec runs the queued commands atomically, unless a watched key changed.
+func (s *Server) exec(w *bufio.Writer, sess *session) {
+	defer sess.reset()
+
+	if sess.dirty {
+		writeError(w, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, v := range sess.watched {
+		s.lookup(k)
+		if s.abortExec || s.versions[k] != v {
+			s.aborted++
+			w.WriteString("*-1\r\n")
+			return
+		}
+	}
+
+	replies := make([]interface{}, 0, len(sess.queue))
+	for _, args := range sess.queue {
+		replies = append(replies, s.run(args))
+	}
+	writeReply(w, replies)
+}
+
+// reset ends the transaction and clears the watched keys.
+func (sess *session) reset() {
+	sess.inMulti = false
+	sess.queue = nil
+	sess.dirty = false
+	sess.watched = make(map[string]uint64)
+}
+
+// statusReply is a simple string reply, and errorReply is an error reply.
+type (
+	statusReply string
+	errorReply  string
+)
+
+// commands are the commands which can be run directly or queued in a
+// transaction. They are called with the lock held.
+var commands = map[string]func(s *Server, args []string) interface{}{
+	"PING": func(s *Server, args []string) interface{} {
+		return statusReply("PONG")
+	},
+	"SELECT": func(s *Server, args []string) interface{} {
+		if len(args) != 2 {
+			return errorReply("ERR wrong number of arguments for 'select' command")
+		}
+		if _, err := strconv.Atoi(args[1]); err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		return statusReply("OK")
+	},
+	"FLUSHALL": func(s *Server, args []string) interface{} {
+		for k := range s.data {
+			s.touch(k)
+		}
+		s.data = make(map[string]*entry)
+		return statusReply("OK")
+	},
+	"HSET": func(s *Server, args []string) interface{} {
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errorReply("ERR wrong number of arguments for 'hset' command")
+		}
+		e := s.lookup(args[1])
+		if e == nil {
+			e = &entry{hash: make(map[string]string)}
+			s.data[args[1]] = e
+		}
+
+		var added int64
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := e.hash[args[i]]; !ok {
+				added++
+			}
+			e.hash[args[i]] = args[i+1]
+		}
+		s.touch(args[1])
+		return added
+	},
+	"HMGET": func(s *Server, args []string) interface{} {
+		if len(args) < 3 {
+			return errorReply("ERR wrong number of arguments for 'hmget' command")
+		}
+		e := s.lookup(args[1])
+
+		values := make([]interface{}, 0, len(args)-2)
+		for _, f := range args[2:] {
+			if e == nil {
+				values = append(values, nil)
+				continue
+			}
+			if v, ok := e.hash[f]; ok {
+				values = append(values, v)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	},
+	"DEL": func(s *Server, args []string) interface{} {
+		var deleted int64
+		for _, k := range args[1:] {
+			if s.lookup(k) != nil {
+				delete(s.data, k)
+				s.touch(k)
+				deleted++
+			}
+		}
+		return deleted
+	},
+	"PEXPIRE": func(s *Server, args []string) interface{} {
+		if len(args) != 3 {
+			return errorReply("ERR wrong number of arguments for 'pexpire' command")
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		e := s.lookup(args[1])
+		if e == nil {
+			return int64(0)
+		}
+		e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		s.touch(args[1])
+		return int64(1)
+	},
+	"PTTL": func(s *Server, args []string) interface{} {
+		if len(args) != 2 {
+			return errorReply("ERR wrong number of arguments for 'pttl' command")
+		}
+		e := s.lookup(args[1])
+		if e == nil {
+			return int64(-2)
+		}
+		if e.expires.IsZero() {
+			return int64(-1)
+		}
+		return time.Until(e.expires).Milliseconds()
+	},
+}
+
+// run runs a command with the lock held.
+func (s *Server) run(args []string) interface{} {
+	cmd, ok := commands[strings.ToUpper(args[0])]
+	if !ok {
+		return errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return cmd(s, args)
+}
+
+// lookup returns the entry for the key, or nil if it does not exist or has
+// expired. It must be called with the lock held.
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.data, key)
+		s.touch(key)
+		return nil
+	}
+	return e
+}
+
+// touch records a change to the key, which aborts transactions watching it. It
+// must be called with the lock held.
+func (s *Server) touch(key string) {
+	s.version++
+	s.versions[key] = s.version
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("expected array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid array length %q", line)
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, without the terminator.
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// writeReply writes a reply returned by a command.
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case statusReply:
+		writeSimple(w, string(r))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case errorReply:
+		writeError(w, string(r))
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeReply(w, v)
+		}
+	default:
+		writeError(w, fmt.Sprintf("ERR unexpected reply type %T", reply))
+	}
+}
+
+// writeSimple writes a simple string reply.
+func writeSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+// writeError writes an error reply.
+func writeError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
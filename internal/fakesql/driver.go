@@ -0,0 +1,950 @@
+// Package fakesql is a minimal in-memory database/sql driver for tests,
+// registered as "fakesql". Each data source name is a separate database, which
+// lives until the process exits.
+//
+// It understands only the statements used by sqlstore, in each of its
+// dialects:
+//
+//	CREATE TABLE IF NOT EXISTS t (c1 TYPE ..., c2 TYPE ..., [INDEX i (c)])
+//	CREATE INDEX IF NOT EXISTS i ON t (c)
+//	INSERT [IGNORE | OR IGNORE] INTO t (c1, ...) VALUES (?, ...)
+//	  [ON CONFLICT (c1) DO NOTHING | ON DUPLICATE KEY UPDATE c = c]
+//	SELECT c1, ... FROM t WHERE c = ? [FOR UPDATE]
+//	UPDATE t SET c1 = ?, ... WHERE c = ?
+//	DELETE FROM t WHERE c (= | <) ?
+//
+// Placeholders may be ? or $n. The first column of a table is its primary key.
+// A VARCHAR(n) column holds at most n bytes: longer values are truncated by
+// INSERT IGNORE, and rejected otherwise. ON DUPLICATE KEY UPDATE only accepts
+// assigning a column to itself, which leaves the row unchanged and affects no
+// rows, as MySQL reports it by default.
+//
+// Transactions run concurrently, and lock like the databases they stand in
+// for. By default, they lock rows like Postgres and MySQL at read committed:
+// writes and SELECT ... FOR UPDATE lock the rows they touch until the
+// transaction ends, and reads see only the committed state of the rows other
+// transactions locked. If the data source name starts with
+// "sqlite:", they lock the database like SQLite in WAL mode instead: reads see
+// the last commit, and a transaction which writes takes the write lock, or
+// fails with "database is locked" if it has read and another transaction
+// holds the lock or committed since. Statements outside a transaction run in
+// a transaction of their own.
+package fakesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func init() {
+	sql.Register("fakesql", &Driver{})
+}
+
+var (
+	_ driver.Driver             = (*Driver)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.NamedValueChecker  = (*conn)(nil)
+	_ driver.Rows               = (*rows)(nil)
+	_ driver.Tx                 = (*tx)(nil)
+	_ driver.SessionResetter    = (*conn)(nil)
+	_ driver.Validator          = (*conn)(nil)
+	_ driver.Stmt               = (*stmt)(nil)
+	_ driver.StmtExecContext    = (*stmt)(nil)
+	_ driver.StmtQueryContext   = (*stmt)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+)
+
+// errBusy is returned when a transaction can't take the write lock of a
+// database which locks like SQLite. It matches the message of the SQLite
+// drivers.
+var errBusy = errors.New("database is locked (5) (SQLITE_BUSY)")
+
+var (
+	databasesLock sync.Mutex
+	databases     = make(map[string]*database)
+)
+
+// Driver is the fakesql driver.
+type Driver struct{}
+
+// Open returns a connection to the database named by dsn, creating it if
+// necessary.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+
+	db, ok := databases[dsn]
+	if !ok {
+		db = &database{
+			sqlite:  strings.HasPrefix(dsn, "sqlite:"),
+			tables:  make(map[string]*table),
+			changed: make(chan struct{}),
+			locks:   make(map[string]*tx),
+		}
+		databases[dsn] = db
+	}
+	return &conn{db: db}, nil
+}
+
+// database is a set of tables, and the locks which transactions hold on them.
+type database struct {
+	// sqlite is true if transactions lock the database instead of rows.
+	sqlite bool
+
+	// lock guards the fields below. It is held for the duration of each
+	// statement, except while waiting for a transaction's lock.
+	lock sync.Mutex
+
+	// tables are the tables. When locking the database, they are only replaced
+	// by commits; when locking rows, they are changed in place.
+	tables map[string]*table
+
+	// changed is closed, and replaced, whenever a transaction releases its
+	// locks. It is a channel, so that waiting can be canceled.
+	changed chan struct{}
+
+	// locks are the row locks, by table and key, when locking rows.
+	locks map[string]*tx
+
+	// writer holds the write lock, and version counts the commits which wrote,
+	// when locking the database.
+	writer  *tx
+	version uint64
+
+	// waiting is the number of statements waiting for a lock.
+	waiting int
+}
+
+// Waiting returns the number of statements waiting for a lock in the database
+// named by dsn, so that tests can tell when a transaction is blocked.
+func Waiting(dsn string) int {
+	databasesLock.Lock()
+	db, ok := databases[dsn]
+	databasesLock.Unlock()
+	if !ok {
+		return 0
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.waiting
+}
+
+// wait waits until a transaction releases its locks, or ctx is done. It must
+// be called with the lock held, which it releases while waiting.
+func (db *database) wait(ctx context.Context) error {
+	changed := db.changed
+	db.waiting++
+	db.lock.Unlock()
+	defer func() {
+		db.lock.Lock()
+		db.waiting--
+	}()
+
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify wakes the transactions waiting for locks.
+func (db *database) notify() {
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
+
+// table is a list of columns and the rows, keyed by their first column.
+type table struct {
+	columns []string
+
+	// widths are the maximum lengths of the columns, or 0 if unlimited.
+	widths []int
+
+	rows map[string][]driver.Value
+}
+
+// clone returns a deep copy of the tables.
+func clone(tables map[string]*table) map[string]*table {
+	out := make(map[string]*table, len(tables))
+	for name, t := range tables {
+		rows := make(map[string][]driver.Value, len(t.rows))
+		for k, row := range t.rows {
+			rows[k] = append([]driver.Value(nil), row...)
+		}
+		out[name] = &table{columns: t.columns, widths: t.widths, rows: rows}
+	}
+	return out
+}
+
+// conn is a connection to a database.
+type conn struct {
+	db *database
+
+	// tx is the open transaction, if any.
+	tx *tx
+}
+
+// Prepare returns a statement which is parsed when it is run.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext returns a statement which is parsed when it is run.
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+// Close closes the connection, rolling back any open transaction.
+func (c *conn) Close() error {
+	if c.tx != nil {
+		return c.tx.Rollback()
+	}
+	return nil
+}
+
+// Begin starts a transaction.
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. Locks are taken by its statements.
+func (c *conn) BeginTx(_ context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, fmt.Errorf("transaction already open")
+	}
+
+	c.tx = &tx{conn: c}
+	return c.tx, nil
+}
+
+// ResetSession is called before the connection is reused.
+func (c *conn) ResetSession(_ context.Context) error {
+	if c.tx != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// IsValid reports whether the connection can be reused.
+func (c *conn) IsValid() bool {
+	return c.tx == nil
+}
+
+// CheckNamedValue accepts the values which the driver can store.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case int64, string, nil:
+		return nil
+	case int:
+		nv.Value = int64(v)
+		return nil
+	default:
+		return fmt.Errorf("unsupported value type %T", nv.Value)
+	}
+}
+
+// ExecContext runs a statement which does not return rows.
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var result driver.Result
+	err := c.run(func(t *tx) error {
+		var err error
+		result, err = t.exec(ctx, query, values(args))
+		return err
+	})
+	return result, err
+}
+
+// QueryContext runs a statement which returns rows.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var r driver.Rows
+	err := c.run(func(t *tx) error {
+		var err error
+		r, err = t.query(ctx, query, values(args))
+		return err
+	})
+	return r, err
+}
+
+// run runs fn in the open transaction, or in a transaction of its own which
+// is committed if fn succeeds. It holds the database lock.
+func (c *conn) run(fn func(t *tx) error) error {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+
+	if c.tx != nil {
+		return fn(c.tx)
+	}
+
+	t := &tx{conn: c}
+	err := fn(t)
+	t.end(err == nil)
+	return err
+}
+
+// values returns the values of the arguments in order.
+func values(args []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, 0, len(args))
+	for _, arg := range args {
+		out = append(out, arg.Value)
+	}
+	return out
+}
+
+// tx is an open transaction.
+type tx struct {
+	conn *conn
+
+	// locked are the rows locked by the transaction, and undo restores the rows
+	// it changed, latest first, when locking rows.
+	locked []string
+	undo   []undo
+
+	// read is true once the transaction has read, and snapshot is the version
+	// it read, when locking the database. tables are its changes, if it holds
+	// the write lock.
+	read     bool
+	snapshot uint64
+	tables   map[string]*table
+}
+
+// undo is the state of a row before a transaction changed it.
+type undo struct {
+	table *table
+	key   string
+	row   []driver.Value
+}
+
+// Commit ends the transaction, keeping its changes.
+func (t *tx) Commit() error {
+	return t.finish(true)
+}
+
+// Rollback ends the transaction, discarding its changes.
+func (t *tx) Rollback() error {
+	return t.finish(false)
+}
+
+// finish ends the open transaction.
+func (t *tx) finish(commit bool) error {
+	if t.conn.tx != t {
+		return sql.ErrTxDone
+	}
+
+	db := t.conn.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	t.end(commit)
+	t.conn.tx = nil
+	return nil
+}
+
+// end commits or rolls back the transaction, and releases its locks. It must
+// be called with the database lock held.
+func (t *tx) end(commit bool) {
+	db := t.conn.db
+
+	if db.sqlite {
+		if t.tables == nil {
+			return
+		}
+		if commit {
+			db.tables = t.tables
+			db.version++
+		}
+		db.writer = nil
+		db.notify()
+		return
+	}
+
+	if !commit {
+		for i := len(t.undo) - 1; i >= 0; i-- {
+			u := t.undo[i]
+			if u.row == nil {
+				delete(u.table.rows, u.key)
+			} else {
+				u.table.rows[u.key] = u.row
+			}
+		}
+	}
+	for _, id := range t.locked {
+		delete(db.locks, id)
+	}
+	if len(t.locked) > 0 {
+		db.notify()
+	}
+}
+
+// view returns the tables for reading.
+func (t *tx) view() map[string]*table {
+	db := t.conn.db
+	if !db.sqlite {
+		return db.tables
+	}
+
+	if t.tables != nil {
+		return t.tables
+	}
+	if !t.read {
+		t.read = true
+		t.snapshot = db.version
+	}
+	return db.tables
+}
+
+// writable returns the tables for writing. When locking the database, it takes
+// the write lock, and waits for it only if the transaction has not read.
+func (t *tx) writable(ctx context.Context) (map[string]*table, error) {
+	db := t.conn.db
+	if !db.sqlite {
+		return db.tables, nil
+	}
+
+	for t.tables == nil {
+		switch {
+		case db.writer == nil:
+			if t.read && t.snapshot != db.version {
+				return nil, errBusy
+			}
+			db.writer = t
+			t.tables = clone(db.tables)
+		case t.read:
+			return nil, errBusy
+		default:
+			if err := db.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.tables, nil
+}
+
+// lockRows locks the keys of the named table, when locking rows. If another
+// transaction holds one of them, it waits for a lock to be released and
+// returns false, and the caller must look at the table again.
+func (t *tx) lockRows(ctx context.Context, name string, keys []string) (bool, error) {
+	db := t.conn.db
+	if db.sqlite {
+		return true, nil
+	}
+
+	for _, k := range keys {
+		id := name + "\x00" + k
+		switch owner := db.locks[id]; owner {
+		case t:
+		case nil:
+			db.locks[id] = t
+			t.locked = append(t.locked, id)
+		default:
+			return false, db.wait(ctx)
+		}
+	}
+	return true, nil
+}
+
+// visible returns the table as the transaction sees it, when locking rows: the
+// rows which other transactions changed are replaced by their state before the
+// change.
+func (t *tx) visible(name string, tb *table) *table {
+	db := t.conn.db
+	if db.sqlite {
+		return tb
+	}
+
+	var out *table
+	for id, owner := range db.locks {
+		if owner == t || !strings.HasPrefix(id, name+"\x00") {
+			continue
+		}
+		k := strings.TrimPrefix(id, name+"\x00")
+
+		for _, u := range owner.undo {
+			if u.table != tb || u.key != k {
+				continue
+			}
+
+			if out == nil {
+				out = &table{columns: tb.columns, widths: tb.widths, rows: make(map[string][]driver.Value, len(tb.rows))}
+				for k, row := range tb.rows {
+					out.rows[k] = row
+				}
+			}
+			if u.row == nil {
+				delete(out.rows, k)
+			} else {
+				out.rows[k] = u.row
+			}
+			break
+		}
+	}
+
+	if out == nil {
+		return tb
+	}
+	return out
+}
+
+// save records the row so that it is restored on rollback, when locking rows.
+func (t *tx) save(tb *table, k string) {
+	if t.conn.db.sqlite {
+		return
+	}
+
+	var row []driver.Value
+	if r, ok := tb.rows[k]; ok {
+		row = append([]driver.Value(nil), r...)
+	}
+	t.undo = append(t.undo, undo{table: tb, key: k, row: row})
+}
+
+// stmt is a prepared statement.
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+// Close closes the statement.
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput returns -1, since the number of placeholders is not checked.
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+// Exec runs the statement.
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("use ExecContext")
+}
+
+// Query runs the statement.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("use QueryContext")
+}
+
+// ExecContext runs the statement.
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+// QueryContext runs the statement.
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+// Regular expressions for each statement, which are matched against the query
+// with quotes removed and whitespace collapsed.
+var (
+	createTableRe = regexp.MustCompile(`(?i)^CREATE TABLE IF NOT EXISTS (\S+) \((.+)\)$`)
+	createIndexRe = regexp.MustCompile(`(?i)^CREATE INDEX IF NOT EXISTS \S+ ON (\S+) \((\w+)\)$`)
+	insertRe      = regexp.MustCompile(`(?i)^INSERT (IGNORE |OR IGNORE )?INTO (\S+) \(([^)]+)\) VALUES \(([^)]+)\)( ON CONFLICT \((\w+)\) DO NOTHING| ON DUPLICATE KEY UPDATE (\w+) = (\w+))?$`)
+	selectRe      = regexp.MustCompile(`(?i)^SELECT (.+) FROM (\S+) WHERE (\w+) = (\S+)( FOR UPDATE)?$`)
+	updateRe      = regexp.MustCompile(`(?i)^UPDATE (\S+) SET (.+) WHERE (\w+) = (\S+)$`)
+	deleteRe      = regexp.MustCompile(`(?i)^DELETE FROM (\S+) WHERE (\w+) (=|<) (\S+)$`)
+	varcharRe     = regexp.MustCompile(`(?i)^VARCHAR\((\d+)\)$`)
+	spaceRe       = regexp.MustCompile(`\s+`)
+)
+
+// normalize removes identifier quotes and collapses whitespace.
+func normalize(query string) string {
+	query = strings.NewReplacer("`", "", `"`, "").Replace(query)
+	return strings.TrimSpace(spaceRe.ReplaceAllString(query, " "))
+}
+
+// placeholders resolves placeholders to argument values. Positional ?
+// placeholders are numbered in the order they are resolved.
+type placeholders struct {
+	args []driver.Value
+	next int
+}
+
+// value returns the value of the placeholder.
+func (p *placeholders) value(ph string) (driver.Value, error) {
+	ph = strings.TrimSpace(ph)
+
+	idx := p.next
+	switch {
+	case ph == "?":
+		p.next++
+	case strings.HasPrefix(ph, "$"):
+		n, err := strconv.Atoi(ph[1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid placeholder %q", ph)
+		}
+		idx = n - 1
+	default:
+		return nil, fmt.Errorf("expected placeholder, got %q", ph)
+	}
+
+	if idx >= len(p.args) {
+		return nil, fmt.Errorf("missing argument for placeholder %q", ph)
+	}
+	return p.args[idx], nil
+}
+
+// exec runs a statement which does not return rows. It must be called with the
+// database lock held.
+func (t *tx) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	query = normalize(query)
+
+	if m := createTableRe.FindStringSubmatch(query); m != nil {
+		tables, err := t.writable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tables[m[1]]; ok {
+			return driver.RowsAffected(0), nil
+		}
+
+		tb := &table{rows: make(map[string][]driver.Value)}
+		for _, def := range strings.Split(m[2], ",") {
+			fields := strings.Fields(def)
+			switch strings.ToUpper(fields[0]) {
+			case "INDEX", "KEY", "PRIMARY", "UNIQUE":
+				continue
+			}
+
+			var width int
+			if len(fields) > 1 {
+				if vm := varcharRe.FindStringSubmatch(fields[1]); vm != nil {
+					width, _ = strconv.Atoi(vm[1])
+				}
+			}
+			tb.columns = append(tb.columns, fields[0])
+			tb.widths = append(tb.widths, width)
+		}
+		tables[m[1]] = tb
+		return driver.RowsAffected(0), nil
+	}
+
+	if m := createIndexRe.FindStringSubmatch(query); m != nil {
+		tb, err := lookup(t.view(), m[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tb.column(m[2]); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(0), nil
+	}
+
+	// Statements which change rows start again whenever they wait for a lock,
+	// since the rows may have changed while waiting.
+	for {
+		tables, err := t.writable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p := &placeholders{args: args}
+
+		var result driver.Result
+		var locked bool
+		switch {
+		case insertRe.MatchString(query):
+			result, locked, err = t.insert(ctx, tables, insertRe.FindStringSubmatch(query), p)
+		case updateRe.MatchString(query):
+			result, locked, err = t.update(ctx, tables, updateRe.FindStringSubmatch(query), p)
+		case deleteRe.MatchString(query):
+			result, locked, err = t.delete(ctx, tables, deleteRe.FindStringSubmatch(query), p)
+		default:
+			return nil, fmt.Errorf("unsupported statement %q", query)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return result, nil
+		}
+	}
+}
+
+// insert runs an INSERT statement. It reports false if it had to wait for a
+// lock.
+func (t *tx) insert(ctx context.Context, tables map[string]*table, m []string, p *placeholders) (driver.Result, bool, error) {
+	tb, err := lookup(tables, m[2])
+	if err != nil {
+		return nil, false, err
+	}
+
+	ignore := m[1] != ""
+	if m[7] != "" && !strings.EqualFold(m[7], m[8]) {
+		return nil, false, fmt.Errorf("ON DUPLICATE KEY UPDATE can only assign a column to itself")
+	}
+
+	cols := splitList(m[3])
+	phs := splitList(m[4])
+	if len(cols) != len(tb.columns) || len(phs) != len(cols) {
+		return nil, false, fmt.Errorf("insert must set every column")
+	}
+
+	row := make([]driver.Value, len(tb.columns))
+	for i, col := range cols {
+		idx, err := tb.column(col)
+		if err != nil {
+			return nil, false, err
+		}
+		v, err := p.value(phs[i])
+		if err != nil {
+			return nil, false, err
+		}
+		if row[idx], err = tb.fit(idx, v, ignore); err != nil {
+			return nil, false, err
+		}
+	}
+
+	k := fmt.Sprint(row[0])
+	if ok, err := t.lockRows(ctx, m[2], []string{k}); !ok || err != nil {
+		return nil, false, err
+	}
+
+	if _, ok := tb.rows[k]; ok {
+		if !ignore && m[5] == "" {
+			return nil, false, fmt.Errorf("duplicate key %q", k)
+		}
+		return driver.RowsAffected(0), true, nil
+	}
+	t.save(tb, k)
+	tb.rows[k] = row
+	return driver.RowsAffected(1), true, nil
+}
+
+// update runs an UPDATE statement. It reports false if it had to wait for a
+// lock.
+func (t *tx) update(ctx context.Context, tables map[string]*table, m []string, p *placeholders) (driver.Result, bool, error) {
+	tb, err := lookup(tables, m[1])
+	if err != nil {
+		return nil, false, err
+	}
+
+	type assignment struct {
+		idx int
+		v   driver.Value
+	}
+	var assignments []assignment
+	for _, set := range splitList(m[2]) {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 {
+			return nil, false, fmt.Errorf("invalid assignment %q", set)
+		}
+		idx, err := tb.column(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, false, err
+		}
+		v, err := p.value(parts[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if v, err = tb.fit(idx, v, false); err != nil {
+			return nil, false, err
+		}
+		assignments = append(assignments, assignment{idx: idx, v: v})
+	}
+
+	matches, err := tb.where(m[3], "=", m[4], p)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok, err := t.lockRows(ctx, m[1], matches); !ok || err != nil {
+		return nil, false, err
+	}
+
+	for _, k := range matches {
+		t.save(tb, k)
+		for _, a := range assignments {
+			tb.rows[k][a.idx] = a.v
+		}
+	}
+	return driver.RowsAffected(len(matches)), true, nil
+}
+
+// delete runs a DELETE statement. It reports false if it had to wait for a
+// lock.
+func (t *tx) delete(ctx context.Context, tables map[string]*table, m []string, p *placeholders) (driver.Result, bool, error) {
+	tb, err := lookup(tables, m[1])
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches, err := tb.where(m[2], m[3], m[4], p)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok, err := t.lockRows(ctx, m[1], matches); !ok || err != nil {
+		return nil, false, err
+	}
+
+	for _, k := range matches {
+		t.save(tb, k)
+		delete(tb.rows, k)
+	}
+	return driver.RowsAffected(len(matches)), true, nil
+}
+
+// query runs a statement which returns rows. It must be called with the
+// database lock held.
+func (t *tx) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	query = normalize(query)
+
+	m := selectRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query %q", query)
+	}
+
+	for {
+		p := &placeholders{args: args}
+
+		tb, err := lookup(t.view(), m[2])
+		if err != nil {
+			return nil, err
+		}
+		tb = t.visible(m[2], tb)
+
+		cols := splitList(m[1])
+		idxs := make([]int, 0, len(cols))
+		for _, col := range cols {
+			idx, err := tb.column(col)
+			if err != nil {
+				return nil, err
+			}
+			idxs = append(idxs, idx)
+		}
+
+		matches, err := tb.where(m[3], "=", m[4], p)
+		if err != nil {
+			return nil, err
+		}
+		if m[5] != "" {
+			if ok, err := t.lockRows(ctx, m[2], matches); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+
+		r := &rows{columns: cols}
+		for _, k := range matches {
+			row := make([]driver.Value, 0, len(idxs))
+			for _, idx := range idxs {
+				row = append(row, tb.rows[k][idx])
+			}
+			r.rows = append(r.rows, row)
+		}
+		return r, nil
+	}
+}
+
+// lookup returns the named table.
+func lookup(tables map[string]*table, name string) (*table, error) {
+	t, ok := tables[name]
+	if !ok {
+		return nil, fmt.Errorf("no such table %q", name)
+	}
+	return t, nil
+}
+
+// column returns the index of the named column.
+func (t *table) column(name string) (int, error) {
+	for i, col := range t.columns {
+		if strings.EqualFold(col, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no such column %q", name)
+}
+
+// fit checks that the value fits in the column. A string which is too long is
+// truncated if truncate is true, and rejected otherwise.
+func (t *table) fit(idx int, v driver.Value, truncate bool) (driver.Value, error) {
+	s, ok := v.(string)
+	if w := t.widths[idx]; ok && w > 0 && len(s) > w {
+		if !truncate {
+			return nil, fmt.Errorf("data too long for column %q", t.columns[idx])
+		}
+		return s[:w], nil
+	}
+	return v, nil
+}
+
+// where returns the keys of the rows for which the column compares to the
+// placeholder's value with op, which is = or <. Only integers can be compared
+// with <.
+func (t *table) where(col, op, ph string, p *placeholders) ([]string, error) {
+	idx, err := t.column(col)
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.value(ph)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for k, row := range t.rows {
+		switch op {
+		case "=":
+			if row[idx] == v {
+				keys = append(keys, k)
+			}
+		case "<":
+			a, aok := row[idx].(int64)
+			b, bok := v.(int64)
+			if !aok || !bok {
+				return nil, fmt.Errorf("can only compare integers")
+			}
+			if a < b {
+				keys = append(keys, k)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported operator %q", op)
+		}
+	}
+	return keys, nil
+}
+
+// splitList splits a comma-separated list and trims each item.
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// rows is the result of a query.
+type rows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// Columns returns the names of the columns.
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+// Close closes the rows.
+func (r *rows) Close() error {
+	return nil
+}
+
+// Next copies the next row into dest.
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
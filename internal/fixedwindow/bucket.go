@@ -0,0 +1,79 @@
+// Package fixedwindow implements the state of a fixed window bucket as plain
+// values, with the same semantics as the memorystore fixed window. It is used
+// by the stores which keep their buckets in an external service, and read and
+// write the whole bucket on every update. Store implements their operations on
+// top of a Backend, which only loads buckets and stores them back.
+package fixedwindow
+
+import (
+	"time"
+)
+
+// Bucket is the state of a fixed window bucket.
+type Bucket struct {
+	// MaxTokens is the maximum number of tokens permitted on the bucket at any
+	// time, except after a burst.
+	MaxTokens uint64
+
+	// Interval is the time at which ticking should occur.
+	Interval time.Duration
+
+	// StartTime is the number of nanoseconds from unix epoch when the bucket was
+	// created, or when the clock was last rewound.
+	StartTime uint64
+
+	// LastTick is the last clock tick, and Available is the number of tokens
+	// remaining in it.
+	LastTick  uint64
+	Available uint64
+}
+
+// New creates a new, full bucket.
+func New(now, tokens uint64, interval time.Duration) Bucket {
+	return Bucket{
+		MaxTokens: tokens,
+		Interval:  interval,
+		StartTime: now,
+		Available: tokens,
+	}
+}
+
+// Take attempts to remove n tokens from the bucket. If the clock has ticked
+// forward since the last take, it refills the bucket first. If fewer than n
+// tokens are available, no tokens are removed. It returns the time at which the
+// current tick ends, and whether the take was successful.
+func (b *Bucket) Take(now, n uint64) (reset uint64, ok bool) {
+	// If the current time is before the start time, it means the clock was reset
+	// to an earlier time. In that case, rebase to 0.
+	if now < b.StartTime {
+		b.StartTime = now
+		b.LastTick = 0
+	}
+
+	currTick := (now - b.StartTime) / uint64(b.Interval)
+	if b.LastTick < currTick {
+		b.Available = b.MaxTokens
+		b.LastTick = currTick
+	}
+
+	if b.Available >= n {
+		b.Available -= n
+		ok = true
+	}
+	return b.StartTime + ((currTick + 1) * uint64(b.Interval)), ok
+}
+
+// Burst adds tokens to the bucket's available tokens.
+func (b *Bucket) Burst(tokens uint64) {
+	b.Available += tokens
+}
+
+// Refund returns tokens to the bucket, but only if the bucket is still in the
+// tick which ends at reset. It reports whether the bucket changed.
+func (b *Bucket) Refund(now, tokens, reset uint64) bool {
+	if now >= reset || b.StartTime+((b.LastTick+1)*uint64(b.Interval)) != reset {
+		return false
+	}
+	b.Available += tokens
+	return true
+}
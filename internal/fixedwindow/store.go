@@ -0,0 +1,159 @@
+package fixedwindow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// ErrConflict is returned by a Backend when another client changed the bucket
+// while it was being updated, so the update must start again.
+var ErrConflict = errors.New("bucket changed during update")
+
+// Backend reads and writes the buckets in an external service.
+type Backend interface {
+	// Load reads the bucket at key, and reports whether it exists. The update
+	// is finished with the returned Txn.
+	Load(ctx context.Context, key string) (Bucket, bool, Txn, error)
+}
+
+// Txn is an update of a bucket which was loaded.
+type Txn interface {
+	// CompareAndStore writes the bucket, but only if the bucket did not change
+	// since it was loaded. Otherwise, it writes nothing and returns
+	// ErrConflict. now is the time of the update.
+	CompareAndStore(ctx context.Context, b Bucket, now uint64) error
+
+	// Abort ends the update without writing.
+	Abort(ctx context.Context) error
+}
+
+// Store implements the operations which change buckets, for the stores which
+// keep them in an external service. Each operation loads the bucket, changes
+// it, and stores it back, and starts again after a short, growing, random wait
+// if another client changed it in between, up to MaxRetries times.
+type Store struct {
+	Backend    Backend
+	Tokens     uint64
+	Interval   time.Duration
+	MaxRetries int
+	Clock      limiter.Clock
+}
+
+// Take attempts to remove a token from the named key. If the take is
+// successful, it returns true, otherwise false. It also returns the configured
+// limit, remaining tokens, and reset time.
+func (s *Store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN attempts to remove n tokens from the named key. The take is all or
+// nothing - if fewer than n tokens are available, no tokens are removed and the
+// take is unsuccessful. It returns the same values as Take.
+func (s *Store) TakeN(ctx context.Context, key string, n uint64) (tokens, remaining, reset uint64, ok bool, retErr error) {
+	retErr = s.update(ctx, key, func(b *Bucket, exists bool, now uint64) bool {
+		if !exists {
+			*b = New(now, s.Tokens, s.Interval)
+		}
+
+		before := *b
+		reset, ok = b.Take(now, n)
+		tokens, remaining = b.MaxTokens, b.Available
+		return !exists || *b != before
+	})
+	if retErr != nil {
+		return 0, 0, 0, false, retErr
+	}
+	return
+}
+
+// Set configures the bucket-specific tokens and interval.
+func (s *Store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	return s.update(ctx, key, func(b *Bucket, _ bool, now uint64) bool {
+		*b = New(now, tokens, interval)
+		return true
+	})
+}
+
+// Burst adds the provided value to the bucket's currently available tokens.
+func (s *Store) Burst(ctx context.Context, key string, tokens uint64) error {
+	return s.update(ctx, key, func(b *Bucket, exists bool, now uint64) bool {
+		if !exists {
+			*b = New(now, s.Tokens+tokens, s.Interval)
+			return true
+		}
+		b.Burst(tokens)
+		return true
+	})
+}
+
+// Refund returns tokens to the bucket at key, provided the bucket is still in
+// the interval that ends at reset.
+func (s *Store) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	return s.update(ctx, key, func(b *Bucket, exists bool, now uint64) bool {
+		return exists && b.Refund(now, tokens, reset)
+	})
+}
+
+// update loads the bucket at key, calls fn to modify it, and stores it back if
+// fn returns true. fn is told whether the bucket exists, and the current time.
+// If the backend reports a conflict, the update starts again, so fn may be
+// called more than once.
+func (s *Store) update(ctx context.Context, key string, fn func(b *Bucket, exists bool, now uint64) bool) error {
+	for attempt := 0; attempt <= s.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := backoff(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		err := s.tryUpdate(ctx, key, fn)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("bucket %q changed during %d attempts to update it", key, s.MaxRetries+1)
+}
+
+// tryUpdate runs a single attempt of update.
+func (s *Store) tryUpdate(ctx context.Context, key string, fn func(b *Bucket, exists bool, now uint64) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b, exists, txn, err := s.Backend.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	now := s.Clock.Now()
+	if !fn(&b, exists, now) {
+		return txn.Abort(ctx)
+	}
+	return txn.CompareAndStore(ctx, b, now)
+}
+
+// backoff waits before the attempt, for a random time which grows with the
+// number of attempts, so that clients which conflicted do not retry in
+// lockstep.
+func backoff(ctx context.Context, attempt int) error {
+	d := 50 * time.Millisecond
+	if attempt < 6 {
+		d = time.Millisecond << attempt
+	}
+	d = d/2 + rand.N(d/2+1)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,131 @@
+package fixedwindow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter/fakeclock"
+)
+
+// mapBackend keeps the buckets in a map. It reports a conflict for the next
+// conflicts updates.
+type mapBackend struct {
+	lock      sync.Mutex
+	buckets   map[string]Bucket
+	conflicts int
+}
+
+func (m *mapBackend) Load(_ context.Context, key string) (Bucket, bool, Txn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.buckets[key]
+	return b, ok, &mapTxn{backend: m, key: key}, nil
+}
+
+type mapTxn struct {
+	backend *mapBackend
+	key     string
+}
+
+func (t *mapTxn) CompareAndStore(_ context.Context, b Bucket, _ uint64) error {
+	t.backend.lock.Lock()
+	defer t.backend.lock.Unlock()
+
+	if t.backend.conflicts > 0 {
+		t.backend.conflicts--
+		return ErrConflict
+	}
+	t.backend.buckets[t.key] = b
+	return nil
+}
+
+func (t *mapTxn) Abort(_ context.Context) error {
+	return nil
+}
+
+func TestStore_TakeN(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+	s := &Store{
+		Backend:  &mapBackend{buckets: make(map[string]Bucket)},
+		Tokens:   3,
+		Interval: time.Minute,
+		Clock:    clock,
+	}
+
+	for i := uint64(0); i < 3; i++ {
+		limit, remaining, reset, ok, err := s.Take(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("%d: expected take to succeed", i)
+		}
+		if got, want := limit, uint64(3); got != want {
+			t.Errorf("%d: expected %d to be %d", i, got, want)
+		}
+		if got, want := remaining, 2-i; got != want {
+			t.Errorf("%d: expected %d to be %d", i, got, want)
+		}
+		if got, want := reset, clock.Now()+uint64(time.Minute); got != want {
+			t.Errorf("%d: expected %d to be %d", i, got, want)
+		}
+	}
+
+	if _, _, _, ok, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("expected take to be rejected")
+	}
+
+	// The bucket refills at the start of the next interval.
+	clock.Advance(time.Minute)
+	if _, remaining, _, ok, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	} else if !ok || remaining != 2 {
+		t.Errorf("expected take to succeed with 2 remaining, got %d, %t", remaining, ok)
+	}
+
+	// A rewound clock starts a new window.
+	clock.Advance(-time.Hour)
+	if _, remaining, reset, ok, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	} else if !ok || remaining != 1 || reset != clock.Now()+uint64(time.Minute) {
+		t.Errorf("expected take to succeed with 1 remaining, got %d, %t, %d", remaining, ok, reset)
+	}
+}
+
+func TestStore_conflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	backend := &mapBackend{buckets: make(map[string]Bucket)}
+	s := &Store{
+		Backend:    backend,
+		Tokens:     3,
+		Interval:   time.Minute,
+		MaxRetries: 2,
+		Clock:      fakeclock.New(time.Unix(1700000000, 0)),
+	}
+
+	// Conflicts are retried.
+	backend.conflicts = 2
+	if _, remaining, _, ok, err := s.Take(ctx, "key"); err != nil || !ok || remaining != 2 {
+		t.Errorf("expected take to succeed with 2 remaining, got %d, %t, %v", remaining, ok, err)
+	}
+
+	// An update which keeps conflicting gives up once the retries run out.
+	backend.conflicts = 3
+	if _, _, _, _, err := s.Take(ctx, "key"); err == nil || errors.Is(err, ErrConflict) {
+		t.Errorf("expected error other than %v, got %v", ErrConflict, err)
+	}
+	if got, want := backend.conflicts, 0; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
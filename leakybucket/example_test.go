@@ -0,0 +1,61 @@
+package leakybucket_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/leakybucket"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// A fake clock keeps the example deterministic. Leave Clock unset to use the
+	// system clock.
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+
+	// Create a shaper that lets 5 requests per second through, and holds up to
+	// 2 more in the queue.
+	shaper, err := leakybucket.New(&leakybucket.Config{
+		Rate:     5,
+		Interval: time.Second,
+		MaxQueue: 2,
+		Clock:    clock,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shaper.Close(ctx)
+
+	// Each request waits for its slot; once the queue is full, requests are
+	// rejected until it drains.
+	for i := 0; i < 4; i++ {
+		delay, ok, err := shaper.Delay(ctx, "my-key")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			fmt.Printf("queue is full, retry in %s\n", delay)
+			continue
+		}
+		fmt.Printf("wait %s\n", delay)
+	}
+
+	// Once a slot drains, there is room in the queue again.
+	clock.Advance(200 * time.Millisecond)
+	delay, ok, err := shaper.Delay(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wait %s (%t)\n", delay, ok)
+
+	// Output:
+	// wait 0s
+	// wait 200ms
+	// wait 400ms
+	// queue is full, retry in 200ms
+	// wait 400ms (true)
+}
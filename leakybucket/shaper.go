@@ -0,0 +1,152 @@
+// Package leakybucket defines a leaky bucket which shapes traffic to a constant
+// rate. Instead of rejecting requests which exceed the rate, it queues them and
+// tells the caller how long to wait.
+package leakybucket
+
+import (
+	"context"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+var _ limiter.Shaper = (*shaper)(nil)
+
+type shaper struct {
+	// store meters the requests for each key. It spaces tokens one emission
+	// interval apart, and holds one token for the request being served plus one
+	// for each request in the queue.
+	store limiter.Store
+	clock limiter.Clock
+
+	// emission is the number of nanoseconds between slots.
+	emission uint64
+}
+
+// Config is used as input to New. It defines the behavior of the shaper.
+type Config struct {
+	// Rate is the number of requests to permit per interval. Requests are spaced
+	// evenly across the interval. The default value is 1.
+	Rate uint64
+
+	// Interval is the time interval over which Rate requests are permitted. The
+	// default value is 1 second.
+	Interval time.Duration
+
+	// MaxQueue is the maximum number of requests which may be waiting for a slot
+	// for a single key. Once the queue is full, requests are rejected. The
+	// default value is Rate.
+	MaxQueue uint64
+
+	// SweepInterval is the rate at which to run the garbage collection on stale
+	// entries. The default value is 6 hours.
+	SweepInterval time.Duration
+
+	// SweepMinTTL is the minimum amount of time a key must be idle before
+	// clearing it from the entries. The default value is 12 hours.
+	SweepMinTTL time.Duration
+
+	// InitialAlloc is the size to use for the in-memory map. The default value is
+	// 4096.
+	InitialAlloc int
+
+	// DisablePurge disables the purge operation. WARNING: this will cause
+	// unbounded memory growth. Do not enable unless you have a fixed number of
+	// keys.
+	DisablePurge bool
+
+	// Clock is the source of the current time. The default value is the system
+	// clock.
+	Clock limiter.Clock
+}
+
+// New creates an in-memory leaky bucket shaper. Each key has its own queue,
+// which drains at Rate requests per Interval.
+//
+// The queues are kept in a memorystore using AlgorithmGCRA. A queue which may
+// hold MaxQueue requests is a bucket of MaxQueue+1 tokens which refills one
+// token per slot: a take succeeds exactly when the next slot is at most
+// MaxQueue slots away, and the number of tokens taken tells the caller how far
+// away its slot is.
+func New(c *Config) (limiter.Shaper, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	rate := uint64(1)
+	if c.Rate > 0 {
+		rate = c.Rate
+	}
+
+	interval := 1 * time.Second
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	maxQueue := rate
+	if c.MaxQueue > 0 {
+		maxQueue = c.MaxQueue
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	emission := max(uint64(interval)/rate, 1)
+
+	store, err := memorystore.New(&memorystore.Config{
+		Tokens:        maxQueue + 1,
+		Interval:      time.Duration(emission * (maxQueue + 1)),
+		Algorithm:     memorystore.AlgorithmGCRA,
+		SweepInterval: c.SweepInterval,
+		SweepMinTTL:   c.SweepMinTTL,
+		InitialAlloc:  c.InitialAlloc,
+		DisablePurge:  c.DisablePurge,
+		Clock:         clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &shaper{
+		store:    store,
+		clock:    clock,
+		emission: emission,
+	}, nil
+}
+
+// Delay reserves the next slot in the key's queue and returns how long the
+// caller must wait for it.
+func (s *shaper) Delay(ctx context.Context, key string) (time.Duration, bool, error) {
+	tokens, remaining, reset, ok, err := s.store.Take(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	now := s.clock.Now()
+
+	// If the queue is full, reset is when the next slot frees up.
+	if !ok {
+		return until(reset, now), false, nil
+	}
+
+	// Every token taken beyond the one for this request is a request queued
+	// ahead of it. The store reports reset as the time the next token becomes
+	// available, which is one slot after the first queued request's slot.
+	slot := reset + (tokens-1-remaining)*s.emission - s.emission
+	return until(slot, now), true, nil
+}
+
+// Close stops the shaper and cleans up any outstanding queues.
+func (s *shaper) Close(ctx context.Context) error {
+	return s.store.Close(ctx)
+}
+
+// until returns the time from now until t, or zero if t is not after now.
+func until(t, now uint64) time.Duration {
+	if t <= now {
+		return 0
+	}
+	return time.Duration(t - now)
+}
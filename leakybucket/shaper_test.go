@@ -0,0 +1,173 @@
+package leakybucket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+)
+
+func TestShaper_Delay(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Rate:          10,
+		Interval:      time.Second,
+		MaxQueue:      2,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The first request proceeds immediately and the next two are queued 100ms
+	// apart. Allow some slack for the time spent between calls.
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		delay, ok, err := s.Delay(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected request %d to be queued", i)
+		}
+		if delay > want || delay < want-10*time.Millisecond {
+			t.Errorf("request %d: expected %s to be about %s", i, delay, want)
+		}
+	}
+
+	// The queue is full.
+	delay, ok, err := s.Delay(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected queue to be full")
+	}
+	if want := 100 * time.Millisecond; delay > want || delay < want-10*time.Millisecond {
+		t.Errorf("expected %s to be about %s", delay, want)
+	}
+
+	// Other keys have their own queue.
+	if delay, ok, err := s.Delay(ctx, "other"); err != nil || !ok || delay != 0 {
+		t.Errorf("expected other key to proceed immediately, got %s, %t, %v", delay, ok, err)
+	}
+}
+
+func TestShaper_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing twice is fine.
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Delay(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+}
+
+func TestShaper_schedule(t *testing.T) {
+	t.Parallel()
+
+	type step struct {
+		at    time.Duration
+		delay time.Duration
+		ok    bool
+	}
+
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "constant_rate",
+			steps: []step{
+				{at: 0, delay: 0, ok: true},
+				{at: 100 * time.Millisecond, delay: 0, ok: true},
+				{at: 200 * time.Millisecond, delay: 0, ok: true},
+			},
+		},
+		{
+			name: "queues_bursts",
+			steps: []step{
+				{at: 0, delay: 0, ok: true},
+				{at: 0, delay: 100 * time.Millisecond, ok: true},
+				{at: 0, delay: 200 * time.Millisecond, ok: true},
+				{at: 0, delay: 300 * time.Millisecond, ok: true},
+				{at: 0, delay: 100 * time.Millisecond, ok: false},
+				{at: 50 * time.Millisecond, delay: 50 * time.Millisecond, ok: false},
+				{at: 100 * time.Millisecond, delay: 300 * time.Millisecond, ok: true},
+			},
+		},
+		{
+			name: "drains",
+			steps: []step{
+				{at: 0, delay: 0, ok: true},
+				{at: 0, delay: 100 * time.Millisecond, ok: true},
+				{at: time.Second, delay: 0, ok: true},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			start := time.Unix(0, 0).Add(time.Hour)
+			clock := fakeclock.New(start)
+
+			s, err := New(&Config{
+				Rate:     10,
+				Interval: time.Second,
+				MaxQueue: 3,
+				Clock:    clock,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			for i, step := range tc.steps {
+				clock.Set(start.Add(step.at))
+				delay, ok, err := s.Delay(ctx, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := ok, step.ok; got != want {
+					t.Errorf("step %d: ok: expected %t to be %t", i, got, want)
+				}
+				if got, want := delay, step.delay; got != want {
+					t.Errorf("step %d: delay: expected %s to be %s", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,542 @@
+// Package limitertest provides a conformance test suite for implementations of
+// limiter.Store. Call RunStoreTests from a test in the store's package:
+//
+//	func TestStore_conformance(t *testing.T) {
+//		limitertest.RunStoreTests(t, func() limiter.Store {
+//			s, err := mystore.New(&mystore.Config{})
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		})
+//	}
+//
+// Stores which share their buckets between processes, for example through a
+// database, should also call RunSharedStoreTests.
+package limitertest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// RunStoreTests runs the conformance suite against the stores returned by
+// newStore. It is called once per test, and each store is closed when its test
+// finishes, so it must return a new, independent store every time. Tests run
+// in parallel.
+//
+// The suite configures keys with Set, so the store's default limit does not
+// matter. Stores which report a limit of 0 from Take are treated as
+// non-enforcing (like noopstore): they are only checked to permit every take,
+// and the checks for limits, reset times, and ErrStopped are skipped.
+//
+// If the store implements limiter.StoreWithTakeN, limiter.StoreWithRefund, or
+// limiter.StoreWithDelete, those methods are tested too.
+func RunStoreTests(t *testing.T, newStore func() limiter.Store) {
+	t.Helper()
+
+	if !enforcing(t, newStore) {
+		t.Run("non_enforcing", func(t *testing.T) {
+			t.Parallel()
+			testNonEnforcing(t, open(t, newStore))
+		})
+		return
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s limiter.Store)
+	}{
+		{name: "take", fn: testTake},
+		{name: "get", fn: testGet},
+		{name: "set", fn: testSet},
+		{name: "burst", fn: testBurst},
+		{name: "keys", fn: testKeys},
+		{name: "reset", fn: testReset},
+		{name: "concurrent", fn: testConcurrent},
+		{name: "take_n", fn: testTakeN},
+		{name: "refund", fn: testRefund},
+		{name: "delete", fn: testDelete},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.fn(t, open(t, newStore))
+		})
+	}
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+		testClose(t, newStore())
+	})
+}
+
+// RunSharedStoreTests runs the checks for stores which share their buckets,
+// as the stores of several servers do, against the stores returned by
+// newStores. It is called once per test, and must return n stores which share
+// their buckets with each other, but not with the stores of other calls. Each
+// store is closed when its test finishes. Tests run in parallel.
+func RunSharedStoreTests(t *testing.T, newStores func(n int) []limiter.Store) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, stores []limiter.Store)
+	}{
+		{name: "shared_limit", fn: testSharedLimit},
+		{name: "shared_set", fn: testSharedSet},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			stores := newStores(3)
+			if len(stores) != 3 {
+				t.Fatalf("newStores returned %d stores, expected 3", len(stores))
+			}
+			for _, s := range stores {
+				s := s
+				t.Cleanup(func() {
+					if err := s.Close(context.Background()); err != nil {
+						t.Errorf("failed to close store: %v", err)
+					}
+				})
+			}
+			tc.fn(t, stores)
+		})
+	}
+}
+
+// open creates a store and closes it when the test finishes.
+func open(t *testing.T, newStore func() limiter.Store) limiter.Store {
+	t.Helper()
+
+	s := newStore()
+	if s == nil {
+		t.Fatal("newStore returned nil")
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Errorf("failed to close store: %v", err)
+		}
+	})
+	return s
+}
+
+// enforcing reports whether the store enforces limits, which is inferred from
+// whether it reports a limit from Take.
+func enforcing(t *testing.T, newStore func() limiter.Store) bool {
+	t.Helper()
+
+	s := newStore()
+	defer s.Close(context.Background())
+
+	limit, _, _, _, err := s.Take(context.Background(), "limitertest")
+	if err != nil {
+		t.Fatalf("failed to take: %v", err)
+	}
+	return limit > 0
+}
+
+// set configures the key with the given limit.
+func set(t *testing.T, s limiter.Store, key string, tokens uint64, interval time.Duration) {
+	t.Helper()
+
+	if err := s.Set(context.Background(), key, tokens, interval); err != nil {
+		t.Fatalf("failed to set %q: %v", key, err)
+	}
+}
+
+// take takes from the key and checks whether the take was permitted and the
+// number of remaining tokens.
+func take(t *testing.T, s limiter.Store, key string, wantOK bool, wantRemaining uint64) (uint64, uint64) {
+	t.Helper()
+
+	limit, remaining, reset, ok, err := s.Take(context.Background(), key)
+	if err != nil {
+		t.Fatalf("failed to take %q: %v", key, err)
+	}
+	if got, want := ok, wantOK; got != want {
+		t.Errorf("take %q: ok: expected %t to be %t", key, got, want)
+	}
+	if got, want := remaining, wantRemaining; got != want {
+		t.Errorf("take %q: remaining: expected %d to be %d", key, got, want)
+	}
+	return limit, reset
+}
+
+// get gets the key and checks the limit and number of remaining tokens.
+func get(t *testing.T, s limiter.Store, key string, wantLimit, wantRemaining uint64) {
+	t.Helper()
+
+	limit, remaining, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("failed to get %q: %v", key, err)
+	}
+	if got, want := limit, wantLimit; got != want {
+		t.Errorf("get %q: limit: expected %d to be %d", key, got, want)
+	}
+	if got, want := remaining, wantRemaining; got != want {
+		t.Errorf("get %q: remaining: expected %d to be %d", key, got, want)
+	}
+}
+
+func testNonEnforcing(t *testing.T, s limiter.Store) {
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+			t.Fatalf("take %d: expected take to be permitted, got %t, %v", i, ok, err)
+		}
+	}
+
+	if _, _, err := s.Get(ctx, "key"); err != nil {
+		t.Errorf("failed to get: %v", err)
+	}
+	if err := s.Set(ctx, "key", 1, time.Second); err != nil {
+		t.Errorf("failed to set: %v", err)
+	}
+	if err := s.Burst(ctx, "key", 1); err != nil {
+		t.Errorf("failed to burst: %v", err)
+	}
+}
+
+func testTake(t *testing.T, s limiter.Store) {
+	set(t, s, "key", 3, time.Hour)
+
+	for i := uint64(0); i < 3; i++ {
+		limit, _ := take(t, s, "key", true, 2-i)
+		if got, want := limit, uint64(3); got != want {
+			t.Errorf("take %d: limit: expected %d to be %d", i, got, want)
+		}
+	}
+
+	// The bucket is empty, so the take is rejected and nothing changes.
+	take(t, s, "key", false, 0)
+	take(t, s, "key", false, 0)
+}
+
+func testGet(t *testing.T, s limiter.Store) {
+	ctx := context.Background()
+
+	// Get must not consume tokens or create a limit for an unknown key.
+	limit, remaining, err := s.Get(ctx, "unknown")
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if remaining != limit {
+		t.Errorf("expected unknown key to have no tokens taken, got %d of %d", remaining, limit)
+	}
+
+	set(t, s, "key", 5, time.Hour)
+	get(t, s, "key", 5, 5)
+
+	take(t, s, "key", true, 4)
+	get(t, s, "key", 5, 4)
+
+	// Get does not change the bucket.
+	get(t, s, "key", 5, 4)
+	take(t, s, "key", true, 3)
+}
+
+func testSet(t *testing.T, s limiter.Store) {
+	set(t, s, "key", 2, time.Hour)
+	take(t, s, "key", true, 1)
+	take(t, s, "key", true, 0)
+	take(t, s, "key", false, 0)
+
+	// Set overwrites the limit and refills the bucket.
+	set(t, s, "key", 4, time.Hour)
+	get(t, s, "key", 4, 4)
+	take(t, s, "key", true, 3)
+}
+
+func testBurst(t *testing.T, s limiter.Store) {
+	ctx := context.Background()
+
+	set(t, s, "key", 2, time.Hour)
+	take(t, s, "key", true, 1)
+	take(t, s, "key", true, 0)
+
+	if err := s.Burst(ctx, "key", 3); err != nil {
+		t.Fatalf("failed to burst: %v", err)
+	}
+	get(t, s, "key", 2, 3)
+
+	// The burst tokens may be taken beyond the limit.
+	take(t, s, "key", true, 2)
+	take(t, s, "key", true, 1)
+	take(t, s, "key", true, 0)
+	take(t, s, "key", false, 0)
+}
+
+func testKeys(t *testing.T, s limiter.Store) {
+	set(t, s, "a", 1, time.Hour)
+	set(t, s, "b", 1, time.Hour)
+
+	take(t, s, "a", true, 0)
+	take(t, s, "a", false, 0)
+
+	// Keys are independent.
+	take(t, s, "b", true, 0)
+}
+
+func testReset(t *testing.T, s limiter.Store) {
+	const interval = 100 * time.Millisecond
+
+	set(t, s, "key", 2, interval)
+
+	// A permitted take resets within one interval.
+	before := uint64(time.Now().UnixNano())
+	_, reset := take(t, s, "key", true, 1)
+	after := uint64(time.Now().UnixNano())
+	if reset <= before || reset > after+uint64(interval) {
+		t.Errorf("expected reset %d to be in (%d, %d]", reset, before, after+uint64(interval))
+	}
+
+	take(t, s, "key", true, 0)
+
+	// A rejected take reports when a token will next be available, which may be
+	// up to two intervals away for sliding windows.
+	before = uint64(time.Now().UnixNano())
+	_, reset = take(t, s, "key", false, 0)
+	after = uint64(time.Now().UnixNano())
+	if reset <= before || reset > after+2*uint64(interval) {
+		t.Errorf("expected reset %d to be in (%d, %d]", reset, before, after+2*uint64(interval))
+	}
+
+	// Once the reset time passes, a take is permitted again.
+	time.Sleep(time.Until(time.Unix(0, int64(reset))) + time.Millisecond)
+	if _, _, _, ok, err := s.Take(context.Background(), "key"); err != nil || !ok {
+		t.Errorf("expected take after reset to be permitted, got %t, %v", ok, err)
+	}
+}
+
+func testConcurrent(t *testing.T, s limiter.Store) {
+	const tokens = 50
+	const workers = 10
+	const takes = 20
+
+	set(t, s, "key", tokens, time.Hour)
+
+	var lock sync.Mutex
+	var permitted int
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < takes; j++ {
+				_, _, _, ok, err := s.Take(context.Background(), "key")
+				if err != nil {
+					t.Errorf("failed to take: %v", err)
+					return
+				}
+				if ok {
+					lock.Lock()
+					permitted++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := permitted, tokens; got != want {
+		t.Errorf("expected %d takes to be permitted, got %d", want, got)
+	}
+	get(t, s, "key", tokens, 0)
+}
+
+func testSharedLimit(t *testing.T, stores []limiter.Store) {
+	const tokens = 50
+	const workers = 12
+	const takes = 10
+
+	set(t, stores[0], "key", tokens, time.Hour)
+
+	var lock sync.Mutex
+	var permitted int
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(s limiter.Store) {
+			defer wg.Done()
+
+			for j := 0; j < takes; j++ {
+				_, _, _, ok, err := s.Take(context.Background(), "key")
+				if err != nil {
+					t.Errorf("failed to take: %v", err)
+					return
+				}
+				if ok {
+					lock.Lock()
+					permitted++
+					lock.Unlock()
+				}
+			}
+		}(stores[i%len(stores)])
+	}
+	wg.Wait()
+
+	if got, want := permitted, tokens; got != want {
+		t.Errorf("expected %d takes to be permitted, got %d", want, got)
+	}
+	for _, s := range stores {
+		get(t, s, "key", tokens, 0)
+	}
+}
+
+func testSharedSet(t *testing.T, stores []limiter.Store) {
+	set(t, stores[0], "key", 3, time.Hour)
+
+	// Every store sees the limit, and the takes of the others.
+	take(t, stores[1], "key", true, 2)
+	take(t, stores[2], "key", true, 1)
+	take(t, stores[0], "key", true, 0)
+	take(t, stores[1], "key", false, 0)
+	for _, s := range stores {
+		get(t, s, "key", 3, 0)
+	}
+
+	if err := stores[2].Burst(context.Background(), "key", 1); err != nil {
+		t.Fatalf("failed to burst: %v", err)
+	}
+	take(t, stores[0], "key", true, 0)
+}
+
+func testTakeN(t *testing.T, s limiter.Store) {
+	sn, ok := s.(limiter.StoreWithTakeN)
+	if !ok {
+		t.Skip("store does not implement limiter.StoreWithTakeN")
+	}
+
+	ctx := context.Background()
+	set(t, s, "key", 5, time.Hour)
+
+	takeN := func(n uint64, wantOK bool, wantRemaining uint64) {
+		t.Helper()
+
+		_, remaining, _, ok, err := sn.TakeN(ctx, "key", n)
+		if err != nil {
+			t.Fatalf("failed to take %d: %v", n, err)
+		}
+		if got, want := ok, wantOK; got != want {
+			t.Errorf("take %d: ok: expected %t to be %t", n, got, want)
+		}
+		if got, want := remaining, wantRemaining; got != want {
+			t.Errorf("take %d: remaining: expected %d to be %d", n, got, want)
+		}
+	}
+
+	takeN(3, true, 2)
+
+	// The take is all or nothing.
+	takeN(3, false, 2)
+	get(t, s, "key", 5, 2)
+
+	takeN(2, true, 0)
+}
+
+func testRefund(t *testing.T, s limiter.Store) {
+	rs, ok := s.(limiter.StoreWithRefund)
+	if !ok {
+		t.Skip("store does not implement limiter.StoreWithRefund")
+	}
+
+	ctx := context.Background()
+	set(t, s, "key", 3, time.Hour)
+
+	_, reset := take(t, s, "key", true, 2)
+	if err := rs.Refund(ctx, "key", 1, reset); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	get(t, s, "key", 3, 3)
+
+	// Refunding a key which does not exist is not an error.
+	if err := rs.Refund(ctx, "unknown", 1, reset); err != nil {
+		t.Errorf("failed to refund unknown key: %v", err)
+	}
+}
+
+func testDelete(t *testing.T, s limiter.Store) {
+	ds, ok := s.(limiter.StoreWithDelete)
+	if !ok {
+		t.Skip("store does not implement limiter.StoreWithDelete")
+	}
+
+	ctx := context.Background()
+	set(t, s, "key", 1, time.Hour)
+	take(t, s, "key", true, 0)
+
+	if err := ds.Delete(ctx, "key"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	// The key starts over with the store's default limit.
+	limit, remaining, err := s.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if remaining != limit {
+		t.Errorf("expected deleted key to have no tokens taken, got %d of %d", remaining, limit)
+	}
+	if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+		t.Errorf("expected take after delete to be permitted, got %t, %v", ok, err)
+	}
+
+	// Deleting a key which does not exist is not an error.
+	if err := ds.Delete(ctx, "unknown"); err != nil {
+		t.Errorf("failed to delete unknown key: %v", err)
+	}
+}
+
+func testClose(t *testing.T, s limiter.Store) {
+	ctx := context.Background()
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// Closing twice is fine.
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("failed to close twice: %v", err)
+	}
+
+	if _, _, _, ok, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) || ok {
+		t.Errorf("take: expected %v to be %v", err, limiter.ErrStopped)
+	}
+	if _, _, err := s.Get(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("get: expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	if sn, ok := s.(limiter.StoreWithTakeN); ok {
+		if _, _, _, ok, err := sn.TakeN(ctx, "key", 1); !errors.Is(err, limiter.ErrStopped) || ok {
+			t.Errorf("take n: expected %v to be %v", err, limiter.ErrStopped)
+		}
+	}
+	if rs, ok := s.(limiter.StoreWithRefund); ok {
+		if err := rs.Refund(ctx, "key", 1, 0); !errors.Is(err, limiter.ErrStopped) {
+			t.Errorf("refund: expected %v to be %v", err, limiter.ErrStopped)
+		}
+	}
+	if ds, ok := s.(limiter.StoreWithDelete); ok {
+		if err := ds.Delete(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+			t.Errorf("delete: expected %v to be %v", err, limiter.ErrStopped)
+		}
+	}
+}
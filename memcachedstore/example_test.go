@@ -0,0 +1,29 @@
+package memcachedstore_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/memcachedstore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	store, err := memcachedstore.New(&memcachedstore.Config{
+		Addrs:    []string{"10.0.0.1:11211", "10.0.0.2:11211"},
+		Tokens:   15,
+		Interval: time.Minute,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
@@ -0,0 +1,201 @@
+package memcachedstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sethvargo/go-limiter/internal/connpool"
+)
+
+// Results of the storage commands.
+const (
+	resultStored    = "STORED"
+	resultNotStored = "NOT_STORED"
+	resultExists    = "EXISTS"
+	resultNotFound  = "NOT_FOUND"
+	resultDeleted   = "DELETED"
+)
+
+// serverError is an error reply from the server.
+type serverError string
+
+func (e serverError) Error() string {
+	return string(e)
+}
+
+// conn is a single connection to a server, which speaks the memcached text
+// protocol.
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// newConn wraps the network connection. The timeouts apply to commands whose
+// context has no deadline.
+func newConn(nc net.Conn, readTimeout, writeTimeout time.Duration) *conn {
+	return &conn{
+		nc: nc,
+		br: bufio.NewReader(nc),
+		bw: bufio.NewWriter(nc),
+
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// gets returns the value at key and its CAS unique. It reports whether the key
+// exists.
+func (c *conn) gets(ctx context.Context, key string) ([]byte, uint64, bool, error) {
+	if err := c.send(ctx, "gets "+key+"\r\n", nil); err != nil {
+		return nil, 0, false, err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if line == "END" {
+		return nil, 0, false, nil
+	}
+
+	// VALUE <key> <flags> <bytes> <cas unique>
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "VALUE" || fields[1] != key {
+		return nil, 0, false, fmt.Errorf("unexpected gets reply %q", line)
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil || n < 0 {
+		return nil, 0, false, fmt.Errorf("invalid value length %q", fields[3])
+	}
+	cas, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("invalid cas unique %q", fields[4])
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(c.br, b); err != nil {
+		return nil, 0, false, err
+	}
+
+	if line, err := c.readLine(); err != nil {
+		return nil, 0, false, err
+	} else if line != "END" {
+		return nil, 0, false, fmt.Errorf("unexpected gets reply %q", line)
+	}
+	return b[:n], cas, true, nil
+}
+
+// add stores the value at key only if the key does not exist. It returns
+// STORED or NOT_STORED.
+func (c *conn) add(ctx context.Context, key string, exptime int64, value []byte) (string, error) {
+	line := fmt.Sprintf("add %s 0 %d %d\r\n", key, exptime, len(value))
+	return c.storage(ctx, line, value)
+}
+
+// cas stores the value at key only if it has not changed since it was read
+// with gets. It returns STORED, EXISTS, or NOT_FOUND.
+func (c *conn) cas(ctx context.Context, key string, exptime int64, value []byte, unique uint64) (string, error) {
+	line := fmt.Sprintf("cas %s 0 %d %d %d\r\n", key, exptime, len(value), unique)
+	return c.storage(ctx, line, value)
+}
+
+// delete deletes the key. It returns DELETED or NOT_FOUND.
+func (c *conn) delete(ctx context.Context, key string) (string, error) {
+	if err := c.send(ctx, "delete "+key+"\r\n", nil); err != nil {
+		return "", err
+	}
+	return c.readResult("delete")
+}
+
+// storage sends a storage command and its data block, and returns the result.
+func (c *conn) storage(ctx context.Context, line string, value []byte) (string, error) {
+	if err := c.send(ctx, line, value); err != nil {
+		return "", err
+	}
+	return c.readResult(line[:strings.IndexByte(line, ' ')])
+}
+
+// send writes the command line, and the data block if it is not nil. The
+// context's deadline, if any, applies to the command and its reply. Otherwise,
+// writing the command and reading the reply each have their own timeout.
+func (c *conn) send(ctx context.Context, line string, data []byte) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if err := c.nc.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	c.bw.WriteString(line)
+	if data != nil {
+		c.bw.Write(data)
+		c.bw.WriteString("\r\n")
+	}
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+
+	if !hasDeadline {
+		return c.nc.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return nil
+}
+
+// readResult reads a single-line result, and returns it unless it is an error.
+func (c *conn) readResult(cmd string) (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	switch line {
+	case resultStored, resultNotStored, resultExists, resultNotFound, resultDeleted:
+		return line, nil
+	}
+	return "", fmt.Errorf("unexpected %s reply %q", cmd, line)
+}
+
+// readLine reads a line terminated by CRLF, without the terminator. Error
+// replies are returned as a serverError.
+func (c *conn) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed reply line %q", line)
+	}
+	line = line[:len(line)-2]
+
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR ") || strings.HasPrefix(line, "SERVER_ERROR ") {
+		return "", serverError(line)
+	}
+	return line, nil
+}
+
+// Close closes the network connection.
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+// dialer returns a function which dials addr.
+func dialer(addr string, timeout, readTimeout, writeTimeout time.Duration) func(ctx context.Context) (*conn, error) {
+	return func(ctx context.Context) (*conn, error) {
+		nc, err := connpool.Dial(ctx, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return newConn(nc, readTimeout, writeTimeout), nil
+	}
+}
@@ -0,0 +1,426 @@
+// Package memcachedstore defines a store which keeps its buckets in memcached,
+// so that many servers can share the same limits. It speaks the memcached text
+// protocol directly, using only the standard library.
+//
+// Each bucket is an item holding the same state as a memorystore fixed window
+// bucket. Updates are optimistic: the bucket is read with gets, and written
+// back with cas (or add, if it did not exist), and retried a limited number of
+// times if another client changed it in between, so every take is atomic
+// across all clients.
+//
+// Each item expires when its bucket's current window ends, since the bucket
+// would be refilled then anyway. As a result, a bucket configured with Set
+// returns to the store's default limit once it is idle for a whole window.
+// Memcached counts expiration in seconds, so items live for at least a second.
+//
+// Keys are spread across the servers by hashing, like most memcached clients.
+// Decisions are made with the clients' clocks, which should be synchronized.
+package memcachedstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/internal/connpool"
+	"github.com/sethvargo/go-limiter/internal/fixedwindow"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+const (
+	// maxKeyLength is the longest key memcached accepts.
+	maxKeyLength = 250
+
+	// maxPrefixLength is the longest key prefix, which leaves room for a hashed
+	// key.
+	maxPrefixLength = maxKeyLength - len(hashedKeyPrefix) - 2*sha256.Size
+
+	// hashedKeyPrefix marks keys which were hashed because they could not be
+	// used as they are.
+	hashedKeyPrefix = "sha256:"
+
+	// maxRelativeExptime is the largest expiration time which memcached treats
+	// as relative to now. Larger values are unix timestamps.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+type store struct {
+	fixedwindow.Store
+
+	prefix string
+
+	pools []*connpool.Pool[*conn]
+
+	stopped uint32
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Addrs are the host and port of each memcached server. Keys are assigned to
+	// servers by hashing, so changing the list moves most keys to a different
+	// server, which resets their buckets. The default value is
+	// ["127.0.0.1:11211"].
+	Addrs []string
+
+	// Tokens is the number of tokens to allow per interval. The default value is
+	// 1.
+	Tokens uint64
+
+	// Interval is the time interval upon which to enforce rate limiting. The
+	// default value is 1 second.
+	Interval time.Duration
+
+	// KeyPrefix is prepended to every key in memcached. Keys which are too long
+	// or contain spaces or control characters are hashed. The default value is
+	// "limiter:".
+	KeyPrefix string
+
+	// PoolSize is the maximum number of connections to each server. The default
+	// value is 10.
+	PoolSize int
+
+	// DialTimeout is the timeout for connecting to a server. The default value
+	// is 5 seconds.
+	DialTimeout time.Duration
+
+	// ReadTimeout and WriteTimeout are the timeouts for reading a reply and
+	// writing a command, for operations whose context has no deadline. If the
+	// context has a deadline, it applies instead. The default values are 3
+	// seconds.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxRetries is the number of times an update is retried when another client
+	// changes the bucket at the same time. Retries wait for a short, growing,
+	// random time. Once the retries run out, the operation returns an error. A
+	// negative value disables retries. The default value is 10.
+	MaxRetries int
+
+	// Clock is the source of the current time. The default value is the system
+	// clock.
+	Clock limiter.Clock
+}
+
+// New creates a memcached-backed rate limiter that uses the fixed window
+// algorithm. Connections are made lazily, so New does not fail if the servers
+// are unavailable.
+func New(c *Config) (limiter.Store, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	addrs := []string{"127.0.0.1:11211"}
+	if len(c.Addrs) > 0 {
+		addrs = c.Addrs
+	}
+
+	tokens := uint64(1)
+	if c.Tokens > 0 {
+		tokens = c.Tokens
+	}
+
+	interval := 1 * time.Second
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	prefix := "limiter:"
+	if c.KeyPrefix != "" {
+		prefix = c.KeyPrefix
+	}
+	if len(prefix) > maxPrefixLength || !validKey(prefix) {
+		return nil, fmt.Errorf("invalid key prefix %q", prefix)
+	}
+
+	poolSize := 10
+	if c.PoolSize > 0 {
+		poolSize = c.PoolSize
+	}
+
+	dialTimeout := 5 * time.Second
+	if c.DialTimeout > 0 {
+		dialTimeout = c.DialTimeout
+	}
+
+	readTimeout := 3 * time.Second
+	if c.ReadTimeout > 0 {
+		readTimeout = c.ReadTimeout
+	}
+
+	writeTimeout := 3 * time.Second
+	if c.WriteTimeout > 0 {
+		writeTimeout = c.WriteTimeout
+	}
+
+	maxRetries := 10
+	if c.MaxRetries > 0 {
+		maxRetries = c.MaxRetries
+	} else if c.MaxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	pools := make([]*connpool.Pool[*conn], 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == "" {
+			return nil, fmt.Errorf("server address cannot be empty")
+		}
+		pools = append(pools, connpool.New(poolSize, dialer(addr, dialTimeout, readTimeout, writeTimeout)))
+	}
+
+	s := &store{
+		prefix: prefix,
+
+		pools: pools,
+	}
+	s.Store = fixedwindow.Store{
+		Backend:    s,
+		Tokens:     tokens,
+		Interval:   interval,
+		MaxRetries: maxRetries,
+		Clock:      clock,
+	}
+	return s, nil
+}
+
+// Get retrieves the information about the key, if any exists.
+func (s *store) Get(ctx context.Context, key string) (tokens, remaining uint64, retErr error) {
+	k := s.itemKey(key)
+	retErr = s.withConn(ctx, k, func(c *conn) error {
+		value, _, exists, err := c.gets(ctx, k)
+		if err != nil || !exists {
+			return err
+		}
+
+		b, err := decode(value)
+		if err != nil {
+			return fmt.Errorf("bucket %q is invalid: %w", key, err)
+		}
+		tokens, remaining = b.MaxTokens, b.Available
+		return nil
+	})
+	return
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *store) Delete(ctx context.Context, key string) error {
+	k := s.itemKey(key)
+	return s.withConn(ctx, k, func(c *conn) error {
+		_, err := c.delete(ctx, k)
+		return err
+	})
+}
+
+// Close stops the store and closes the connections to the servers. It does not
+// delete any buckets.
+func (s *store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	for _, p := range s.pools {
+		p.Close()
+	}
+	return nil
+}
+
+// conn returns a connection to the server which owns the item key, and its
+// pool, unless the store is stopped.
+func (s *store) conn(ctx context.Context, k string) (*conn, *connpool.Pool[*conn], error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return nil, nil, limiter.ErrStopped
+	}
+
+	p := s.pools[0]
+	if len(s.pools) > 1 {
+		p = s.pools[crc32.ChecksumIEEE([]byte(k))%uint32(len(s.pools))]
+	}
+
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, p, nil
+}
+
+// withConn runs fn with a connection to the server which owns the item key.
+// The connection is closed instead of being reused if fn returns an error,
+// since it may be left in the middle of a reply.
+func (s *store) withConn(ctx context.Context, k string, fn func(c *conn) error) error {
+	c, p, err := s.conn(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	p.Put(c, err)
+	return err
+}
+
+// Load reads the bucket at key with gets. The connection is held until the
+// update ends.
+func (s *store) Load(ctx context.Context, key string) (fixedwindow.Bucket, bool, fixedwindow.Txn, error) {
+	k := s.itemKey(key)
+	c, p, err := s.conn(ctx, k)
+	if err != nil {
+		return fixedwindow.Bucket{}, false, nil, err
+	}
+
+	var b fixedwindow.Bucket
+	value, unique, exists, err := c.gets(ctx, k)
+	if err == nil && exists {
+		if b, err = decode(value); err != nil {
+			err = fmt.Errorf("bucket %q is invalid: %w", key, err)
+		}
+	}
+	if err != nil {
+		p.Put(c, err)
+		return fixedwindow.Bucket{}, false, nil, err
+	}
+
+	return b, exists, &txn{conn: c, pool: p, key: k, unique: unique, exists: exists}, nil
+}
+
+// txn is an update of a bucket which was read with gets.
+type txn struct {
+	conn *conn
+	pool *connpool.Pool[*conn]
+	key  string
+
+	// unique is the CAS unique of the bucket, if it exists.
+	unique uint64
+	exists bool
+}
+
+// CompareAndStore writes the bucket with cas, or add if it did not exist, which
+// write nothing if another client changed, created, or deleted the bucket since
+// it was read.
+func (t *txn) CompareAndStore(ctx context.Context, b fixedwindow.Bucket, now uint64) error {
+	value := encode(b)
+	exptime := expiration(b, now)
+
+	var result string
+	var err error
+	if t.exists {
+		result, err = t.conn.cas(ctx, t.key, exptime, value, t.unique)
+	} else {
+		result, err = t.conn.add(ctx, t.key, exptime, value)
+	}
+	t.pool.Put(t.conn, err)
+	if err != nil {
+		return err
+	}
+
+	if result != resultStored {
+		return fixedwindow.ErrConflict
+	}
+	return nil
+}
+
+// Abort returns the connection to the pool.
+func (t *txn) Abort(_ context.Context) error {
+	t.pool.Put(t.conn, nil)
+	return nil
+}
+
+// itemKey returns the memcached key for the bucket key. Keys which memcached
+// would reject are replaced by their hash.
+func (s *store) itemKey(key string) string {
+	if k := s.prefix + key; len(k) <= maxKeyLength && validKey(key) {
+		return k
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return s.prefix + hashedKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// validKey reports whether the key has no spaces or control characters.
+func validKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiration returns the memcached expiration time for the bucket, which is
+// the end of its current window, rounded up to whole seconds.
+func expiration(b fixedwindow.Bucket, now uint64) int64 {
+	ttl := uint64(b.Interval)
+	if end := b.StartTime + (b.LastTick+1)*uint64(b.Interval); end > now {
+		ttl = end - now
+	}
+
+	secs := (ttl + uint64(time.Second) - 1) / uint64(time.Second)
+	if secs <= maxRelativeExptime {
+		return int64(secs)
+	}
+
+	// Longer expiration times must be absolute.
+	return int64((now + ttl + uint64(time.Second) - 1) / uint64(time.Second))
+}
+
+// encode returns the bucket as a value, which is its fields in decimal
+// separated by spaces.
+func encode(b fixedwindow.Bucket) []byte {
+	buf := make([]byte, 0, 64)
+	buf = strconv.AppendUint(buf, b.MaxTokens, 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(b.Interval), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, b.StartTime, 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, b.LastTick, 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, b.Available, 10)
+	return buf
+}
+
+// decode parses a value written by encode.
+func decode(value []byte) (fixedwindow.Bucket, error) {
+	fields := strings.Fields(string(value))
+	if len(fields) != 5 {
+		return fixedwindow.Bucket{}, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	interval, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || interval <= 0 {
+		return fixedwindow.Bucket{}, fmt.Errorf("invalid interval %q", fields[1])
+	}
+
+	var nums [5]uint64
+	for i, f := range fields {
+		if i == 1 {
+			continue
+		}
+		if nums[i], err = strconv.ParseUint(f, 10, 64); err != nil {
+			return fixedwindow.Bucket{}, fmt.Errorf("invalid field: %w", err)
+		}
+	}
+
+	return fixedwindow.Bucket{
+		MaxTokens: nums[0],
+		Interval:  time.Duration(interval),
+		StartTime: nums[2],
+		LastTick:  nums[3],
+		Available: nums[4],
+	}, nil
+}
@@ -0,0 +1,383 @@
+package memcachedstore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/internal/fakememcached"
+	"github.com/sethvargo/go-limiter/internal/fixedwindow"
+	"github.com/sethvargo/go-limiter/limitertest"
+)
+
+// startServer starts a fake memcached server, and stops it when the test
+// finishes.
+func startServer(t testing.TB) *fakememcached.Server {
+	t.Helper()
+
+	srv, err := fakememcached.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv
+}
+
+// newStore creates a store, and closes it when the test finishes.
+func newStore(t testing.TB, c *Config) limiter.Store {
+	t.Helper()
+
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return s
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		c    *Config
+	}{
+		{
+			name: "prefix_space",
+			c:    &Config{KeyPrefix: "my limiter:"},
+		},
+		{
+			name: "prefix_too_long",
+			c:    &Config{KeyPrefix: strings.Repeat("a", maxPrefixLength+1)},
+		},
+		{
+			name: "empty_addr",
+			c:    &Config{Addrs: []string{"127.0.0.1:11211", ""}},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := New(tc.c); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestStore_expiration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t)
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+
+	s := newStore(t, &Config{
+		Addrs:     []string{srv.Addr()},
+		Interval:  time.Minute,
+		KeyPrefix: "test:",
+		Clock:     clock,
+	})
+
+	// The item expires when the window ends.
+	clock.Advance(20 * time.Second)
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Second)
+	if err := s.(limiter.StoreWithRefund).Refund(ctx, "key", 1, clock.Now()+uint64(45*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, ok := srv.TTL("test:key")
+	if !ok {
+		t.Fatal("expected item to exist")
+	}
+	if ttl <= 44*time.Second || ttl > 45*time.Second {
+		t.Errorf("expected TTL of 45s, got %s", ttl)
+	}
+
+	// Sub-second intervals live for a second.
+	if err := s.Set(ctx, "short", 1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := srv.TTL("test:short"); !ok || ttl <= 0 || ttl > time.Second {
+		t.Errorf("expected TTL of 1s, got %s, %t", ttl, ok)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	t.Parallel()
+
+	now := uint64(time.Unix(1700000000, 0).UnixNano())
+	day := 24 * time.Hour
+
+	cases := []struct {
+		name string
+		b    fixedwindow.Bucket
+		want int64
+	}{
+		{
+			name: "window",
+			b:    fixedwindow.Bucket{StartTime: now - uint64(10*time.Second), Interval: time.Minute},
+			want: 50,
+		},
+		{
+			name: "rounded_up",
+			b:    fixedwindow.Bucket{StartTime: now - uint64(10*time.Second+time.Millisecond), Interval: time.Minute},
+			want: 50,
+		},
+		{
+			name: "ended",
+			b:    fixedwindow.Bucket{StartTime: now - uint64(2*time.Minute), Interval: time.Minute},
+			want: 60,
+		},
+		{
+			name: "absolute",
+			b:    fixedwindow.Bucket{StartTime: now, Interval: 31 * day},
+			want: 1700000000 + int64((31*day)/time.Second),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := expiration(tc.b, now), tc.want; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_keys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t)
+
+	s := newStore(t, &Config{
+		Addrs:    []string{srv.Addr()},
+		Tokens:   1,
+		Interval: time.Hour,
+	})
+
+	// Keys which memcached would reject are hashed, and stay distinct.
+	keys := []string{
+		"plain",
+		"with space",
+		"with\nnewline",
+		strings.Repeat("a", 300),
+		strings.Repeat("a", 301),
+	}
+	for _, key := range keys {
+		if _, _, _, ok, err := s.Take(ctx, key); err != nil {
+			t.Fatalf("%q: %s", key, err)
+		} else if !ok {
+			t.Errorf("%q: expected take to succeed", key)
+		}
+	}
+
+	if got, want := srv.Keys(), len(keys); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_servers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srvs := []*fakememcached.Server{startServer(t), startServer(t)}
+
+	s := newStore(t, &Config{
+		Addrs:    []string{srvs[0].Addr(), srvs[1].Addr()},
+		Tokens:   1,
+		Interval: time.Hour,
+	})
+
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		if _, _, _, ok, err := s.Take(ctx, key); err != nil || !ok {
+			t.Fatalf("%s: expected take to succeed, got %t, %v", key, ok, err)
+		}
+		if _, _, _, ok, err := s.Take(ctx, key); err != nil || ok {
+			t.Fatalf("%s: expected take to be rejected, got %t, %v", key, ok, err)
+		}
+	}
+
+	// The keys are spread across both servers.
+	for i, srv := range srvs {
+		if got := srv.Keys(); got == 0 || got == 50 {
+			t.Errorf("server %d: expected some keys, got %d", i, got)
+		}
+	}
+}
+
+func TestStore_unavailable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t)
+
+	s := newStore(t, &Config{
+		Addrs:       []string{srv.Addr()},
+		DialTimeout: time.Second,
+	})
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the server is gone, every operation fails instead of hanging, and
+	// the broken connection is not reused.
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+	}
+}
+
+func TestStore_readTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// The server accepts connections, but never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	s := newStore(t, &Config{
+		Addrs:       []string{ln.Addr().String()},
+		ReadTimeout: 50 * time.Millisecond,
+	})
+
+	// Without a deadline on the context, the read timeout applies.
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestStore_maxRetries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t)
+
+	s := newStore(t, &Config{
+		Addrs:      []string{srv.Addr()},
+		MaxRetries: 2,
+	})
+
+	// An update which keeps conflicting gives up instead of retrying forever.
+	srv.Conflict(true)
+	if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+
+	srv.Conflict(false)
+	if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+		t.Errorf("expected take to succeed, got %t, %v", ok, err)
+	}
+}
+
+func TestStore_invalidBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t)
+
+	s := newStore(t, &Config{
+		Addrs: []string{srv.Addr()},
+	})
+
+	c, err := s.(*store).pools[0].Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := c.add(ctx, "limiter:key", 0, []byte("10 nope 0 0 10")); err != nil {
+		t.Fatal(err)
+	} else if result != resultStored {
+		t.Fatalf("expected %q to be %q", result, resultStored)
+	}
+	s.(*store).pools[0].Put(c, nil)
+
+	if _, _, err := s.Get(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+	if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	srv := startServer(t)
+
+	var lock sync.Mutex
+	var n int
+
+	// Every group of stores needs its own keys.
+	newStores := func(count int) []limiter.Store {
+		lock.Lock()
+		n++
+		prefix := "conformance:" + strconv.Itoa(n) + ":"
+		lock.Unlock()
+
+		stores := make([]limiter.Store, count)
+		for i := range stores {
+			s, err := New(&Config{
+				Addrs:     []string{srv.Addr()},
+				Tokens:    10,
+				Interval:  time.Hour,
+				KeyPrefix: prefix,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores[i] = s
+		}
+		return stores
+	}
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		return newStores(1)[0]
+	})
+	limitertest.RunSharedStoreTests(t, newStores)
+}
@@ -0,0 +1,230 @@
+package memorystore
+
+import (
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxAtomicTokens is the largest number of tokens an atomicBucket can hold,
+	// since the tokens are packed into the low 32 bits of the state.
+	maxAtomicTokens = math.MaxUint32
+
+	// maxAtomicTick is the largest tick an atomicWindow can represent. Ticks at
+	// or beyond it require the window to be rebased.
+	maxAtomicTick = math.MaxUint32 - 1
+
+	// sealedState marks an atomicWindow which is being replaced. Its tick is one
+	// more than maxAtomicTick, so it is never a valid state.
+	sealedState = math.MaxUint64
+)
+
+var _ taker = (*atomicBucket)(nil)
+
+// atomicBucket is a lock-free implementation of the fixed window algorithm,
+// with the same semantics as bucket. The last tick and available tokens are
+// packed into a single word, which is updated with compare-and-swap, so takes
+// never block one another.
+//
+// Since the start time and the tick offset cannot change without also changing
+// the state, they live in an immutable window alongside it. When the clock is
+// rewound, or the tick no longer fits in 32 bits, the window is sealed and
+// replaced with a new one which carries over the tokens.
+type atomicBucket struct {
+	// maxTokens is the maximum number of tokens permitted on the bucket at any
+	// time, except after a burst.
+	maxTokens uint64
+
+	// interval is the time at which ticking should occur.
+	interval time.Duration
+
+	// window is the current window.
+	window atomic.Pointer[atomicWindow]
+}
+
+// atomicWindow is a start time, tick offset, and the packed state relative to
+// them.
+type atomicWindow struct {
+	// state is the last tick, relative to tickOffset, in the high 32 bits and the
+	// available tokens in the low 32 bits, or sealedState.
+	state uint64
+
+	// startTime is the number of nanoseconds from unix epoch when the bucket was
+	// created, or when the clock was last rewound. Ticks are counted from it.
+	startTime uint64
+
+	// tickOffset is the number of ticks between startTime and the tick stored in
+	// state as 0.
+	tickOffset uint64
+}
+
+// newAtomicBucket creates a new lock-free bucket from the given tokens and
+// interval. Tokens beyond maxAtomicTokens are discarded.
+func newAtomicBucket(now, tokens uint64, interval time.Duration) *atomicBucket {
+	tokens = min(tokens, maxAtomicTokens)
+
+	b := &atomicBucket{
+		maxTokens: tokens,
+		interval:  interval,
+	}
+	b.window.Store(&atomicWindow{
+		state:     packState(0, tokens),
+		startTime: now,
+	})
+	return b
+}
+
+// load returns the current window and its state, waiting for any in-progress
+// rebase to finish.
+func (b *atomicBucket) load() (*atomicWindow, uint64) {
+	for {
+		w := b.window.Load()
+		if state := atomic.LoadUint64(&w.state); state != sealedState {
+			return w, state
+		}
+		runtime.Gosched()
+	}
+}
+
+// get returns information about the bucket.
+func (b *atomicBucket) get(_ uint64) (tokens uint64, remaining uint64, retErr error) {
+	_, state := b.load()
+	_, remaining = unpackState(state)
+	return b.maxTokens, remaining, nil
+}
+
+// take attempts to remove n tokens from the bucket, with the same semantics as
+// bucket.take.
+func (b *atomicBucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
+	for {
+		w, state := b.load()
+
+		// If the current time is before the start time, it means the server clock
+		// was reset to an earlier time. In that case, rebase to 0.
+		if now < w.startTime {
+			b.rebase(w, now)
+			continue
+		}
+
+		currTick := tick(w.startTime, now, b.interval)
+
+		lastTick, available := unpackState(state)
+		lastTick += w.tickOffset
+
+		// If we're on a new tick since last assessment, perform a full reset up to
+		// maxTokens. If the new tick does not fit in the state, move the window
+		// forward first.
+		if lastTick < currTick {
+			if currTick-w.tickOffset > maxAtomicTick {
+				b.rebase(w, now)
+				continue
+			}
+			lastTick = currTick
+			available = b.maxTokens
+		}
+
+		ok = available >= n
+		if ok {
+			available -= n
+		}
+
+		next := packState(lastTick-w.tickOffset, available)
+		if next == state || atomic.CompareAndSwapUint64(&w.state, state, next) {
+			reset = w.startTime + ((currTick + 1) * uint64(b.interval))
+			return b.maxTokens, available, reset, ok, nil
+		}
+	}
+}
+
+// burst adds the specified number of tokens to the bucket's available tokens.
+// The available tokens saturate at maxAtomicTokens.
+func (b *atomicBucket) burst(_, tokens uint64) {
+	for {
+		w, state := b.load()
+		lastTick, available := unpackState(state)
+
+		next := packState(lastTick, min(available+min(tokens, maxAtomicTokens), maxAtomicTokens))
+		if atomic.CompareAndSwapUint64(&w.state, state, next) {
+			return
+		}
+	}
+}
+
+// refund returns tokens to the bucket's available tokens, but only if the
+// bucket is still in the tick which ends at reset.
+func (b *atomicBucket) refund(now, tokens, reset uint64) {
+	if now >= reset {
+		return
+	}
+
+	for {
+		w, state := b.load()
+		lastTick, available := unpackState(state)
+
+		if w.startTime+((w.tickOffset+lastTick+1)*uint64(b.interval)) != reset {
+			return
+		}
+
+		next := packState(lastTick, min(available+min(tokens, maxAtomicTokens), maxAtomicTokens))
+		if atomic.CompareAndSwapUint64(&w.state, state, next) {
+			return
+		}
+	}
+}
+
+// lastTime returns the start of the last tick in which the bucket was used.
+func (b *atomicBucket) lastTime() uint64 {
+	w, state := b.load()
+	lastTick, _ := unpackState(state)
+	return w.startTime + ((w.tickOffset + lastTick) * uint64(b.interval))
+}
+
+// rebase seals the window and replaces it with one whose tick offset is the
+// current tick or, if the clock was rewound, one which starts at now. If another
+// goroutine is already replacing the window, rebase returns immediately and the
+// caller should retry.
+func (b *atomicBucket) rebase(w *atomicWindow, now uint64) {
+	var state uint64
+	for {
+		state = atomic.LoadUint64(&w.state)
+		if state == sealedState {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&w.state, state, sealedState) {
+			break
+		}
+	}
+
+	lastTick, available := unpackState(state)
+
+	// If the clock was rewound, rebase to 0, keeping the available tokens.
+	next := &atomicWindow{
+		state:     packState(0, available),
+		startTime: now,
+	}
+	if now >= w.startTime {
+		// Otherwise, the tick no longer fits. The last tick always fits, so the
+		// current tick is later, and the bucket is refilled just as bucket.take
+		// would do.
+		next.startTime = w.startTime
+		next.tickOffset = tick(w.startTime, now, b.interval)
+		if next.tickOffset > w.tickOffset+lastTick {
+			available = b.maxTokens
+		}
+		next.state = packState(0, available)
+	}
+
+	b.window.Store(next)
+}
+
+// packState packs the tick and available tokens into a single word.
+func packState(tick, available uint64) uint64 {
+	return tick<<32 | available
+}
+
+// unpackState is the inverse of packState.
+func unpackState(state uint64) (tick, available uint64) {
+	return state >> 32, state & math.MaxUint32
+}
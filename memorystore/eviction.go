@@ -0,0 +1,209 @@
+package memorystore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// Eviction is the policy used to choose which key to evict when the store holds
+// MaxKeys keys.
+type Eviction uint8
+
+const (
+	// EvictionLRU evicts the least recently used key. It is exact within a
+	// shard, but every take for an existing key briefly takes a per-shard lock
+	// to record the use.
+	EvictionLRU Eviction = iota
+
+	// EvictionCLOCK approximates LRU with the CLOCK algorithm: each key has a
+	// reference bit which is set when it is used, and a hand sweeps the keys,
+	// clearing bits until it finds a key which has not been used since the hand
+	// last passed. Recording a use is a single atomic store, so takes for
+	// existing keys never contend.
+	EvictionCLOCK
+)
+
+// Stats are counters describing the store's keys.
+type Stats struct {
+	// Keys is the number of keys currently in the store.
+	Keys uint64
+
+	// Evictions is the number of keys which have been evicted to make room for
+	// new keys because the store was full.
+	Evictions uint64
+
+	// Rejections is the number of takes for new keys which were rejected because
+	// the store was full and RejectNewKeys was set.
+	Rejections uint64
+}
+
+// StoreWithStats is implemented by the stores returned by New. Callers can
+// type-assert a limiter.Store to this interface to monitor eviction.
+type StoreWithStats interface {
+	limiter.Store
+
+	// Stats returns the current counters.
+	Stats() Stats
+}
+
+// evictor tracks the keys in a shard to choose which to evict. add, remove,
+// victim, and reset are called with the shard's write lock held. touch is
+// called with the shard's read lock held, so it must be safe for concurrent
+// use.
+type evictor interface {
+	add(key string)
+	touch(key string)
+	remove(key string)
+	victim() (string, bool)
+	reset()
+}
+
+// newEvictor creates an evictor for the policy.
+func newEvictor(e Eviction) evictor {
+	switch e {
+	case EvictionCLOCK:
+		return newClockEvictor()
+	default:
+		return newLRUEvictor()
+	}
+}
+
+// lruEvictor evicts the least recently used key. The front of the list is the
+// most recently used key.
+type lruEvictor struct {
+	elems map[string]*list.Element
+	order *list.List
+
+	// lock guards order, since touch is called concurrently. elems is only
+	// modified with the shard's write lock held.
+	lock sync.Mutex
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{
+		elems: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (e *lruEvictor) add(key string) {
+	e.lock.Lock()
+	e.elems[key] = e.order.PushFront(key)
+	e.lock.Unlock()
+}
+
+func (e *lruEvictor) touch(key string) {
+	elem, ok := e.elems[key]
+	if !ok {
+		return
+	}
+
+	e.lock.Lock()
+	e.order.MoveToFront(elem)
+	e.lock.Unlock()
+}
+
+func (e *lruEvictor) remove(key string) {
+	elem, ok := e.elems[key]
+	if !ok {
+		return
+	}
+
+	e.lock.Lock()
+	e.order.Remove(elem)
+	e.lock.Unlock()
+	delete(e.elems, key)
+}
+
+func (e *lruEvictor) victim() (string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	elem := e.order.Back()
+	if elem == nil {
+		return "", false
+	}
+	return elem.Value.(string), true
+}
+
+func (e *lruEvictor) reset() {
+	e.lock.Lock()
+	e.elems = make(map[string]*list.Element)
+	e.order.Init()
+	e.lock.Unlock()
+}
+
+// clockEvictor evicts keys with the CLOCK algorithm. The keys are kept in a
+// ring, and removing a key moves the last key into its slot.
+type clockEvictor struct {
+	index map[string]int
+	ring  []*clockEntry
+	hand  int
+}
+
+// clockEntry is a key in the ring.
+type clockEntry struct {
+	key        string
+	referenced uint32
+}
+
+func newClockEvictor() *clockEvictor {
+	return &clockEvictor{
+		index: make(map[string]int),
+	}
+}
+
+func (e *clockEvictor) add(key string) {
+	e.index[key] = len(e.ring)
+	e.ring = append(e.ring, &clockEntry{key: key})
+}
+
+func (e *clockEvictor) touch(key string) {
+	if i, ok := e.index[key]; ok {
+		atomic.StoreUint32(&e.ring[i].referenced, 1)
+	}
+}
+
+func (e *clockEvictor) remove(key string) {
+	i, ok := e.index[key]
+	if !ok {
+		return
+	}
+	delete(e.index, key)
+
+	last := len(e.ring) - 1
+	if i != last {
+		e.ring[i] = e.ring[last]
+		e.index[e.ring[i].key] = i
+	}
+	e.ring[last] = nil
+	e.ring = e.ring[:last]
+}
+
+func (e *clockEvictor) victim() (string, bool) {
+	if len(e.ring) == 0 {
+		return "", false
+	}
+
+	// Every pass clears a reference bit, so this ends within two laps.
+	for {
+		if e.hand >= len(e.ring) {
+			e.hand = 0
+		}
+
+		entry := e.ring[e.hand]
+		e.hand++
+		if atomic.SwapUint32(&entry.referenced, 0) == 0 {
+			return entry.key, true
+		}
+	}
+}
+
+func (e *clockEvictor) reset() {
+	e.index = make(map[string]int)
+	e.ring = nil
+	e.hand = 0
+}
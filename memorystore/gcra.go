@@ -0,0 +1,159 @@
+package memorystore
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// gcraBucket is the generic cell rate algorithm implementation of a taker. It
+// stores a single "theoretical arrival time" (TAT): the time at which the
+// bucket would be full again if no more tokens were taken. Each token pushes
+// the TAT forward by the emission interval, and a take is permitted as long as
+// the TAT stays within one interval of the current time.
+type gcraBucket struct {
+	// startTime is the number of nanoseconds from unix epoch when this bucket was
+	// initially created.
+	startTime uint64
+
+	// maxTokens is the maximum number of tokens permitted on the bucket at any
+	// time, excluding burst tokens.
+	maxTokens uint64
+
+	// interval is the time it takes for an empty bucket to refill completely.
+	interval time.Duration
+
+	// emission is the number of nanoseconds between each token, which is the
+	// interval divided by the number of tokens.
+	emission uint64
+
+	// tat is the theoretical arrival time, in nanoseconds from unix epoch.
+	tat uint64
+
+	// burstTokens is the number of additional tokens available until
+	// burstExpiry. Burst tokens are taken before regular tokens.
+	burstTokens uint64
+	burstExpiry uint64
+
+	// lock guards the mutable fields.
+	lock sync.RWMutex
+}
+
+// newGCRABucket creates a new GCRA bucket from the given tokens and interval.
+func newGCRABucket(now, tokens uint64, interval time.Duration) *gcraBucket {
+	// A bucket with no tokens never permits a take, so make each token cost more
+	// than the interval. Otherwise, make sure the emission interval is never zero
+	// for very high rates.
+	emission := uint64(interval) + 1
+	if tokens > 0 {
+		emission = max(uint64(interval)/tokens, 1)
+	}
+
+	return &gcraBucket{
+		startTime: now,
+		maxTokens: tokens,
+		interval:  interval,
+		emission:  emission,
+		tat:       now,
+	}
+}
+
+// remaining returns the number of regular tokens available at now for the
+// given TAT. The caller must ensure tat is not before now.
+func (b *gcraBucket) remaining(now, tat uint64) uint64 {
+	if tat > now+uint64(b.interval) {
+		return 0
+	}
+	return (now + uint64(b.interval) - tat) / b.emission
+}
+
+// burstRemaining returns the number of burst tokens available at now.
+func (b *gcraBucket) burstRemaining(now uint64) uint64 {
+	if now >= b.burstExpiry {
+		return 0
+	}
+	return b.burstTokens
+}
+
+// get returns information about the bucket.
+func (b *gcraBucket) get(now uint64) (tokens uint64, remaining uint64, retErr error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	tokens = b.maxTokens
+	remaining = addSaturating(b.remaining(now, max(b.tat, now)), b.burstRemaining(now))
+	return
+}
+
+// take attempts to remove n tokens from the bucket. It returns the limit,
+// remaining tokens, the time at which the next token becomes available, and
+// whether the take was successful. When the take is unsuccessful, reset is
+// exactly when a single token can next be taken.
+func (b *gcraBucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	interval := uint64(b.interval)
+
+	// If the server clock was reset to an earlier time, the TAT may be further
+	// than one interval away. In that case, treat the bucket as empty rather than
+	// blocking until the clock catches up.
+	if b.tat > now+interval {
+		b.tat = now + interval
+	}
+
+	tat := max(b.tat, now)
+	burst := b.burstRemaining(now)
+	tokens = b.maxTokens
+
+	// Burst tokens are used first, and only the rest advance the TAT.
+	need := n - min(n, burst)
+	hi, cost := bits.Mul64(need, b.emission)
+	if newTat, carry := bits.Add64(tat, cost, 0); hi == 0 && carry == 0 && newTat <= now+interval {
+		b.tat = newTat
+		b.burstTokens = burst - (n - need)
+		tat = newTat
+		burst = b.burstTokens
+		ok = true
+	}
+
+	regular := b.remaining(now, tat)
+	remaining = addSaturating(regular, burst)
+	reset = tat + ((regular + 1) * b.emission) - interval
+	return
+}
+
+// burst adds the specified number of tokens to the bucket for one interval. The
+// bucket may exceed maxTokens until then.
+func (b *gcraBucket) burst(now, tokens uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.burstTokens = addSaturating(b.burstRemaining(now), tokens)
+	b.burstExpiry = now + uint64(b.interval)
+}
+
+// refund returns tokens to the bucket by moving the TAT backwards. Tokens which
+// would have been replenished by now are not refunded.
+func (b *gcraBucket) refund(now, tokens, _ uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.tat <= now {
+		return
+	}
+
+	hi, credit := bits.Mul64(tokens, b.emission)
+	if hi != 0 || credit > b.tat-now {
+		credit = b.tat - now
+	}
+	b.tat -= credit
+}
+
+// lastTime returns the TAT, which is the time at which the bucket is full.
+func (b *gcraBucket) lastTime() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return max(b.tat, b.startTime)
+}
@@ -0,0 +1,170 @@
+package memorystore
+
+import (
+	"sync"
+	"time"
+)
+
+// slidingLogBucket is the sliding log implementation of a taker. It records the
+// time of every take in the trailing interval, so it never permits more than
+// maxTokens takes in any window of the interval's length.
+type slidingLogBucket struct {
+	// startTime is the number of nanoseconds from unix epoch when this bucket was
+	// initially created.
+	startTime uint64
+
+	// maxTokens is the maximum number of tokens permitted in any trailing
+	// interval, excluding burst tokens.
+	maxTokens uint64
+
+	// interval is the size of the sliding window.
+	interval time.Duration
+
+	// entries is the log of takes in the trailing interval, oldest first.
+	entries []logEntry
+
+	// count is the sum of the tokens in entries.
+	count uint64
+
+	// burstTokens is the number of additional tokens available until
+	// burstExpiry.
+	burstTokens uint64
+	burstExpiry uint64
+
+	// lock guards the mutable fields.
+	lock sync.RWMutex
+}
+
+// logEntry is a single take in a slidingLogBucket. Weighted takes are recorded
+// as one entry.
+type logEntry struct {
+	time   uint64
+	tokens uint64
+}
+
+// newSlidingLogBucket creates a new sliding log bucket from the given tokens and
+// interval.
+func newSlidingLogBucket(now, tokens uint64, interval time.Duration) *slidingLogBucket {
+	return &slidingLogBucket{
+		startTime: now,
+		maxTokens: tokens,
+		interval:  interval,
+	}
+}
+
+// expired returns the number of entries which are no longer in the trailing
+// interval ending at now, and the number of tokens they hold.
+func (b *slidingLogBucket) expired(now uint64) (int, uint64) {
+	var i int
+	var tokens uint64
+	for ; i < len(b.entries); i++ {
+		if b.entries[i].time+uint64(b.interval) > now {
+			break
+		}
+		tokens += b.entries[i].tokens
+	}
+	return i, tokens
+}
+
+// available returns the number of tokens which can be taken given the number
+// of tokens taken in the trailing interval.
+func (b *slidingLogBucket) available(now, used uint64) uint64 {
+	capacity := b.maxTokens
+	if now < b.burstExpiry {
+		capacity = addSaturating(capacity, b.burstTokens)
+	}
+	if used >= capacity {
+		return 0
+	}
+	return capacity - used
+}
+
+// get returns information about the bucket.
+func (b *slidingLogBucket) get(now uint64) (tokens uint64, remaining uint64, retErr error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, expired := b.expired(now)
+
+	tokens = b.maxTokens
+	remaining = b.available(now, b.count-expired)
+	return
+}
+
+// take attempts to remove n tokens from the bucket. It returns the limit,
+// remaining tokens, the time when the oldest take in the log expires, and
+// whether the take was successful.
+func (b *slidingLogBucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	i, expired := b.expired(now)
+	b.entries = b.entries[i:]
+	b.count -= expired
+
+	tokens = b.maxTokens
+	remaining = b.available(now, b.count)
+
+	if remaining >= n {
+		if n > 0 {
+			b.entries = append(b.entries, logEntry{time: now, tokens: n})
+			b.count = addSaturating(b.count, n)
+		}
+		remaining -= n
+		ok = true
+	}
+
+	reset = now
+	if len(b.entries) > 0 {
+		reset = b.entries[0].time + uint64(b.interval)
+	}
+	return
+}
+
+// burst adds the specified number of tokens to the bucket for one interval.
+func (b *slidingLogBucket) burst(now, tokens uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now >= b.burstExpiry {
+		b.burstTokens = 0
+	}
+	b.burstTokens = addSaturating(b.burstTokens, tokens)
+	b.burstExpiry = now + uint64(b.interval)
+}
+
+// refund removes the most recent takes from the log, as long as the oldest take
+// at the time of the refunded take has not expired.
+func (b *slidingLogBucket) refund(now, tokens, reset uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now >= reset {
+		return
+	}
+
+	for tokens > 0 && len(b.entries) > 0 {
+		last := &b.entries[len(b.entries)-1]
+		if last.tokens > tokens {
+			last.tokens -= tokens
+			b.count -= tokens
+			return
+		}
+
+		tokens -= last.tokens
+		b.count -= last.tokens
+		b.entries = b.entries[:len(b.entries)-1]
+	}
+}
+
+// lastTime returns the time of the most recent take, or the creation time if
+// there are no takes in the log.
+func (b *slidingLogBucket) lastTime() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if len(b.entries) == 0 {
+		return b.startTime
+	}
+	return b.entries[len(b.entries)-1].time
+}
@@ -0,0 +1,233 @@
+package memorystore
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// slidingWindowBucket is the sliding window counter implementation of a taker.
+// It keeps the number of tokens taken in the current and previous fixed
+// windows, and estimates the number of tokens taken in the trailing interval by
+// assuming the previous window's takes were evenly distributed.
+type slidingWindowBucket struct {
+	// startTime is the number of nanoseconds from unix epoch when this bucket was
+	// initially created. Windows are aligned to this time.
+	startTime uint64
+
+	// maxTokens is the maximum number of tokens permitted in any trailing
+	// interval, excluding burst tokens.
+	maxTokens uint64
+
+	// interval is the size of the sliding window.
+	interval time.Duration
+
+	// lastTick is the window in which the counts were last updated.
+	lastTick uint64
+
+	// prevCount and currCount are the number of tokens taken in the previous and
+	// current windows respectively.
+	prevCount uint64
+	currCount uint64
+
+	// burstTokens is the number of additional tokens available until the end of
+	// the current window.
+	burstTokens uint64
+
+	// lock guards the mutable fields.
+	lock sync.RWMutex
+}
+
+// newSlidingWindowBucket creates a new sliding window counter bucket from the
+// given tokens and interval.
+func newSlidingWindowBucket(now, tokens uint64, interval time.Duration) *slidingWindowBucket {
+	return &slidingWindowBucket{
+		startTime: now,
+		maxTokens: tokens,
+		interval:  interval,
+	}
+}
+
+// slidingWindowState is a point-in-time view of a slidingWindowBucket, advanced
+// to the window containing "now".
+type slidingWindowState struct {
+	tick        uint64
+	elapsed     uint64
+	prevCount   uint64
+	currCount   uint64
+	burstTokens uint64
+}
+
+// state computes the bucket's state at the given time without modifying the
+// bucket. The caller must hold the lock. If now is before the start time, the
+// clock was reset, and the state is computed as of the start of the last
+// window.
+func (b *slidingWindowBucket) state(now uint64) slidingWindowState {
+	st := slidingWindowState{
+		tick:        b.lastTick,
+		prevCount:   b.prevCount,
+		currCount:   b.currCount,
+		burstTokens: b.burstTokens,
+	}
+
+	if now < b.startTime {
+		return st
+	}
+
+	st.tick = tick(b.startTime, now, b.interval)
+	st.elapsed = now - b.startTime - st.tick*uint64(b.interval)
+
+	switch {
+	case st.tick == b.lastTick:
+	case st.tick == b.lastTick+1:
+		st.prevCount, st.currCount, st.burstTokens = b.currCount, 0, 0
+	default:
+		st.prevCount, st.currCount, st.burstTokens = 0, 0, 0
+	}
+	return st
+}
+
+// used returns the estimated number of tokens taken in the trailing interval.
+func (b *slidingWindowBucket) used(st slidingWindowState) uint64 {
+	return addSaturating(weight(st.prevCount, uint64(b.interval)-st.elapsed, uint64(b.interval)), st.currCount)
+}
+
+// available returns the number of tokens which can be taken at the given state.
+func (b *slidingWindowBucket) available(st slidingWindowState) uint64 {
+	capacity := addSaturating(b.maxTokens, st.burstTokens)
+	used := b.used(st)
+	if used >= capacity {
+		return 0
+	}
+	return capacity - used
+}
+
+// nextToken returns the time at which the estimated number of tokens taken in
+// the trailing interval next decreases, freeing up a token.
+func (b *slidingWindowBucket) nextToken(now uint64, st slidingWindowState) uint64 {
+	interval := uint64(b.interval)
+	windowStart := b.startTime + st.tick*interval
+
+	// While the previous window's takes are decaying, a token frees up when the
+	// weighted count drops to the next whole number.
+	if c := weight(st.prevCount, interval-st.elapsed, interval); c > 0 {
+		return windowStart + interval - mulDiv(c-1, interval, st.prevCount)
+	}
+
+	// Otherwise, the current window's takes start decaying once it becomes the
+	// previous window.
+	if st.currCount > 0 {
+		return windowStart + interval + interval - mulDiv(st.currCount-1, interval, st.currCount)
+	}
+
+	return now
+}
+
+// get returns information about the bucket.
+func (b *slidingWindowBucket) get(now uint64) (tokens uint64, remaining uint64, retErr error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	tokens = b.maxTokens
+	remaining = b.available(b.state(now))
+	return
+}
+
+// take attempts to remove n tokens from the bucket. It returns the limit,
+// remaining tokens, reset time, and whether the take was successful. If the
+// take is successful, the reset time is the end of the current window. If it is
+// unsuccessful, the reset time is when the next token will be available, which
+// may be more than one interval away.
+func (b *slidingWindowBucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// If the current time is before the start time, it means the server clock was
+	// reset to an earlier time. In that case, rebase to 0.
+	if now < b.startTime {
+		b.startTime = now
+		b.lastTick = 0
+	}
+
+	st := b.state(now)
+	b.lastTick, b.prevCount, b.currCount, b.burstTokens = st.tick, st.prevCount, st.currCount, st.burstTokens
+
+	tokens = b.maxTokens
+	remaining = b.available(st)
+
+	if remaining >= n {
+		b.currCount = addSaturating(b.currCount, n)
+		remaining -= n
+		ok = true
+		reset = b.startTime + ((st.tick + 1) * uint64(b.interval))
+		return
+	}
+
+	reset = b.nextToken(now, st)
+	return
+}
+
+// burst adds the specified number of tokens to the bucket until the end of the
+// current window.
+func (b *slidingWindowBucket) burst(now, tokens uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now < b.startTime {
+		b.startTime = now
+		b.lastTick = 0
+	}
+
+	st := b.state(now)
+	b.lastTick, b.prevCount, b.currCount = st.tick, st.prevCount, st.currCount
+	b.burstTokens = addSaturating(st.burstTokens, tokens)
+}
+
+// refund returns tokens taken in the current window, as long as the window
+// which ends at reset has not passed.
+func (b *slidingWindowBucket) refund(now, tokens, reset uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now >= reset || b.currCount < tokens {
+		return
+	}
+	b.currCount -= tokens
+}
+
+// lastTime returns the start of the last window in which the bucket was used.
+func (b *slidingWindowBucket) lastTime() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.startTime + (b.lastTick * uint64(b.interval))
+}
+
+// weight returns ceil(count * part / whole) without overflowing. part must not
+// be greater than whole.
+func weight(count, part, whole uint64) uint64 {
+	hi, lo := bits.Mul64(count, part)
+	q, r := bits.Div64(hi, lo, whole)
+	if r > 0 {
+		q++
+	}
+	return q
+}
+
+// mulDiv returns floor(a * b / c) without overflowing. a must not be greater
+// than c.
+func mulDiv(a, b, c uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	q, _ := bits.Div64(hi, lo, c)
+	return q
+}
+
+// addSaturating returns a + b, or math.MaxUint64 if the sum would overflow.
+func addSaturating(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
@@ -0,0 +1,421 @@
+package memorystore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+// Restore rejects snapshots with any other version.
+const snapshotVersion = 1
+
+// StoreWithSnapshot is implemented by the stores returned by New. Callers can
+// type-assert a limiter.Store to this interface to persist the buckets across
+// restarts, so that clients do not get a fresh quota on every deploy.
+type StoreWithSnapshot interface {
+	limiter.Store
+
+	// Snapshot writes the state of every bucket to w.
+	Snapshot(w io.Writer) error
+
+	// Restore reads a snapshot written by Snapshot from r and restores its
+	// buckets.
+	Restore(r io.Reader) error
+}
+
+// snapshotHeader is the first value in a snapshot.
+type snapshotHeader struct {
+	// Version is the version of the snapshot format.
+	Version int `json:"version"`
+
+	// Time is the store's time when the snapshot was taken, in nanoseconds since
+	// the unix epoch.
+	Time uint64 `json:"time"`
+}
+
+// bucketSnapshot is the state of a single bucket. Exactly one of the algorithm
+// fields is set. All times are in nanoseconds since the unix epoch.
+type bucketSnapshot struct {
+	Key string `json:"key"`
+
+	FixedWindow   *fixedWindowSnapshot   `json:"fixed_window,omitempty"`
+	SlidingWindow *slidingWindowSnapshot `json:"sliding_window,omitempty"`
+	SlidingLog    *slidingLogSnapshot    `json:"sliding_log,omitempty"`
+	GCRA          *gcraSnapshot          `json:"gcra,omitempty"`
+	TokenBucket   *tokenBucketSnapshot   `json:"token_bucket,omitempty"`
+}
+
+// fixedWindowSnapshot is the state of a bucket or an atomicBucket.
+type fixedWindowSnapshot struct {
+	StartTime       uint64        `json:"start_time"`
+	MaxTokens       uint64        `json:"max_tokens"`
+	Interval        time.Duration `json:"interval"`
+	AvailableTokens uint64        `json:"available_tokens"`
+	LastTick        uint64        `json:"last_tick"`
+}
+
+// slidingWindowSnapshot is the state of a slidingWindowBucket.
+type slidingWindowSnapshot struct {
+	StartTime   uint64        `json:"start_time"`
+	MaxTokens   uint64        `json:"max_tokens"`
+	Interval    time.Duration `json:"interval"`
+	LastTick    uint64        `json:"last_tick"`
+	PrevCount   uint64        `json:"prev_count"`
+	CurrCount   uint64        `json:"curr_count"`
+	BurstTokens uint64        `json:"burst_tokens"`
+}
+
+// slidingLogSnapshot is the state of a slidingLogBucket. Entries holds pairs of
+// time and tokens, oldest first.
+type slidingLogSnapshot struct {
+	StartTime   uint64        `json:"start_time"`
+	MaxTokens   uint64        `json:"max_tokens"`
+	Interval    time.Duration `json:"interval"`
+	Entries     [][2]uint64   `json:"entries"`
+	BurstTokens uint64        `json:"burst_tokens"`
+	BurstExpiry uint64        `json:"burst_expiry"`
+}
+
+// gcraSnapshot is the state of a gcraBucket.
+type gcraSnapshot struct {
+	StartTime   uint64        `json:"start_time"`
+	MaxTokens   uint64        `json:"max_tokens"`
+	Interval    time.Duration `json:"interval"`
+	TAT         uint64        `json:"tat"`
+	BurstTokens uint64        `json:"burst_tokens"`
+	BurstExpiry uint64        `json:"burst_expiry"`
+}
+
+// tokenBucketSnapshot is the state of a tokenBucket. Rate is in tokens per
+// nanosecond.
+type tokenBucketSnapshot struct {
+	Capacity   uint64  `json:"capacity"`
+	Rate       float64 `json:"rate"`
+	Available  float64 `json:"available"`
+	LastRefill uint64  `json:"last_refill"`
+}
+
+// Snapshot writes the state of every bucket to w as a series of JSON values: a
+// header with the format version and the store's current time, followed by one
+// value per bucket. Buckets are read one shard at a time, so takes which happen
+// during the snapshot may or may not be included, but each bucket is
+// consistent.
+func (s *store) Snapshot(w io.Writer) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(&snapshotHeader{
+		Version: snapshotVersion,
+		Time:    s.clock.Now(),
+	}); err != nil {
+		return fmt.Errorf("failed to write snapshot header: %w", err)
+	}
+
+	for _, sh := range s.shards {
+		sh.lock.RLock()
+		snapshots := make([]*bucketSnapshot, 0, len(sh.data))
+		for k, b := range sh.data {
+			bs := b.snapshot()
+			bs.Key = k
+			snapshots = append(snapshots, bs)
+		}
+		sh.lock.RUnlock()
+
+		for _, bs := range snapshots {
+			if err := enc.Encode(bs); err != nil {
+				return fmt.Errorf("failed to write bucket %q: %w", bs.Key, err)
+			}
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore reads a snapshot written by Snapshot from r and restores its
+// buckets, replacing any existing bucket with the same key. Other keys are left
+// alone. The snapshot must have been taken by a store using the same algorithm,
+// although lock-free and locked fixed window buckets are interchangeable.
+//
+// Time which passed between the snapshot and the restore counts as it would
+// have if the store had kept running, so buckets which were exhausted at the
+// time of the snapshot may have refilled. If the clock is earlier than when the
+// snapshot was taken, for example because the snapshot came from a host with a
+// faster clock, every bucket is moved back by the difference so that it is
+// restored exactly as it was.
+//
+// The snapshot is read in full before any bucket is restored, so the store is
+// unchanged if Restore returns an error.
+func (s *store) Restore(r io.Reader) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	dec := json.NewDecoder(r)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	now := s.clock.Now()
+	var delta uint64
+	if now < header.Time {
+		delta = header.Time - now
+	}
+
+	type restored struct {
+		key string
+		b   taker
+	}
+	var buckets []restored
+
+	for {
+		var bs bucketSnapshot
+		if err := dec.Decode(&bs); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("failed to read bucket: %w", err)
+		}
+
+		b, err := s.restoreTaker(&bs, delta)
+		if err != nil {
+			return fmt.Errorf("failed to restore bucket %q: %w", bs.Key, err)
+		}
+		buckets = append(buckets, restored{key: bs.Key, b: b})
+	}
+
+	for _, rb := range buckets {
+		sh := s.shardFor(rb.key)
+		sh.lock.Lock()
+		s.put(sh, rb.key, rb.b)
+		sh.lock.Unlock()
+
+		s.evict(rb.key)
+	}
+	return nil
+}
+
+// restoreTaker creates a bucket for the store's algorithm from the snapshot,
+// moving every time back by delta.
+func (s *store) restoreTaker(bs *bucketSnapshot, delta uint64) (taker, error) {
+	switch {
+	case bs.FixedWindow != nil && s.algorithm == AlgorithmFixedWindow:
+		st := bs.FixedWindow
+		if st.Interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", st.Interval)
+		}
+
+		startTime := subSaturating(st.StartTime, delta)
+		if s.lockFree {
+			if st.MaxTokens > maxAtomicTokens {
+				return nil, fmt.Errorf("lock-free buckets support at most %d tokens, got %d", uint64(maxAtomicTokens), st.MaxTokens)
+			}
+
+			b := newAtomicBucket(startTime, st.MaxTokens, st.Interval)
+			b.window.Store(&atomicWindow{
+				state:      packState(0, min(st.AvailableTokens, maxAtomicTokens)),
+				startTime:  startTime,
+				tickOffset: st.LastTick,
+			})
+			return b, nil
+		}
+
+		b := newBucket(startTime, st.MaxTokens, st.Interval)
+		b.availableTokens = st.AvailableTokens
+		b.lastTick = st.LastTick
+		return b, nil
+
+	case bs.SlidingWindow != nil && s.algorithm == AlgorithmSlidingWindowCounter:
+		st := bs.SlidingWindow
+		if st.Interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", st.Interval)
+		}
+
+		b := newSlidingWindowBucket(subSaturating(st.StartTime, delta), st.MaxTokens, st.Interval)
+		b.lastTick = st.LastTick
+		b.prevCount = st.PrevCount
+		b.currCount = st.CurrCount
+		b.burstTokens = st.BurstTokens
+		return b, nil
+
+	case bs.SlidingLog != nil && s.algorithm == AlgorithmSlidingLog:
+		st := bs.SlidingLog
+		if st.Interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", st.Interval)
+		}
+
+		b := newSlidingLogBucket(subSaturating(st.StartTime, delta), st.MaxTokens, st.Interval)
+		b.entries = make([]logEntry, 0, len(st.Entries))
+		for _, e := range st.Entries {
+			b.entries = append(b.entries, logEntry{
+				time:   subSaturating(e[0], delta),
+				tokens: e[1],
+			})
+			b.count = addSaturating(b.count, e[1])
+		}
+		b.burstTokens = st.BurstTokens
+		b.burstExpiry = subSaturating(st.BurstExpiry, delta)
+		return b, nil
+
+	case bs.GCRA != nil && s.algorithm == AlgorithmGCRA:
+		st := bs.GCRA
+		if st.Interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", st.Interval)
+		}
+
+		b := newGCRABucket(subSaturating(st.StartTime, delta), st.MaxTokens, st.Interval)
+		b.tat = subSaturating(st.TAT, delta)
+		b.burstTokens = st.BurstTokens
+		b.burstExpiry = subSaturating(st.BurstExpiry, delta)
+		return b, nil
+
+	case bs.TokenBucket != nil && s.algorithm == AlgorithmTokenBucket:
+		st := bs.TokenBucket
+		if st.Rate < 0 || st.Available < 0 {
+			return nil, fmt.Errorf("rate and available tokens cannot be negative")
+		}
+
+		return &tokenBucket{
+			capacity:   st.Capacity,
+			rate:       st.Rate,
+			available:  st.Available,
+			lastRefill: subSaturating(st.LastRefill, delta),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("bucket does not match the store's algorithm")
+	}
+}
+
+// snapshot returns the state of the bucket.
+func (b *bucket) snapshot() *bucketSnapshot {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return &bucketSnapshot{
+		FixedWindow: &fixedWindowSnapshot{
+			StartTime:       b.startTime,
+			MaxTokens:       b.maxTokens,
+			Interval:        b.interval,
+			AvailableTokens: b.availableTokens,
+			LastTick:        b.lastTick,
+		},
+	}
+}
+
+// snapshot returns the state of the bucket in the same form as bucket, so the
+// two are interchangeable.
+func (b *atomicBucket) snapshot() *bucketSnapshot {
+	w, state := b.load()
+	lastTick, available := unpackState(state)
+
+	return &bucketSnapshot{
+		FixedWindow: &fixedWindowSnapshot{
+			StartTime:       w.startTime,
+			MaxTokens:       b.maxTokens,
+			Interval:        b.interval,
+			AvailableTokens: available,
+			LastTick:        w.tickOffset + lastTick,
+		},
+	}
+}
+
+// snapshot returns the state of the bucket.
+func (b *slidingWindowBucket) snapshot() *bucketSnapshot {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return &bucketSnapshot{
+		SlidingWindow: &slidingWindowSnapshot{
+			StartTime:   b.startTime,
+			MaxTokens:   b.maxTokens,
+			Interval:    b.interval,
+			LastTick:    b.lastTick,
+			PrevCount:   b.prevCount,
+			CurrCount:   b.currCount,
+			BurstTokens: b.burstTokens,
+		},
+	}
+}
+
+// snapshot returns the state of the bucket.
+func (b *slidingLogBucket) snapshot() *bucketSnapshot {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	entries := make([][2]uint64, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, [2]uint64{e.time, e.tokens})
+	}
+
+	return &bucketSnapshot{
+		SlidingLog: &slidingLogSnapshot{
+			StartTime:   b.startTime,
+			MaxTokens:   b.maxTokens,
+			Interval:    b.interval,
+			Entries:     entries,
+			BurstTokens: b.burstTokens,
+			BurstExpiry: b.burstExpiry,
+		},
+	}
+}
+
+// snapshot returns the state of the bucket.
+func (b *gcraBucket) snapshot() *bucketSnapshot {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return &bucketSnapshot{
+		GCRA: &gcraSnapshot{
+			StartTime:   b.startTime,
+			MaxTokens:   b.maxTokens,
+			Interval:    b.interval,
+			TAT:         b.tat,
+			BurstTokens: b.burstTokens,
+			BurstExpiry: b.burstExpiry,
+		},
+	}
+}
+
+// snapshot returns the state of the bucket.
+func (b *tokenBucket) snapshot() *bucketSnapshot {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return &bucketSnapshot{
+		TokenBucket: &tokenBucketSnapshot{
+			Capacity:   b.capacity,
+			Rate:       b.rate,
+			Available:  b.available,
+			LastRefill: b.lastRefill,
+		},
+	}
+}
+
+// subSaturating returns a-b, or 0 if b is greater than a.
+func subSaturating(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
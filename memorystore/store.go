@@ -3,30 +3,87 @@ package memorystore
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/sethvargo/go-limiter"
-	"github.com/sethvargo/go-limiter/internal/fasttime"
 )
 
-var _ limiter.Store = (*store)(nil)
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+	_ StoreWithStats          = (*store)(nil)
+	_ StoreWithSnapshot       = (*store)(nil)
+)
 
 type store struct {
-	tokens   uint64
-	interval time.Duration
+	tokens    uint64
+	interval  time.Duration
+	algorithm Algorithm
+	capacity  uint64
+	lockFree  bool
+	clock     limiter.Clock
 
 	sweepInterval time.Duration
 	sweepMinTTL   uint64
 
-	data     map[string]*bucket
-	dataLock sync.RWMutex
+	shards []*shard
+
+	// keys is the number of keys in every shard, and maxKeys is the maximum, or
+	// 0 if there is none. evictLock serializes evictions, and is taken before
+	// any shard's lock.
+	keys      int64
+	maxKeys   int64
+	evictLock sync.Mutex
+
+	rejectNewKeys bool
+	evictions     uint64
+	rejections    uint64
 
 	stopped uint32
 	stopCh  chan struct{}
 }
 
+// Algorithm is the algorithm used to decide whether a take is permitted.
+type Algorithm uint8
+
+const (
+	// AlgorithmFixedWindow permits Tokens takes per Interval, resetting the
+	// bucket to Tokens at the start of every interval. It is the fastest and most
+	// memory-efficient algorithm, but permits up to twice the limit in bursts that
+	// straddle an interval boundary. This is the default.
+	AlgorithmFixedWindow Algorithm = iota
+
+	// AlgorithmSlidingWindowCounter approximates a sliding window by weighting
+	// the number of takes in the previous interval by how much of it still
+	// overlaps the sliding window, and adding the takes in the current interval.
+	// It uses constant memory per key and smooths bursts across interval
+	// boundaries.
+	AlgorithmSlidingWindowCounter
+
+	// AlgorithmSlidingLog records the time of every take and permits a take only
+	// if fewer than Tokens takes occurred in the trailing Interval. It is exact,
+	// but memory usage per key grows with Tokens.
+	AlgorithmSlidingLog
+
+	// AlgorithmGCRA uses the generic cell rate algorithm, which spaces tokens
+	// evenly across the interval instead of refilling them all at once. It stores
+	// a single timestamp per key and reports reset as the exact time at which the
+	// next token becomes available, which is when a rejected caller may retry.
+	AlgorithmGCRA
+
+	// AlgorithmTokenBucket is a classic token bucket. Tokens are replenished
+	// continuously (including fractional tokens) at a rate of Tokens per
+	// Interval, up to Capacity. Unlike AlgorithmFixedWindow, an exhausted bucket
+	// regains its first token after Interval/Tokens rather than a full Interval.
+	// Take reports reset as the time at which the next whole token is available,
+	// and reports Capacity as the limit.
+	AlgorithmTokenBucket
+)
+
 // Config is used as input to New. It defines the behavior of the storage
 // system.
 type Config struct {
@@ -52,16 +109,71 @@ type Config struct {
 	// before they limit is applied. The default value is 12 hours.
 	SweepMinTTL time.Duration
 
-	// InitialAlloc is the size to use for the in-memory map. Go will
-	// automatically expand the buffer, but choosing higher number can trade
-	// memory consumption for performance as it limits the number of times the map
-	// needs to expand. The default value is 4096.
+	// InitialAlloc is the size to use for the in-memory map, which is divided
+	// evenly across the shards. Go will automatically expand the buffer, but
+	// choosing higher number can trade memory consumption for performance as it
+	// limits the number of times the map needs to expand. The default value is
+	// 4096.
 	InitialAlloc int
 
+	// Algorithm is the rate limiting algorithm to use. The default value is
+	// AlgorithmFixedWindow.
+	Algorithm Algorithm
+
+	// Capacity is the maximum number of tokens a bucket can hold when using
+	// AlgorithmTokenBucket. It is ignored by the other algorithms. Buckets
+	// configured with Set use the number of tokens as their capacity. The default
+	// value is Tokens.
+	Capacity uint64
+
 	// DisablePurge disables the purge operation. WARNING: this will cause
 	// unbounded memory growth. Do not enable unless you have a fixed number of
 	// buckets.
 	DisablePurge bool
+
+	// LockFree uses a lock-free implementation of AlgorithmFixedWindow, which
+	// updates each bucket with compare-and-swap instead of taking a lock. It has
+	// the same semantics, and is faster when many goroutines take from the same
+	// key. Since the bucket state is packed into a single word, buckets hold at
+	// most math.MaxUint32 tokens: New and Set return an error for larger limits,
+	// and bursts saturate at that value. It is only supported with
+	// AlgorithmFixedWindow.
+	LockFree bool
+
+	// Shards is the number of independently locked maps across which keys are
+	// spread. Takes for keys in different shards never contend for the same lock,
+	// and the first take for a new key only locks its shard exclusively. The
+	// purge sweeps one shard at a time. The default value is 32.
+	Shards int
+
+	// Clock is the source of the current time. It is used for all rate limiting
+	// decisions and to decide which entries are stale, but not to schedule the
+	// purge, which always runs every SweepInterval of real time. The default
+	// value is the system clock.
+	Clock limiter.Clock
+
+	// MaxKeys is the maximum number of keys the store holds. When the store is
+	// full, a take for a new key either evicts a key or, if RejectNewKeys is set,
+	// is rejected. Set and Burst always evict. The new key is added before
+	// another is evicted, so the store briefly holds one key more per concurrent
+	// insert. If MaxKeys is smaller than Shards, the number of shards is reduced
+	// to MaxKeys. The default value is 0, which means the number of keys is only
+	// bounded by the purge.
+	MaxKeys int
+
+	// Eviction is the policy used to choose which key to evict when the store
+	// holds MaxKeys keys. Each shard tracks its own keys, and the key is chosen
+	// from the shard which holds the most, so with more than one shard the
+	// policy only applies within that shard. It is ignored if MaxKeys is 0. The
+	// default value is EvictionLRU.
+	Eviction Eviction
+
+	// RejectNewKeys rejects takes for new keys when the store holds MaxKeys keys,
+	// instead of evicting existing keys. Existing keys keep their limits, which
+	// protects established clients from a flood of new ones, but new clients are
+	// rejected until keys are purged or deleted. A rejected take reports no
+	// remaining tokens and a reset one Interval in the future.
+	RejectNewKeys bool
 }
 
 // New creates an in-memory rate limiter that uses a bucketing model to limit
@@ -92,22 +204,93 @@ func New(c *Config) (limiter.Store, error) {
 		sweepMinTTL = c.SweepMinTTL
 	}
 
+	capacity := tokens
+	if c.Capacity > 0 {
+		capacity = c.Capacity
+	}
+
 	initialAlloc := 4096
 	if c.InitialAlloc > 0 {
 		initialAlloc = c.InitialAlloc
 	}
 
+	shards := 32
+	if c.Shards > 0 {
+		shards = c.Shards
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	if c.MaxKeys < 0 {
+		return nil, fmt.Errorf("max keys cannot be negative, got %d", c.MaxKeys)
+	}
+
+	switch c.Eviction {
+	case EvictionLRU, EvictionCLOCK:
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %d", c.Eviction)
+	}
+
+	// With no more shards than MaxKeys, whenever the store holds too many keys
+	// the fullest shard holds at least two, so it always has a key to evict
+	// besides the one which was just added.
+	if c.MaxKeys > 0 {
+		shards = min(shards, c.MaxKeys)
+	}
+
+	switch c.Algorithm {
+	case AlgorithmFixedWindow, AlgorithmSlidingWindowCounter, AlgorithmSlidingLog, AlgorithmGCRA, AlgorithmTokenBucket:
+	default:
+		return nil, fmt.Errorf("unknown algorithm %d", c.Algorithm)
+	}
+
+	if c.LockFree {
+		if c.Algorithm != AlgorithmFixedWindow {
+			return nil, fmt.Errorf("lock-free buckets are only supported with the fixed window algorithm")
+		}
+		if tokens > maxAtomicTokens {
+			return nil, fmt.Errorf("lock-free buckets support at most %d tokens, got %d", uint64(maxAtomicTokens), tokens)
+		}
+	}
+
 	s := &store{
-		tokens:   tokens,
-		interval: interval,
+		tokens:    tokens,
+		interval:  interval,
+		algorithm: c.Algorithm,
+		capacity:  capacity,
+		lockFree:  c.LockFree,
+		clock:     clock,
 
 		sweepInterval: sweepInterval,
 		sweepMinTTL:   uint64(sweepMinTTL),
 
-		data:   make(map[string]*bucket, initialAlloc),
+		shards: make([]*shard, shards),
+
+		maxKeys: int64(c.MaxKeys),
+
+		rejectNewKeys: c.RejectNewKeys,
+
 		stopCh: make(chan struct{}),
 	}
 
+	// Spread the initial allocation across the shards.
+	shardAlloc := max(initialAlloc/shards, 1)
+	if c.MaxKeys > 0 {
+		shardAlloc = min(shardAlloc, c.MaxKeys/shards+1)
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			data: make(map[string]taker, shardAlloc),
+			keys: &s.keys,
+		}
+		if c.MaxKeys > 0 {
+			s.shards[i].evictor = newEvictor(c.Eviction)
+		}
+	}
+
 	if !c.DisablePurge {
 		go s.purge()
 	}
@@ -119,37 +302,63 @@ func New(c *Config) (limiter.Store, error) {
 // successful, it returns true, otherwise false. It also returns the configured
 // limit, remaining tokens, and reset time.
 func (s *store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN attempts to remove n tokens from the named key. The take is all or
+// nothing - if fewer than n tokens are available, no tokens are removed and the
+// take is unsuccessful. It returns the same values as Take.
+func (s *store) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
 	// If the store is stopped, all requests are rejected.
 	if atomic.LoadUint32(&s.stopped) == 1 {
 		return 0, 0, 0, false, limiter.ErrStopped
 	}
 
+	// Capture the current request time.
+	now := s.clock.Now()
+
 	// Acquire a read lock first - this allows other to concurrently check limits
-	// without taking a full lock.
-	s.dataLock.RLock()
-	if b, ok := s.data[key]; ok {
-		s.dataLock.RUnlock()
-		return b.take()
+	// without taking a full lock. Only the key's shard is locked, so keys in
+	// other shards are unaffected.
+	sh := s.shardFor(key)
+	sh.lock.RLock()
+	if b, ok := sh.data[key]; ok {
+		sh.touch(key)
+		sh.lock.RUnlock()
+		return b.take(now, n)
 	}
-	s.dataLock.RUnlock()
+	sh.lock.RUnlock()
 
 	// Unfortunately we did not find the key in the map. Take out a full lock. We
 	// have to check if the key exists again, because it's possible another
 	// goroutine created it between our shared lock and exclusive lock.
-	s.dataLock.Lock()
-	if b, ok := s.data[key]; ok {
-		s.dataLock.Unlock()
-		return b.take()
+	sh.lock.Lock()
+	if b, ok := sh.data[key]; ok {
+		sh.touch(key)
+		sh.lock.Unlock()
+		return b.take(now, n)
+	}
+
+	// If the store is full and new keys are rejected, there's no bucket to take
+	// from.
+	if !s.reserve(!s.rejectNewKeys) {
+		sh.lock.Unlock()
+		atomic.AddUint64(&s.rejections, 1)
+		return s.tokens, 0, now + uint64(s.interval), false, nil
 	}
 
 	// This is the first time we've seen this entry (or it's been garbage
 	// collected), so create the bucket and take an initial request.
-	b := newBucket(s.tokens, s.interval)
+	b := s.newTaker(now, s.tokens, s.capacity, s.interval)
+
+	// Add it to the map and take, and then make room for it if the store is
+	// full.
+	s.insert(sh, key, b)
+	sh.lock.Unlock()
 
-	// Add it to the map and take.
-	s.data[key] = b
-	s.dataLock.Unlock()
-	return b.take()
+	tokens, remaining, reset, ok, err := b.take(now, n)
+	s.evict(key)
+	return tokens, remaining, reset, ok, err
 }
 
 // Get retrieves the information about the key, if any exists.
@@ -161,50 +370,212 @@ func (s *store) Get(ctx context.Context, key string) (uint64, uint64, error) {
 
 	// Acquire a read lock first - this allows other to concurrently check limits
 	// without taking a full lock.
-	s.dataLock.RLock()
-	if b, ok := s.data[key]; ok {
-		s.dataLock.RUnlock()
-		return b.get()
+	sh := s.shardFor(key)
+	sh.lock.RLock()
+	if b, ok := sh.data[key]; ok {
+		sh.lock.RUnlock()
+		return b.get(s.clock.Now())
 	}
-	s.dataLock.RUnlock()
+	sh.lock.RUnlock()
 
 	return 0, 0, nil
 }
 
 // Set configures the bucket-specific tokens and interval.
 func (s *store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
-	s.dataLock.Lock()
-	b := newBucket(tokens, interval)
-	s.data[key] = b
-	s.dataLock.Unlock()
+	if s.lockFree && tokens > maxAtomicTokens {
+		return fmt.Errorf("lock-free buckets support at most %d tokens, got %d", uint64(maxAtomicTokens), tokens)
+	}
+
+	sh := s.shardFor(key)
+	sh.lock.Lock()
+	s.put(sh, key, s.newTaker(s.clock.Now(), tokens, tokens, interval))
+	sh.lock.Unlock()
+
+	s.evict(key)
 	return nil
 }
 
 // Burst adds the provided value to the bucket's currently available tokens.
 func (s *store) Burst(ctx context.Context, key string, tokens uint64) error {
-	s.dataLock.RLock()
-	if b, ok := s.data[key]; ok {
-		s.dataLock.RUnlock()
-		b.burst(tokens)
+	now := s.clock.Now()
+
+	sh := s.shardFor(key)
+	sh.lock.RLock()
+	if b, ok := sh.data[key]; ok {
+		sh.touch(key)
+		sh.lock.RUnlock()
+		b.burst(now, tokens)
 		return nil
 	}
-	s.dataLock.RUnlock()
+	sh.lock.RUnlock()
 
-	s.dataLock.Lock()
+	sh.lock.Lock()
 	// check again just in case
-	if b, ok := s.data[key]; ok {
-		s.dataLock.Unlock()
-		b.burst(tokens)
+	if b, ok := sh.data[key]; ok {
+		sh.touch(key)
+		sh.lock.Unlock()
+		b.burst(now, tokens)
 		return nil
 	}
 
 	// If we got this far, there's no current record for the key.
-	b := newBucket(s.tokens+tokens, s.interval)
-	s.data[key] = b
-	s.dataLock.Unlock()
+	b := s.newTaker(now, s.tokens+tokens, s.capacity+tokens, s.interval)
+	s.reserve(true)
+	s.insert(sh, key, b)
+	sh.lock.Unlock()
+
+	s.evict(key)
+	return nil
+}
+
+// Refund returns tokens to the bucket at key, provided the bucket is still in
+// the interval that ends at reset.
+func (s *store) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	sh := s.shardFor(key)
+	sh.lock.RLock()
+	b, ok := sh.data[key]
+	sh.lock.RUnlock()
+
+	if ok {
+		b.refund(s.clock.Now(), tokens, reset)
+	}
+	return nil
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *store) Delete(ctx context.Context, key string) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	sh := s.shardFor(key)
+	sh.lock.Lock()
+	sh.remove(key)
+	sh.lock.Unlock()
 	return nil
 }
 
+// Stats returns the number of keys in the store, and the number of keys which
+// have been evicted or rejected because the store was full.
+func (s *store) Stats() Stats {
+	var keys uint64
+	for _, sh := range s.shards {
+		sh.lock.RLock()
+		keys += uint64(len(sh.data))
+		sh.lock.RUnlock()
+	}
+
+	return Stats{
+		Keys:       keys,
+		Evictions:  atomic.LoadUint64(&s.evictions),
+		Rejections: atomic.LoadUint64(&s.rejections),
+	}
+}
+
+// put adds the bucket to the shard, replacing any existing bucket for the key.
+// It must be called with the shard's write lock held, and followed by evict
+// once the lock is released.
+func (s *store) put(sh *shard, key string, b taker) {
+	if _, ok := sh.data[key]; ok {
+		sh.data[key] = b
+		sh.touch(key)
+		return
+	}
+	s.reserve(true)
+	s.insert(sh, key, b)
+}
+
+// reserve counts a new key. If the store is full, the key is only counted if
+// force is true, and then a key must be evicted. It reports whether the key was
+// counted.
+func (s *store) reserve(force bool) bool {
+	if force || s.maxKeys == 0 {
+		atomic.AddInt64(&s.keys, 1)
+		return true
+	}
+
+	for {
+		keys := atomic.LoadInt64(&s.keys)
+		if keys >= s.maxKeys {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.keys, keys, keys+1) {
+			return true
+		}
+	}
+}
+
+// insert adds the bucket for a new key, which has already been counted with
+// reserve, to the shard. It must be called with the shard's write lock held.
+func (s *store) insert(sh *shard, key string, b taker) {
+	sh.data[key] = b
+	if sh.evictor != nil {
+		sh.evictor.add(key)
+	}
+}
+
+// evict evicts keys until the store holds at most MaxKeys keys. Each key is
+// chosen by the evictor of the shard which holds the most keys, but is never
+// the new key, except. It must be called without any shard's lock held.
+func (s *store) evict(except string) {
+	if s.maxKeys == 0 || atomic.LoadInt64(&s.keys) <= s.maxKeys {
+		return
+	}
+
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	for atomic.LoadInt64(&s.keys) > s.maxKeys {
+		sh := s.fullest()
+		if sh == nil {
+			return
+		}
+
+		sh.lock.Lock()
+		victim, ok := sh.evictor.victim()
+
+		// Mark the new key as used, so that the evictor moves past it. CLOCK may
+		// need two tries, if its hand was on the new key.
+		for i := 0; ok && victim == except && len(sh.data) > 1 && i < 2; i++ {
+			sh.evictor.touch(except)
+			victim, ok = sh.evictor.victim()
+		}
+		if ok && victim != except {
+			sh.remove(victim)
+			atomic.AddUint64(&s.evictions, 1)
+		}
+		sh.lock.Unlock()
+
+		if !ok || victim == except {
+			return
+		}
+	}
+}
+
+// fullest returns the shard which holds the most keys, or nil if every shard
+// is empty.
+func (s *store) fullest() *shard {
+	var fullest *shard
+	var most int
+	for _, sh := range s.shards {
+		sh.lock.RLock()
+		n := len(sh.data)
+		sh.lock.RUnlock()
+
+		if n > most {
+			fullest, most = sh, n
+		}
+	}
+	return fullest
+}
+
 // Close stops the memory limiter and cleans up any outstanding
 // sessions. You should always call Close() as it releases the memory consumed
 // by the map AND releases the tickers.
@@ -217,11 +588,17 @@ func (s *store) Close(ctx context.Context) error {
 	close(s.stopCh)
 
 	// Delete all the things.
-	s.dataLock.Lock()
-	for k := range s.data {
-		delete(s.data, k)
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		for k := range sh.data {
+			delete(sh.data, k)
+		}
+		if sh.evictor != nil {
+			sh.evictor.reset()
+		}
+		sh.lock.Unlock()
 	}
-	s.dataLock.Unlock()
+	atomic.StoreInt64(&s.keys, 0)
 	return nil
 }
 
@@ -241,37 +618,149 @@ func (s *store) purge() {
 		case <-ticker.C:
 		}
 
-		s.dataLock.RLock()
-		now := fasttime.Now()
-		var deletes []string
-		for k, b := range s.data {
-			b.lock.RLock()
-			lastTime := b.startTime + (b.lastTick * uint64(b.interval))
-			b.lock.RUnlock()
-
-			// There's a very rare edge case where the server clock is reset between
-			// the call to fasttime.Now() above and when this bucket is locked. This
-			// is more likely when there are many buckets, since this function will
-			// take longer to run.
-			if lastTime > now {
-				lastTime = now
-			}
-
-			if now-lastTime > s.sweepMinTTL {
-				deletes = append(deletes, k)
-			}
+		s.sweep()
+	}
+}
+
+// sweep deletes the entries which have been inactive for longer than the
+// minimum TTL. Each shard is swept in turn, so only one shard is locked at a
+// time.
+func (s *store) sweep() {
+	for _, sh := range s.shards {
+		sh.sweep(s.clock.Now(), s.sweepMinTTL)
+	}
+}
+
+// shardFor returns the shard which holds the key. It uses the FNV-1a hash of
+// the key, computed inline to avoid allocating a hash.Hash.
+func (s *store) shardFor(key string) *shard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return s.shards[h%uint64(len(s.shards))]
+}
+
+// shard is an independently locked portion of the store's keys.
+type shard struct {
+	data map[string]taker
+	lock sync.RWMutex
+
+	// keys is the store's count of keys, which is shared by every shard.
+	keys *int64
+
+	// evictor chooses which of the shard's keys to evict when the store is full.
+	// It is only set if the store has a maximum number of keys.
+	evictor evictor
+}
+
+// touch records a use of the key for eviction. It must be called with the lock
+// held, but the read lock is sufficient.
+func (sh *shard) touch(key string) {
+	if sh.evictor != nil {
+		sh.evictor.touch(key)
+	}
+}
+
+// remove deletes the key from the shard. It must be called with the write lock
+// held.
+func (sh *shard) remove(key string) {
+	if _, ok := sh.data[key]; !ok {
+		return
+	}
+
+	delete(sh.data, key)
+	atomic.AddInt64(sh.keys, -1)
+	if sh.evictor != nil {
+		sh.evictor.remove(key)
+	}
+}
+
+// sweep deletes the entries in the shard which have been inactive for longer
+// than ttl.
+func (sh *shard) sweep(now, ttl uint64) {
+	sh.lock.RLock()
+	var deletes []string
+	for k, b := range sh.data {
+		lastTime := b.lastTime()
+
+		// There's a very rare edge case where the server clock is reset between
+		// the call to Now() and when this bucket is locked. This is more likely
+		// when there are many buckets, since this function will take longer to
+		// run.
+		if lastTime > now {
+			lastTime = now
 		}
-		s.dataLock.RUnlock()
 
-		for _, k := range deletes {
-			s.dataLock.Lock()
-			delete(s.data, k)
-			s.dataLock.Unlock()
+		if now-lastTime > ttl {
+			deletes = append(deletes, k)
 		}
 	}
+	sh.lock.RUnlock()
+
+	for _, k := range deletes {
+		sh.lock.Lock()
+		// Check again under the full lock, since the key may have been taken from
+		// in the meantime.
+		if b, ok := sh.data[k]; ok && now-min(b.lastTime(), now) > ttl {
+			sh.remove(k)
+		}
+		sh.lock.Unlock()
+	}
+}
+
+// newTaker creates a new bucket for the store's algorithm from the given tokens
+// and interval. The capacity is only used by AlgorithmTokenBucket.
+func (s *store) newTaker(now, tokens, capacity uint64, interval time.Duration) taker {
+	switch s.algorithm {
+	case AlgorithmSlidingWindowCounter:
+		return newSlidingWindowBucket(now, tokens, interval)
+	case AlgorithmSlidingLog:
+		return newSlidingLogBucket(now, tokens, interval)
+	case AlgorithmGCRA:
+		return newGCRABucket(now, tokens, interval)
+	case AlgorithmTokenBucket:
+		return newTokenBucket(now, tokens, capacity, interval)
+	default:
+		if s.lockFree {
+			return newAtomicBucket(now, tokens, interval)
+		}
+		return newBucket(now, tokens, interval)
+	}
+}
+
+// taker is the interface implemented by the buckets for each algorithm. All
+// methods must be safe for concurrent use. The now argument is the current time
+// in nanoseconds since the unix epoch.
+type taker interface {
+	// take attempts to remove n tokens. It returns the limit, remaining tokens,
+	// time when new tokens will be available, and whether the take was
+	// successful. Either all n tokens are taken or none are.
+	take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error)
+
+	// get returns the limit and remaining tokens without modifying the bucket.
+	get(now uint64) (tokens uint64, remaining uint64, retErr error)
+
+	// burst temporarily adds tokens to the bucket.
+	burst(now, tokens uint64)
+
+	// refund returns tokens that were taken by the take which returned reset.
+	refund(now, tokens, reset uint64)
+
+	// lastTime returns the last time the bucket was used, which is used when
+	// purging stale buckets.
+	lastTime() uint64
+
+	// snapshot returns the state of the bucket, without its key.
+	snapshot() *bucketSnapshot
 }
 
-// bucket is an internal wrapper around a taker.
+// bucket is the fixed window implementation of a taker.
 type bucket struct {
 	// startTime is the number of nanoseconds from unix epoch when this bucket was
 	// initially created.
@@ -296,9 +785,9 @@ type bucket struct {
 }
 
 // newBucket creates a new bucket from the given tokens and interval.
-func newBucket(tokens uint64, interval time.Duration) *bucket {
+func newBucket(now, tokens uint64, interval time.Duration) *bucket {
 	b := &bucket{
-		startTime:       fasttime.Now(),
+		startTime:       now,
 		maxTokens:       tokens,
 		availableTokens: tokens,
 		interval:        interval,
@@ -307,7 +796,7 @@ func newBucket(tokens uint64, interval time.Duration) *bucket {
 }
 
 // get returns information about the bucket.
-func (b *bucket) get() (tokens uint64, remaining uint64, retErr error) {
+func (b *bucket) get(_ uint64) (tokens uint64, remaining uint64, retErr error) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
@@ -316,15 +805,12 @@ func (b *bucket) get() (tokens uint64, remaining uint64, retErr error) {
 	return
 }
 
-// take attempts to remove a token from the bucket. If there are no tokens
-// available and the clock has ticked forward, it recalculates the number of
-// tokens and retries. It returns the limit, remaining tokens, time until
-// refresh, and whether the take was successful.
-func (b *bucket) take() (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
-	// Capture the current request time, current tick, and amount of time until
-	// the bucket resets.
-	now := fasttime.Now()
-
+// take attempts to remove n tokens from the bucket. If the clock has ticked
+// forward since the last take, it recalculates the number of tokens first. If
+// fewer than n tokens are available, the bucket is left unchanged. It returns
+// the limit, remaining tokens, time until refresh, and whether the take was
+// successful.
+func (b *bucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -347,22 +833,46 @@ func (b *bucket) take() (tokens uint64, remaining uint64, reset uint64, ok bool,
 		b.lastTick = currTick
 	}
 
-	if b.availableTokens > 0 {
-		b.availableTokens--
+	if b.availableTokens >= n {
+		b.availableTokens -= n
 		ok = true
-		remaining = b.availableTokens
 	}
+	remaining = b.availableTokens
 
 	return
 }
 
 // burst adds the specified number of tokens to the bucket's available tokens in a thread-safe manner.
-func (b *bucket) burst(tokens uint64) {
+func (b *bucket) burst(_, tokens uint64) {
 	b.lock.Lock()
 	b.availableTokens = b.availableTokens + tokens
 	b.lock.Unlock()
 }
 
+// refund returns tokens to the bucket's available tokens, but only if the
+// bucket is still in the tick which ends at reset. Once the tick has passed, the
+// bucket is (or will be) refilled to maxTokens, so there is nothing to refund.
+func (b *bucket) refund(now, tokens, reset uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now >= reset {
+		return
+	}
+	if b.startTime+((b.lastTick+1)*uint64(b.interval)) != reset {
+		return
+	}
+	b.availableTokens = b.availableTokens + tokens
+}
+
+// lastTime returns the start of the last tick in which the bucket was used.
+func (b *bucket) lastTime() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.startTime + (b.lastTick * uint64(b.interval))
+}
+
 // tick is the total number of times the current interval has occurred between
 // when the time started (start) and the current time (curr). For example, if
 // the start time was 12:30pm and it's currently 1:00pm, and the interval was 5
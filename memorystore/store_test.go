@@ -1,15 +1,21 @@
 package memorystore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/sethvargo/go-limiter/internal/fasttime"
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/limitertest"
 )
 
 func TestFillRate(t *testing.T) {
@@ -18,9 +24,11 @@ func TestFillRate(t *testing.T) {
 	t.Run("many_tokens_small_interval", func(t *testing.T) {
 		t.Parallel()
 
+		clock := fakeclock.New(time.Now())
 		s, _ := New(&Config{
 			Tokens:   65525,
 			Interval: time.Second,
+			Clock:    clock,
 		})
 
 		for i := 0; i < 20; i++ {
@@ -28,7 +36,7 @@ func TestFillRate(t *testing.T) {
 			if remaining < limit-uint64(i)-1 {
 				t.Errorf("invalid remaining: run: %d limit: %d remaining: %d", i, limit, remaining)
 			}
-			time.Sleep(100 * time.Millisecond)
+			clock.Advance(100 * time.Millisecond)
 		}
 	})
 }
@@ -49,163 +57,437 @@ func TestStore_Exercise(t *testing.T) {
 
 	ctx := context.Background()
 
-	s, err := New(&Config{
-		Tokens:        5,
-		Interval:      3 * time.Second,
-		SweepInterval: 24 * time.Hour,
-		SweepMinTTL:   24 * time.Hour,
-	})
-	if err != nil {
-		t.Fatal(err)
+	cases := []struct {
+		name      string
+		algorithm Algorithm
+	}{
+		{
+			name:      "fixed_window",
+			algorithm: AlgorithmFixedWindow,
+		},
+		{
+			name:      "sliding_window_counter",
+			algorithm: AlgorithmSlidingWindowCounter,
+		},
+		{
+			name:      "sliding_log",
+			algorithm: AlgorithmSlidingLog,
+		},
+		{
+			name:      "gcra",
+			algorithm: AlgorithmGCRA,
+		},
+		{
+			name:      "token_bucket",
+			algorithm: AlgorithmTokenBucket,
+		},
 	}
-	t.Cleanup(func() {
-		if err := s.Close(ctx); err != nil {
-			t.Fatal(err)
-		}
-	})
 
-	key := testKey(t)
+	for _, tc := range cases {
+		tc := tc
 
-	// Get when no config exists
-	{
-		limit, remaining, err := s.(*store).Get(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-		if got, want := limit, uint64(0); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(0); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
+			clock := fakeclock.New(time.Now())
+			s, err := New(&Config{
+				Tokens:        5,
+				Interval:      3 * time.Second,
+				SweepInterval: 24 * time.Hour,
+				SweepMinTTL:   24 * time.Hour,
+				Algorithm:     tc.algorithm,
+				Clock:         clock,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			key := testKey(t)
+
+			// Get when no config exists
+			{
+				limit, remaining, err := s.(*store).Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := limit, uint64(0); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(0); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+			}
+
+			// Take with no key configuration - this should use the default values
+			{
+				limit, remaining, reset, ok, err := s.Take(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Errorf("expected ok")
+				}
+				if got, want := limit, uint64(5); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(4); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := time.Duration(reset-clock.Now()), 3*time.Second; got > want {
+					t.Errorf("expected %v to less than %v", got, want)
+				}
+			}
+
+			// Get the value
+			{
+				limit, remaining, err := s.(*store).Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := limit, uint64(5); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(4); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+			}
+
+			// Now set a value
+			{
+				if err := s.Set(ctx, key, 11, 5*time.Second); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Get the value again
+			{
+				limit, remaining, err := s.(*store).Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := limit, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+			}
+
+			// Take again, this should use the new values
+			{
+				limit, remaining, reset, ok, err := s.Take(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Errorf("expected ok")
+				}
+				if got, want := limit, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(10); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := time.Duration(reset-clock.Now()), 5*time.Second; got > want {
+					t.Errorf("expected %v to less than %v", got, want)
+				}
+			}
+
+			// Get the value again
+			{
+				limit, remaining, err := s.(*store).Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := limit, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(10); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+			}
+
+			// Burst and take
+			{
+				if err := s.Burst(ctx, key, 5); err != nil {
+					t.Fatal(err)
+				}
+
+				limit, remaining, reset, ok, err := s.Take(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Errorf("expected ok")
+				}
+				if got, want := limit, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(14); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := time.Duration(reset-clock.Now()), 5*time.Second; got > want {
+					t.Errorf("expected %v to less than %v", got, want)
+				}
+			}
+
+			// Get the value one final time
+			{
+				limit, remaining, err := s.(*store).Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := limit, uint64(11); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got, want := remaining, uint64(14); got != want {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+			}
+		})
 	}
+}
 
-	// Take with no key configuration - this should use the default values
-	{
-		limit, remaining, reset, ok, err := s.Take(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if !ok {
-			t.Errorf("expected ok")
-		}
-		if got, want := limit, uint64(5); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(4); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := time.Until(time.Unix(0, int64(reset))), 3*time.Second; got > want {
-			t.Errorf("expected %v to less than %v", got, want)
-		}
+func TestStore_BoundaryBurst(t *testing.T) {
+	t.Parallel()
+
+	// Takes happen at these offsets from the bucket's creation. The bucket is
+	// drained just before the first interval boundary, and then drained again
+	// just after it.
+	type step struct {
+		at    time.Duration
+		takes uint64
+		ok    uint64
 	}
 
-	// Get the value
-	{
-		limit, remaining, err := s.(*store).Get(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got, want := limit, uint64(5); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(4); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
+	cases := []struct {
+		name      string
+		algorithm Algorithm
+		steps     []step
+	}{
+		{
+			name:      "fixed_window",
+			algorithm: AlgorithmFixedWindow,
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1100 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1500 * time.Millisecond, takes: 5, ok: 0},
+				{at: 2000 * time.Millisecond, takes: 5, ok: 5},
+			},
+		},
+		{
+			name:      "sliding_window_counter",
+			algorithm: AlgorithmSlidingWindowCounter,
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1100 * time.Millisecond, takes: 5, ok: 0},
+				{at: 1500 * time.Millisecond, takes: 5, ok: 2},
+				{at: 2000 * time.Millisecond, takes: 5, ok: 3},
+			},
+		},
+		{
+			name:      "sliding_log",
+			algorithm: AlgorithmSlidingLog,
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1100 * time.Millisecond, takes: 5, ok: 0},
+				{at: 1500 * time.Millisecond, takes: 5, ok: 0},
+				{at: 2000 * time.Millisecond, takes: 5, ok: 5},
+			},
+		},
+		{
+			name:      "gcra",
+			algorithm: AlgorithmGCRA,
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1100 * time.Millisecond, takes: 5, ok: 1},
+				{at: 1500 * time.Millisecond, takes: 5, ok: 2},
+				{at: 2000 * time.Millisecond, takes: 5, ok: 2},
+			},
+		},
+		{
+			name:      "token_bucket",
+			algorithm: AlgorithmTokenBucket,
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 5, ok: 5},
+				{at: 1150 * time.Millisecond, takes: 5, ok: 1},
+				{at: 1550 * time.Millisecond, takes: 5, ok: 2},
+				{at: 2050 * time.Millisecond, takes: 5, ok: 2},
+			},
+		},
 	}
 
-	// Now set a value
-	{
-		if err := s.Set(ctx, key, 11, 5*time.Second); err != nil {
-			t.Fatal(err)
-		}
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			start := uint64(time.Hour)
+			b := (&store{algorithm: tc.algorithm}).newTaker(start, 5, 5, time.Second)
+
+			for _, step := range tc.steps {
+				var got uint64
+				for i := uint64(0); i < step.takes; i++ {
+					_, _, _, ok, err := b.take(start+uint64(step.at), 1)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ok {
+						got++
+					}
+				}
+				if want := step.ok; got != want {
+					t.Errorf("at %s: expected %d to be %d", step.at, got, want)
+				}
+			}
+		})
 	}
+}
 
-	// Get the value again
-	{
-		limit, remaining, err := s.(*store).Get(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got, want := limit, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+func TestSlidingWindowBucket_reset(t *testing.T) {
+	t.Parallel()
+
+	start := uint64(time.Hour)
+	b := newSlidingWindowBucket(start, 5, time.Second)
+
+	// Fill the first window.
+	for i := 0; i < 5; i++ {
+		if _, _, reset, ok, _ := b.take(start, 1); !ok {
+			t.Fatalf("expected take %d to be ok", i)
+		} else if got, want := reset, start+uint64(time.Second); got != want {
+			t.Errorf("expected %d to be %d", got, want)
 		}
 	}
 
-	// Take again, this should use the new values
-	{
-		limit, remaining, reset, ok, err := s.Take(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
+	// Just after the boundary, the previous window is still weighted at 90%, so
+	// the next token is available once that drops to 80%.
+	now := start + uint64(1100*time.Millisecond)
+	_, _, reset, ok, _ := b.take(now, 1)
+	if ok {
+		t.Fatal("expected take to be rejected")
+	}
+	if got, want := reset, start+uint64(1200*time.Millisecond); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, _, _, ok, _ := b.take(reset, 1); !ok {
+		t.Errorf("expected take at reset to be ok")
+	}
+}
+
+func TestGCRABucket_reset(t *testing.T) {
+	t.Parallel()
+
+	start := uint64(time.Hour)
+	b := newGCRABucket(start, 5, time.Second)
+
+	// Tokens are replenished every 200ms, so the next token is always available
+	// 200ms after the first take.
+	for i := uint64(0); i < 5; i++ {
+		_, remaining, reset, ok, _ := b.take(start, 1)
 		if !ok {
-			t.Errorf("expected ok")
-		}
-		if got, want := limit, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+			t.Fatalf("expected take %d to be ok", i)
 		}
-		if got, want := remaining, uint64(10); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+		if got, want := remaining, 4-i; got != want {
+			t.Errorf("expected %d to be %d", got, want)
 		}
-		if got, want := time.Until(time.Unix(0, int64(reset))), 5*time.Second; got > want {
-			t.Errorf("expected %v to less than %v", got, want)
+		if got, want := reset, start+uint64(200*time.Millisecond); got != want {
+			t.Errorf("expected %d to be %d", got, want)
 		}
 	}
 
-	// Get the value again
-	{
-		limit, remaining, err := s.(*store).Get(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got, want := limit, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(10); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+	_, _, reset, ok, _ := b.take(start+uint64(100*time.Millisecond), 1)
+	if ok {
+		t.Fatal("expected take to be rejected")
+	}
+	if got, want := reset, start+uint64(200*time.Millisecond); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, _, _, ok, _ := b.take(reset-1, 1); ok {
+		t.Errorf("expected take before reset to be rejected")
+	}
+	if _, _, _, ok, _ := b.take(reset, 1); !ok {
+		t.Errorf("expected take at reset to be ok")
+	}
+}
+
+func TestTokenBucket_reset(t *testing.T) {
+	t.Parallel()
+
+	start := uint64(time.Hour)
+	b := newTokenBucket(start, 5, 5, time.Second)
+
+	for i := 0; i < 5; i++ {
+		if _, _, _, ok, _ := b.take(start, 1); !ok {
+			t.Fatalf("expected take %d to be ok", i)
 		}
 	}
 
-	// Burst and take
-	{
-		if err := s.Burst(ctx, key, 5); err != nil {
+	// Tokens refill at one every 200ms, so an empty bucket has its next token
+	// 200ms from now, not at the end of the interval.
+	now := start + uint64(50*time.Millisecond)
+	_, remaining, reset, ok, _ := b.take(now, 1)
+	if ok {
+		t.Fatal("expected take to be rejected")
+	}
+	if got, want := remaining, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := reset, start+uint64(200*time.Millisecond); got < want || got > want+1 {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, _, _, ok, _ := b.take(reset, 1); !ok {
+		t.Errorf("expected take at reset to be ok")
+	}
+}
+
+func TestTokenBucket_capacity(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Tokens:        1,
+		Interval:      time.Hour,
+		Capacity:      10,
+		Algorithm:     AlgorithmTokenBucket,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
 			t.Fatal(err)
 		}
+	})
 
-		limit, remaining, reset, ok, err := s.Take(ctx, key)
+	key := testKey(t)
+	for i := uint64(0); i < 10; i++ {
+		limit, remaining, _, ok, err := s.Take(ctx, key)
 		if err != nil {
 			t.Fatal(err)
 		}
 		if !ok {
-			t.Errorf("expected ok")
-		}
-		if got, want := limit, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+			t.Fatalf("expected take %d to be ok", i)
 		}
-		if got, want := remaining, uint64(14); got != want {
-			t.Errorf("expected %v to be %v", got, want)
+		if got, want := limit, uint64(10); got != want {
+			t.Errorf("expected %d to be %d", got, want)
 		}
-		if got, want := time.Until(time.Unix(0, int64(reset))), 5*time.Second; got > want {
-			t.Errorf("expected %v to less than %v", got, want)
+		if got, want := remaining, 9-i; got != want {
+			t.Errorf("expected %d to be %d", got, want)
 		}
 	}
 
-	// Get the value one final time
-	{
-		limit, remaining, err := s.(*store).Get(ctx, key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got, want := limit, uint64(11); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
-		if got, want := remaining, uint64(14); got != want {
-			t.Errorf("expected %v to be %v", got, want)
-		}
+	if _, _, _, ok, _ := s.Take(ctx, key); ok {
+		t.Errorf("expected take beyond capacity to be rejected")
 	}
 }
 
@@ -239,11 +521,13 @@ func TestStore_Take(t *testing.T) {
 
 			key := testKey(t)
 
+			clock := fakeclock.New(time.Now())
 			s, err := New(&Config{
 				Interval:      tc.interval,
 				Tokens:        tc.tokens,
 				SweepInterval: 24 * time.Hour,
 				SweepMinTTL:   24 * time.Hour,
+				Clock:         clock,
 			})
 			if err != nil {
 				t.Fatal(err)
@@ -266,7 +550,7 @@ func TestStore_Take(t *testing.T) {
 			for i := uint64(1); i <= 2*tc.tokens; i++ {
 				go func() {
 					limit, remaining, reset, ok, err := s.Take(ctx, key)
-					takeCh <- &result{limit, remaining, time.Duration(fasttime.Now() - reset), ok, err}
+					takeCh <- &result{limit, remaining, time.Duration(reset - clock.Now()), ok, err}
 				}()
 			}
 
@@ -317,8 +601,8 @@ func TestStore_Take(t *testing.T) {
 				}
 			}
 
-			// Wait for the bucket to have entries again.
-			time.Sleep(tc.interval)
+			// Move to the next interval, so the bucket has entries again.
+			clock.Advance(tc.interval)
 
 			// Verify we can take once more.
 			_, _, _, ok, err := s.Take(ctx, key)
@@ -332,20 +616,363 @@ func TestStore_Take(t *testing.T) {
 	}
 }
 
-func TestBucketedLimiter_tick(t *testing.T) {
+func TestStore_TakeN(t *testing.T) {
 	t.Parallel()
 
-	cases := []struct {
-		name     string
-		start    uint64
-		curr     uint64
-		interval time.Duration
-		exp      uint64
-	}{
-		{
-			name:     "no_diff",
-			start:    0,
-			curr:     0,
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Tokens:        10,
+		Interval:      time.Hour,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := testKey(t)
+	takeN := s.(limiter.StoreWithTakeN).TakeN
+
+	cases := []struct {
+		name      string
+		n         uint64
+		ok        bool
+		remaining uint64
+	}{
+		{
+			name:      "partial",
+			n:         4,
+			ok:        true,
+			remaining: 6,
+		},
+		{
+			name:      "exceeds_remaining",
+			n:         7,
+			ok:        false,
+			remaining: 6,
+		},
+		{
+			name:      "exact",
+			n:         6,
+			ok:        true,
+			remaining: 0,
+		},
+		{
+			name:      "empty",
+			n:         1,
+			ok:        false,
+			remaining: 0,
+		},
+	}
+
+	// These cases share a bucket, so they must run in order.
+	for _, tc := range cases {
+		limit, remaining, _, ok, err := takeN(ctx, key, tc.n)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got, want := limit, uint64(10); got != want {
+			t.Errorf("%s: limit: expected %d to be %d", tc.name, got, want)
+		}
+		if got, want := ok, tc.ok; got != want {
+			t.Errorf("%s: ok: expected %t to be %t", tc.name, got, want)
+		}
+		if got, want := remaining, tc.remaining; got != want {
+			t.Errorf("%s: remaining: expected %d to be %d", tc.name, got, want)
+		}
+	}
+}
+
+func TestStore_Refund(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Tokens:        3,
+		Interval:      time.Hour,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := testKey(t)
+	refund := s.(limiter.StoreWithRefund).Refund
+
+	_, _, reset, ok, err := s.Take(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected ok")
+	}
+
+	// Refund in the same tick
+	{
+		if err := refund(ctx, key, 1, reset); err != nil {
+			t.Fatal(err)
+		}
+
+		_, remaining, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := remaining, uint64(3); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	}
+
+	// Refund from a different tick
+	{
+		if _, _, _, _, err := s.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := refund(ctx, key, 1, reset-uint64(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, remaining, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := remaining, uint64(2); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	}
+
+	// Refund a key that does not exist
+	{
+		if err := refund(ctx, testKey(t), 1, reset); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStore_Delete(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Tokens:        2,
+		Interval:      time.Hour,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := testKey(t)
+	del := s.(limiter.StoreWithDelete).Delete
+
+	// Exhaust a bucket with custom limits.
+	if err := s.Set(ctx, key, 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, err := s.Take(ctx, key); err != nil || !ok {
+		t.Fatalf("expected ok, got %t (%v)", ok, err)
+	}
+	if _, _, _, ok, err := s.Take(ctx, key); err != nil || ok {
+		t.Fatalf("expected not ok, got %t (%v)", ok, err)
+	}
+
+	if err := del(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key should be gone entirely.
+	{
+		limit, remaining, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := limit, uint64(0); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+		if got, want := remaining, uint64(0); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	}
+
+	// The next take starts a new bucket with the default limits.
+	{
+		limit, remaining, _, ok, err := s.Take(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("expected ok")
+		}
+		if got, want := limit, uint64(2); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+		if got, want := remaining, uint64(1); got != want {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	}
+
+	// Deleting a key that does not exist is fine.
+	if err := del(ctx, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := del(ctx, key), limiter.ErrStopped; !errors.Is(got, want) {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+}
+
+func TestStore_ClockRewind(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	clock := fakeclock.New(time.Now())
+	s, err := New(&Config{
+		Tokens:        3,
+		Interval:      time.Second,
+		SweepInterval: 24 * time.Hour,
+		SweepMinTTL:   24 * time.Hour,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := testKey(t)
+
+	// Take twice at the start of the first interval.
+	for i := 0; i < 2; i++ {
+		if _, _, _, ok, err := s.Take(ctx, key); err != nil || !ok {
+			t.Fatalf("expected take %d to succeed, got %t, %v", i, ok, err)
+		}
+	}
+
+	// Rewind the clock to before the bucket was created. The bucket rebases onto
+	// the new time, but keeps its remaining tokens.
+	clock.Advance(-time.Hour)
+
+	_, remaining, reset, ok, err := s.Take(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected take to succeed")
+	}
+	if got, want := remaining, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := reset, clock.Now()+uint64(time.Second); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	if _, _, _, ok, err := s.Take(ctx, key); err != nil || ok {
+		t.Fatalf("expected take to fail, got %t, %v", ok, err)
+	}
+
+	// The bucket refills one interval after the new start time.
+	clock.Advance(time.Second - time.Nanosecond)
+	if _, _, _, ok, err := s.Take(ctx, key); err != nil || ok {
+		t.Fatalf("expected take to fail, got %t, %v", ok, err)
+	}
+
+	clock.Advance(time.Nanosecond)
+	if _, remaining, _, ok, err := s.Take(ctx, key); err != nil || !ok || remaining != 2 {
+		t.Fatalf("expected take to succeed with 2 remaining, got %d, %t, %v", remaining, ok, err)
+	}
+}
+
+func TestStore_sweep(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	clock := fakeclock.New(time.Now())
+	s, err := New(&Config{
+		Tokens:       3,
+		Interval:     time.Second,
+		SweepMinTTL:  time.Minute,
+		DisablePurge: true,
+		Clock:        clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, _, _, _, err := s.Take(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(30 * time.Second)
+	if _, _, _, _, err := s.Take(ctx, "fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither key has been inactive for longer than the TTL.
+	st := s.(*store)
+	st.sweep()
+	if limit, _, _ := s.Get(ctx, "stale"); limit == 0 {
+		t.Error("expected stale key to be kept")
+	}
+
+	// Only the stale key has now been inactive for longer than the TTL.
+	clock.Advance(31 * time.Second)
+	st.sweep()
+	if limit, _, _ := s.Get(ctx, "stale"); limit != 0 {
+		t.Error("expected stale key to be purged")
+	}
+	if limit, _, _ := s.Get(ctx, "fresh"); limit == 0 {
+		t.Error("expected fresh key to be kept")
+	}
+
+	// A clock rewind never purges keys.
+	clock.Advance(-time.Hour)
+	st.sweep()
+	if limit, _, _ := s.Get(ctx, "fresh"); limit == 0 {
+		t.Error("expected fresh key to be kept after a rewind")
+	}
+}
+
+func TestBucketedLimiter_tick(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		start    uint64
+		curr     uint64
+		interval time.Duration
+		exp      uint64
+	}{
+		{
+			name:     "no_diff",
+			start:    0,
+			curr:     0,
 			interval: time.Second,
 			exp:      0,
 		},
@@ -398,3 +1025,922 @@ func TestBucketedLimiter_tick(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_shards(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		shards int
+	}{
+		{
+			name:   "single",
+			shards: 1,
+		},
+		{
+			name:   "default",
+			shards: 0,
+		},
+		{
+			name:   "odd",
+			shards: 7,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := New(&Config{
+				Tokens:       2,
+				Interval:     time.Hour,
+				Shards:       tc.shards,
+				DisablePurge: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				if _, remaining, _, ok, err := s.Take(ctx, fmt.Sprintf("key-%d", i)); err != nil || !ok || remaining != 1 {
+					t.Fatalf("expected take to succeed with 1 remaining, got %d, %t, %v", remaining, ok, err)
+				}
+			}
+
+			// Every key lives in exactly one shard, and the keys are spread across all
+			// of the shards.
+			st := s.(*store)
+			var total int
+			for i, sh := range st.shards {
+				if len(st.shards) > 1 && len(sh.data) == 0 {
+					t.Errorf("expected shard %d to have keys", i)
+				}
+				total += len(sh.data)
+			}
+			if got, want := total, keys; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// Keys are found in their shard on subsequent calls.
+			for i := 0; i < keys; i++ {
+				if _, remaining, err := s.Get(ctx, fmt.Sprintf("key-%d", i)); err != nil || remaining != 1 {
+					t.Fatalf("expected 1 remaining, got %d, %v", remaining, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAtomicBucket_equivalence(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		tokens   uint64
+		interval time.Duration
+	}{
+		{
+			name:     "second",
+			tokens:   5,
+			interval: time.Second,
+		},
+		{
+			name:     "nanosecond",
+			tokens:   3,
+			interval: time.Nanosecond,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// splitmix64, so the sequence of operations is deterministic.
+			seed := uint64(42)
+			random := func(n uint64) uint64 {
+				seed += 0x9e3779b97f4a7c15
+				z := seed
+				z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+				z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+				return (z ^ (z >> 31)) % n
+			}
+
+			now := uint64(1 << 40)
+			want := newBucket(now, tc.tokens, tc.interval)
+			got := newAtomicBucket(now, tc.tokens, tc.interval)
+
+			var lastReset uint64
+			for i := 0; i < 10000; i++ {
+				// Mostly move forward within an interval or two, but occasionally jump
+				// far enough to overflow a 32-bit tick, or rewind the clock.
+				switch r := random(100); {
+				case r < 80:
+					now += random(2 * uint64(tc.interval))
+				case r < 85:
+					now += (1 << 32) * uint64(tc.interval)
+				case r < 90:
+					now -= random(now / 2)
+				}
+
+				switch op := random(4); op {
+				case 0:
+					n := random(4)
+					wTokens, wRemaining, wReset, wOK, _ := want.take(now, n)
+					gTokens, gRemaining, gReset, gOK, _ := got.take(now, n)
+					if gTokens != wTokens || gRemaining != wRemaining || gReset != wReset || gOK != wOK {
+						t.Fatalf("op %d: take(%d, %d): expected (%d, %d, %d, %t) to be (%d, %d, %d, %t)",
+							i, now, n, gTokens, gRemaining, gReset, gOK, wTokens, wRemaining, wReset, wOK)
+					}
+					lastReset = wReset
+				case 1:
+					n := random(3)
+					want.burst(now, n)
+					got.burst(now, n)
+				case 2:
+					n := random(3)
+					want.refund(now, n, lastReset)
+					got.refund(now, n, lastReset)
+				case 3:
+					wTokens, wRemaining, _ := want.get(now)
+					gTokens, gRemaining, _ := got.get(now)
+					if gTokens != wTokens || gRemaining != wRemaining {
+						t.Fatalf("op %d: get: expected (%d, %d) to be (%d, %d)", i, gTokens, gRemaining, wTokens, wRemaining)
+					}
+				}
+
+				if g, w := got.lastTime(), want.lastTime(); g != w {
+					t.Fatalf("op %d: lastTime: expected %d to be %d", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestAtomicBucket_burst(t *testing.T) {
+	t.Parallel()
+
+	b := newAtomicBucket(0, maxAtomicTokens-1, time.Second)
+	b.burst(0, 10)
+
+	if _, remaining, _ := b.get(0); remaining != maxAtomicTokens {
+		t.Errorf("expected burst to saturate at %d, got %d", uint64(maxAtomicTokens), remaining)
+	}
+}
+
+func TestStore_LockFree(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	if _, err := New(&Config{LockFree: true, Algorithm: AlgorithmGCRA}); err == nil {
+		t.Error("expected error for lock-free GCRA")
+	}
+	if _, err := New(&Config{LockFree: true, Tokens: maxAtomicTokens + 1}); err == nil {
+		t.Error("expected error for too many tokens")
+	}
+
+	s, err := New(&Config{
+		Tokens:   100,
+		Interval: time.Hour,
+		LockFree: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := s.Set(ctx, "key", maxAtomicTokens+1, time.Hour); err == nil {
+		t.Error("expected error for too many tokens")
+	}
+
+	// Exactly the limit is permitted, however many goroutines take at once.
+	results := make(chan bool, 1000)
+	for i := 0; i < 50; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				_, _, _, ok, err := s.Take(ctx, "key")
+				if err != nil {
+					t.Error(err)
+				}
+				results <- ok
+			}
+		}()
+	}
+
+	var permitted int
+	for i := 0; i < 1000; i++ {
+		if <-results {
+			permitted++
+		}
+	}
+	if got, want := permitted, 100; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_MaxKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	if _, err := New(&Config{MaxKeys: -1}); err == nil {
+		t.Error("expected error for negative max keys")
+	}
+	if _, err := New(&Config{MaxKeys: 1, Eviction: 99}); err == nil {
+		t.Error("expected error for unknown eviction policy")
+	}
+
+	cases := []struct {
+		name     string
+		eviction Eviction
+	}{
+		{
+			name:     "lru",
+			eviction: EvictionLRU,
+		},
+		{
+			name:     "clock",
+			eviction: EvictionCLOCK,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := New(&Config{
+				Tokens:       5,
+				Interval:     time.Hour,
+				Shards:       1,
+				MaxKeys:      3,
+				Eviction:     tc.eviction,
+				DisablePurge: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			for _, key := range []string{"a", "b", "c", "a"} {
+				if _, _, _, ok, err := s.Take(ctx, key); err != nil || !ok {
+					t.Fatalf("expected take %q to succeed, got %t, %v", key, ok, err)
+				}
+			}
+
+			// The store is full, so "b", which is the least recently used, is evicted
+			// to make room for "d".
+			if _, _, _, ok, err := s.Take(ctx, "d"); err != nil || !ok {
+				t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+			}
+
+			for _, tt := range []struct {
+				key       string
+				remaining uint64
+			}{
+				{key: "a", remaining: 3},
+				{key: "b", remaining: 0},
+				{key: "c", remaining: 4},
+				{key: "d", remaining: 4},
+			} {
+				if _, remaining, err := s.Get(ctx, tt.key); err != nil {
+					t.Fatal(err)
+				} else if got, want := remaining, tt.remaining; got != want {
+					t.Errorf("%q: expected %d to be %d", tt.key, got, want)
+				}
+			}
+
+			// Set and Burst evict too.
+			if err := s.Set(ctx, "e", 10, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Burst(ctx, "f", 1); err != nil {
+				t.Fatal(err)
+			}
+
+			stats := s.(StoreWithStats).Stats()
+			if got, want := stats.Keys, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := stats.Evictions, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := stats.Rejections, uint64(0); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// Deleted keys free their slot without an eviction.
+			if err := s.(limiter.StoreWithDelete).Delete(ctx, "e"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, ok, err := s.Take(ctx, "g"); err != nil || !ok {
+				t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+			}
+			if got, want := s.(StoreWithStats).Stats().Evictions, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_MaxKeys_shards(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := New(&Config{
+		Tokens:       1,
+		Interval:     time.Hour,
+		MaxKeys:      100,
+		Eviction:     EvictionCLOCK,
+		DisablePurge: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if _, _, _, ok, err := s.Take(ctx, fmt.Sprintf("key-%d", i)); err != nil || !ok {
+			t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+		}
+	}
+
+	// The limit applies to the whole store, so it holds exactly MaxKeys keys, and
+	// every other key was evicted.
+	stats := s.(StoreWithStats).Stats()
+	if got, want := stats.Keys, uint64(100); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := stats.Evictions, uint64(keys-100); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Fewer keys than shards reduces the number of shards.
+	s2, err := New(&Config{
+		MaxKeys:      3,
+		DisablePurge: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s2.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got, want := len(s2.(*store).shards), 3; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_MaxKeys_threshold(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name          string
+		eviction      Eviction
+		rejectNewKeys bool
+	}{
+		{
+			name:     "lru",
+			eviction: EvictionLRU,
+		},
+		{
+			name:     "clock",
+			eviction: EvictionCLOCK,
+		},
+		{
+			name:          "reject",
+			rejectNewKeys: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The keys are spread unevenly across the default shards, but the limit
+			// applies to the store as a whole.
+			s, err := New(&Config{
+				Tokens:        5,
+				Interval:      time.Hour,
+				MaxKeys:       64,
+				Eviction:      tc.eviction,
+				RejectNewKeys: tc.rejectNewKeys,
+				DisablePurge:  true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := s.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			for i := 0; i < 64; i++ {
+				if _, _, _, ok, err := s.Take(ctx, fmt.Sprintf("key-%d", i)); err != nil || !ok {
+					t.Fatalf("expected take %d to succeed, got %t, %v", i, ok, err)
+				}
+			}
+
+			stats := s.(StoreWithStats).Stats()
+			if got, want := stats.Keys, uint64(64); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := stats.Evictions+stats.Rejections, uint64(0); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// The next new key is the first to be rejected or to evict a key.
+			_, _, _, ok, err := s.Take(ctx, "key-64")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := ok, !tc.rejectNewKeys; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+
+			stats = s.(StoreWithStats).Stats()
+			if got, want := stats.Keys, uint64(64); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := stats.Evictions+stats.Rejections, uint64(1); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if _, remaining, err := s.Get(ctx, "key-64"); err != nil {
+				t.Fatal(err)
+			} else if got, want := remaining, uint64(4); !tc.rejectNewKeys && got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_RejectNewKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+
+	s, err := New(&Config{
+		Tokens:        5,
+		Interval:      time.Minute,
+		Shards:        1,
+		MaxKeys:       2,
+		RejectNewKeys: true,
+		DisablePurge:  true,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, key := range []string{"a", "b"} {
+		if _, _, _, ok, err := s.Take(ctx, key); err != nil || !ok {
+			t.Fatalf("expected take %q to succeed, got %t, %v", key, ok, err)
+		}
+	}
+
+	// The store is full, so the new key is rejected and the existing keys are
+	// left alone.
+	tokens, remaining, reset, ok, err := s.Take(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected take to be rejected")
+	}
+	if got, want := tokens, uint64(5); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := remaining, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := reset, clock.Now()+uint64(time.Minute); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	if _, remaining, _, ok, err := s.Take(ctx, "a"); err != nil || !ok || remaining != 3 {
+		t.Errorf("expected take to succeed with 3 remaining, got %d, %t, %v", remaining, ok, err)
+	}
+
+	stats := s.(StoreWithStats).Stats()
+	if got, want := stats.Keys, uint64(2); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := stats.Evictions, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := stats.Rejections, uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Once a key is deleted, there's room for the new key.
+	if err := s.(limiter.StoreWithDelete).Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, err := s.Take(ctx, "c"); err != nil || !ok {
+		t.Errorf("expected take to succeed, got %t, %v", ok, err)
+	}
+}
+
+func TestClockEvictor(t *testing.T) {
+	t.Parallel()
+
+	e := newClockEvictor()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		e.add(key)
+	}
+
+	// Removing a key moves the last key into its slot.
+	e.remove("b")
+	e.touch("a")
+	e.touch("d")
+
+	// The hand clears the bits for "a" and "d" on the way past, and stops at "c".
+	if victim, ok := e.victim(); !ok || victim != "c" {
+		t.Errorf("expected victim to be c, got %q, %t", victim, ok)
+	}
+	e.remove("c")
+
+	// Every key has now been passed, so the next unreferenced key is chosen.
+	if victim, ok := e.victim(); !ok || victim != "a" {
+		t.Errorf("expected victim to be a, got %q, %t", victim, ok)
+	}
+
+	e.reset()
+	if _, ok := e.victim(); ok {
+		t.Error("expected no victim")
+	}
+}
+
+func TestStore_SnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name            string
+		algorithm       Algorithm
+		lockFree        bool
+		restoreLockFree bool
+		rewind          time.Duration
+	}{
+		{
+			name:      "fixed_window",
+			algorithm: AlgorithmFixedWindow,
+		},
+		{
+			name:      "fixed_window_rewind",
+			algorithm: AlgorithmFixedWindow,
+			rewind:    3 * time.Hour,
+		},
+		{
+			name:            "fixed_window_to_lock_free",
+			algorithm:       AlgorithmFixedWindow,
+			restoreLockFree: true,
+		},
+		{
+			name:      "lock_free_to_fixed_window",
+			algorithm: AlgorithmFixedWindow,
+			lockFree:  true,
+			rewind:    time.Hour,
+		},
+		{
+			name:      "sliding_window_counter",
+			algorithm: AlgorithmSlidingWindowCounter,
+			rewind:    time.Hour,
+		},
+		{
+			name:      "sliding_log",
+			algorithm: AlgorithmSlidingLog,
+			rewind:    time.Hour,
+		},
+		{
+			name:      "gcra",
+			algorithm: AlgorithmGCRA,
+			rewind:    time.Hour,
+		},
+		{
+			name:      "token_bucket",
+			algorithm: AlgorithmTokenBucket,
+			rewind:    time.Hour,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			start := time.Unix(1700000000, 0)
+			clock := fakeclock.New(start)
+
+			newStore := func(clock limiter.Clock, lockFree bool) limiter.Store {
+				s, err := New(&Config{
+					Tokens:       5,
+					Interval:     time.Minute,
+					Algorithm:    tc.algorithm,
+					LockFree:     lockFree,
+					DisablePurge: true,
+					Clock:        clock,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() {
+					if err := s.Close(ctx); err != nil {
+						t.Fatal(err)
+					}
+				})
+				return s
+			}
+
+			s := newStore(clock, tc.lockFree)
+			if err := s.Set(ctx, "custom", 3, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Burst(ctx, "burst", 2); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 4; i++ {
+				for _, key := range []string{"a", "custom", "burst"} {
+					if _, _, _, _, err := s.Take(ctx, key); err != nil {
+						t.Fatal(err)
+					}
+				}
+				clock.Advance(7 * time.Second)
+			}
+
+			var buf bytes.Buffer
+			if err := s.(StoreWithSnapshot).Snapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			// The restored store's clock is behind by the rewind, so every reset is
+			// earlier by the same amount.
+			restoredClock := fakeclock.New(clock.Time().Add(-tc.rewind))
+			restored := newStore(restoredClock, tc.restoreLockFree)
+			if err := restored.(StoreWithSnapshot).Restore(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := restored.(StoreWithStats).Stats().Keys, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// The restored buckets behave exactly like the originals, including
+			// after the interval rolls over.
+			for i := 0; i < 20; i++ {
+				for _, key := range []string{"a", "custom", "burst", "new"} {
+					limit, remaining, err := s.Get(ctx, key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotLimit, gotRemaining, err := restored.Get(ctx, key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if gotLimit != limit || gotRemaining != remaining {
+						t.Errorf("%d: get %q: expected %d, %d to be %d, %d", i, key, gotLimit, gotRemaining, limit, remaining)
+					}
+
+					limit, remaining, reset, ok, err := s.Take(ctx, key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotLimit, gotRemaining, gotReset, gotOK, err := restored.Take(ctx, key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if gotLimit != limit || gotRemaining != remaining || gotOK != ok {
+						t.Errorf("%d: take %q: expected %d, %d, %t to be %d, %d, %t", i, key, gotLimit, gotRemaining, gotOK, limit, remaining, ok)
+					}
+					if got, want := gotReset, reset-uint64(tc.rewind); got != want {
+						t.Errorf("%d: take %q: reset: expected %d to be %d", i, key, got, want)
+					}
+				}
+
+				clock.Advance(11 * time.Second)
+				restoredClock.Advance(11 * time.Second)
+			}
+		})
+	}
+}
+
+func TestStore_Restore_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newStore := func(c *Config) StoreWithSnapshot {
+		c.DisablePurge = true
+		s, err := New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+		return s.(StoreWithSnapshot)
+	}
+
+	s := newStore(&Config{Tokens: 5})
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "big", maxAtomicTokens+1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.String()
+
+	cases := []struct {
+		name     string
+		config   *Config
+		snapshot string
+	}{
+		{
+			name:     "empty",
+			config:   &Config{},
+			snapshot: "",
+		},
+		{
+			name:     "version",
+			config:   &Config{},
+			snapshot: `{"version":2,"time":0}`,
+		},
+		{
+			name:     "malformed",
+			config:   &Config{},
+			snapshot: `{"version":1,"time":0}{"key":`,
+		},
+		{
+			name:     "algorithm",
+			config:   &Config{Algorithm: AlgorithmGCRA},
+			snapshot: snapshot,
+		},
+		{
+			name:     "lock_free_tokens",
+			config:   &Config{LockFree: true},
+			snapshot: snapshot,
+		},
+		{
+			name:     "interval",
+			config:   &Config{},
+			snapshot: `{"version":1,"time":0}{"key":"key","fixed_window":{"interval":0}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newStore(tc.config)
+			if err := s.Restore(strings.NewReader(tc.snapshot)); err == nil {
+				t.Fatal("expected error")
+			}
+
+			// Nothing is restored if any bucket fails.
+			if _, remaining, err := s.Get(ctx, "key"); err != nil {
+				t.Fatal(err)
+			} else if remaining != 0 {
+				t.Errorf("expected key to not be restored, got %d remaining", remaining)
+			}
+		})
+	}
+
+	t.Run("stopped", func(t *testing.T) {
+		t.Parallel()
+
+		s := newStore(&Config{})
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Snapshot(io.Discard); !errors.Is(err, limiter.ErrStopped) {
+			t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+		}
+		if err := s.Restore(strings.NewReader(snapshot)); !errors.Is(err, limiter.ErrStopped) {
+			t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+		}
+	})
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		algorithm Algorithm
+		lockFree  bool
+		maxKeys   int
+		eviction  Eviction
+	}{
+		{
+			name:      "fixed_window",
+			algorithm: AlgorithmFixedWindow,
+		},
+		{
+			name:      "sliding_window_counter",
+			algorithm: AlgorithmSlidingWindowCounter,
+		},
+		{
+			name:      "sliding_log",
+			algorithm: AlgorithmSlidingLog,
+		},
+		{
+			name:      "gcra",
+			algorithm: AlgorithmGCRA,
+		},
+		{
+			name:      "token_bucket",
+			algorithm: AlgorithmTokenBucket,
+		},
+		{
+			name:      "lock_free",
+			algorithm: AlgorithmFixedWindow,
+			lockFree:  true,
+		},
+		{
+			name:      "max_keys_lru",
+			algorithm: AlgorithmFixedWindow,
+			maxKeys:   100,
+			eviction:  EvictionLRU,
+		},
+		{
+			name:      "max_keys_clock",
+			algorithm: AlgorithmFixedWindow,
+			maxKeys:   100,
+			eviction:  EvictionCLOCK,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			limitertest.RunStoreTests(t, func() limiter.Store {
+				s, err := New(&Config{
+					Tokens:    10,
+					Interval:  time.Hour,
+					Algorithm: tc.algorithm,
+					LockFree:  tc.lockFree,
+					MaxKeys:   tc.maxKeys,
+					Eviction:  tc.eviction,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			})
+		})
+	}
+}
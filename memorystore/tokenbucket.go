@@ -0,0 +1,124 @@
+package memorystore
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is the classic token bucket implementation of a taker. Tokens are
+// replenished continuously at a rate of maxTokens per interval, including
+// fractional tokens, up to the bucket's capacity.
+type tokenBucket struct {
+	// capacity is the maximum number of tokens the bucket holds when full. It is
+	// reported as the bucket's limit.
+	capacity uint64
+
+	// rate is the number of tokens added to the bucket per nanosecond.
+	rate float64
+
+	// available is the current point-in-time number of tokens in the bucket,
+	// including fractional tokens.
+	available float64
+
+	// lastRefill is the number of nanoseconds from unix epoch when available was
+	// last updated.
+	lastRefill uint64
+
+	// lock guards the mutable fields.
+	lock sync.RWMutex
+}
+
+// newTokenBucket creates a new, full token bucket which refills at tokens per
+// interval up to capacity.
+func newTokenBucket(now, tokens, capacity uint64, interval time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity:   capacity,
+		rate:       float64(tokens) / float64(interval),
+		available:  float64(capacity),
+		lastRefill: now,
+	}
+}
+
+// refilled returns the number of tokens in the bucket at now. Tokens added by
+// burst may exceed the capacity, but refilling never does.
+func (b *tokenBucket) refilled(now uint64) float64 {
+	if now <= b.lastRefill || b.available >= float64(b.capacity) {
+		return b.available
+	}
+	return math.Min(float64(b.capacity), b.available+float64(now-b.lastRefill)*b.rate)
+}
+
+// get returns information about the bucket.
+func (b *tokenBucket) get(now uint64) (tokens uint64, remaining uint64, retErr error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	tokens = b.capacity
+	remaining = floatToUint(b.refilled(now))
+	return
+}
+
+// take attempts to remove n tokens from the bucket. It returns the capacity,
+// remaining whole tokens, the time at which the next whole token will be
+// available, and whether the take was successful.
+func (b *tokenBucket) take(now, n uint64) (tokens uint64, remaining uint64, reset uint64, ok bool, retErr error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// If the current time is before the last refill, it means the server clock
+	// was reset to an earlier time. In that case, rebase without refilling.
+	b.available = b.refilled(now)
+	b.lastRefill = now
+
+	if b.available >= float64(n) {
+		b.available -= float64(n)
+		ok = true
+	}
+
+	tokens = b.capacity
+	remaining = floatToUint(b.available)
+	reset = now
+	if b.available < float64(b.capacity) && b.rate > 0 {
+		needed := math.Floor(b.available) + 1 - b.available
+		reset = now + floatToUint(math.Ceil(needed/b.rate))
+	}
+	return
+}
+
+// burst adds the specified number of tokens to the bucket. Burst tokens may
+// exceed the capacity, and remain until they are taken.
+func (b *tokenBucket) burst(now, tokens uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.available = b.refilled(now) + float64(tokens)
+	b.lastRefill = max(b.lastRefill, now)
+}
+
+// refund returns tokens to the bucket, up to its capacity.
+func (b *tokenBucket) refund(now, tokens, _ uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	available := b.refilled(now)
+	b.available = math.Max(available, math.Min(float64(b.capacity), available+float64(tokens)))
+	b.lastRefill = max(b.lastRefill, now)
+}
+
+// lastTime returns the last time tokens were taken from the bucket.
+func (b *tokenBucket) lastTime() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.lastRefill
+}
+
+// floatToUint converts a non-negative float to a uint64, truncating any
+// fractional part and saturating at math.MaxUint64.
+func floatToUint(f float64) uint64 {
+	if f >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(f)
+}
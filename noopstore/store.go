@@ -9,7 +9,11 @@ import (
 	"github.com/sethvargo/go-limiter"
 )
 
-var _ limiter.Store = (*store)(nil)
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
 
 type store struct{}
 
@@ -22,6 +26,11 @@ func (s *store) Take(_ context.Context, _ string) (uint64, uint64, uint64, bool,
 	return 0, 0, 0, true, nil
 }
 
+// TakeN always allows the request.
+func (s *store) TakeN(_ context.Context, _ string, _ uint64) (uint64, uint64, uint64, bool, error) {
+	return 0, 0, 0, true, nil
+}
+
 // Get does nothing.
 func (s *store) Get(_ context.Context, _ string) (uint64, uint64, error) {
 	return 0, 0, nil
@@ -37,6 +46,16 @@ func (s *store) Burst(_ context.Context, _ string, _ uint64) error {
 	return nil
 }
 
+// Refund does nothing.
+func (s *store) Refund(_ context.Context, _ string, _, _ uint64) error {
+	return nil
+}
+
+// Delete does nothing.
+func (s *store) Delete(_ context.Context, _ string) error {
+	return nil
+}
+
 // Close does nothing.
 func (s *store) Close(_ context.Context) error {
 	return nil
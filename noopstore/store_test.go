@@ -0,0 +1,20 @@
+package noopstore
+
+import (
+	"testing"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/limitertest"
+)
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		s, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
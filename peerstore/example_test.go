@@ -0,0 +1,45 @@
+package peerstore_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sethvargo/go-limiter/peerstore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Each replica knows its own URL and those of the others, for example from
+	// service discovery.
+	store, err := peerstore.New(&peerstore.Config{
+		Self: "http://10.0.0.1:8080",
+		Peers: []string{
+			"http://10.0.0.1:8080",
+			"http://10.0.0.2:8080",
+			"http://10.0.0.3:8080",
+		},
+		Tokens:   15,
+		Interval: time.Minute,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	// Serve the requests forwarded by the other replicas.
+	mux := http.NewServeMux()
+	mux.Handle("/_limiter/", store)
+	go http.ListenAndServe(":8080", mux)
+
+	// When a replica joins or leaves, update the peers on every replica.
+	store.SetPeers("http://10.0.0.1:8080", "http://10.0.0.2:8080")
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
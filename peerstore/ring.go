@@ -0,0 +1,55 @@
+package peerstore
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring. Each peer is placed on the ring several
+// times, and a key belongs to the first peer at or after the key's hash, so
+// adding or removing a peer only moves the keys next to it.
+type ring struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+// newRing creates a ring with replicas points for each peer. If two points
+// collide, the peer which sorts first owns the point, so the ring does not
+// depend on the order of peers.
+func newRing(replicas int, peers []string) *ring {
+	r := &ring{
+		hashes: make([]uint32, 0, replicas*len(peers)),
+		owners: make(map[uint32]string, replicas*len(peers)),
+	}
+
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			owner, ok := r.owners[h]
+			if !ok {
+				r.hashes = append(r.hashes, h)
+			} else if owner < peer {
+				continue
+			}
+			r.owners[h] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns the peer which owns the key, or the empty string if the ring is
+// empty.
+func (r *ring) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
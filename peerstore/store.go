@@ -0,0 +1,446 @@
+// Package peerstore defines a store which shares limits across a group of
+// peers without an external database, in the style of groupcache.
+//
+// Each key is owned by one peer, chosen by consistent hashing. Operations on a
+// key are forwarded over HTTP to its owner, which applies them to its local
+// store, so every peer sees the same bucket. Each peer must serve the Store as
+// an http.Handler at the configured base path, and should only expose it to the
+// other peers.
+//
+// The peer set can change at any time with SetPeers. Consistent hashing moves
+// only a small share of the keys when a peer joins or leaves, and a moved key
+// starts with a new bucket on its new owner. If a take or get can't connect to
+// the key's owner, it is applied to the local store instead, so that limits
+// degrade to per-peer limits rather than failing; see DisableFallback. Once a
+// request has been sent, the owner may have applied it, so other failures are
+// returned rather than counted twice.
+package peerstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*Store)(nil)
+	_ limiter.StoreWithRefund = (*Store)(nil)
+	_ limiter.StoreWithDelete = (*Store)(nil)
+	_ http.Handler            = (*Store)(nil)
+)
+
+// maxRequestSize is the largest request body a peer accepts.
+const maxRequestSize = 1 << 20
+
+// Operations which can be forwarded to a peer.
+const (
+	opTake   = "take"
+	opGet    = "get"
+	opSet    = "set"
+	opBurst  = "burst"
+	opRefund = "refund"
+	opDelete = "delete"
+)
+
+// errPeerUnavailable is returned when the owning peer can't be reached, or is
+// stopped. errPeerUnreachable is the case where the request was never sent,
+// because the connection to the peer failed.
+var (
+	errPeerUnavailable = errors.New("peer unavailable")
+	errPeerUnreachable = fmt.Errorf("%w: connection failed", errPeerUnavailable)
+)
+
+// Store is a limiter.Store whose keys are spread across a group of peers.
+type Store struct {
+	self     string
+	local    limiter.Store
+	basePath string
+	replicas int
+	client   *http.Client
+	fallback bool
+
+	ring     *ring
+	ringLock sync.RWMutex
+
+	stopped uint32
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Self is the base URL of this peer, such as "http://10.0.0.1:8080", exactly
+	// as it appears in the peer set. This value is required.
+	Self string
+
+	// Peers is the initial set of peers' base URLs. It should include Self;
+	// otherwise this peer owns no keys, and forwards everything. It can be
+	// changed later with SetPeers.
+	Peers []string
+
+	// Local is the store for the keys owned by this peer. Closing the peer store
+	// closes it. The default value is a memorystore with Tokens and Interval.
+	Local limiter.Store
+
+	// Tokens and Interval configure the default local store. They are ignored if
+	// Local is set. The default values are 1 token per second.
+	Tokens   uint64
+	Interval time.Duration
+
+	// BasePath is the path at which peers serve the store. The default value is
+	// "/_limiter/".
+	BasePath string
+
+	// Replicas is the number of points each peer has on the hash ring. More
+	// replicas spread keys more evenly. Every peer must use the same value. The
+	// default value is 50.
+	Replicas int
+
+	// Client is the HTTP client used to forward requests to peers. The default
+	// value is a client with a 5 second timeout.
+	Client *http.Client
+
+	// DisableFallback returns an error when a take or get can't connect to the
+	// key's owner, instead of applying it to the local store. Set, Burst,
+	// Refund, and Delete never fall back, since they would change a local bucket
+	// which the owner does not use.
+	DisableFallback bool
+}
+
+// New creates a peer store.
+func New(c *Config) (*Store, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	if c.Self == "" {
+		return nil, fmt.Errorf("self is required")
+	}
+	self := strings.TrimSuffix(c.Self, "/")
+
+	basePath := "/_limiter/"
+	if c.BasePath != "" {
+		basePath = c.BasePath
+	}
+	if !strings.HasPrefix(basePath, "/") {
+		return nil, fmt.Errorf("base path %q must start with /", basePath)
+	}
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+
+	replicas := 50
+	if c.Replicas > 0 {
+		replicas = c.Replicas
+	}
+
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	local := c.Local
+	if local == nil {
+		var err error
+		local, err = memorystore.New(&memorystore.Config{
+			Tokens:   c.Tokens,
+			Interval: c.Interval,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local store: %w", err)
+		}
+	}
+
+	s := &Store{
+		self:     self,
+		local:    local,
+		basePath: basePath,
+		replicas: replicas,
+		client:   client,
+		fallback: !c.DisableFallback,
+	}
+	s.SetPeers(c.Peers...)
+	return s, nil
+}
+
+// SetPeers replaces the set of peers. Each peer is a base URL, such as
+// "http://10.0.0.1:8080". Every peer should be given the same set.
+func (s *Store) SetPeers(peers ...string) {
+	normalized := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		normalized = append(normalized, strings.TrimSuffix(peer, "/"))
+	}
+	r := newRing(s.replicas, normalized)
+
+	s.ringLock.Lock()
+	s.ring = r
+	s.ringLock.Unlock()
+}
+
+// Take attempts to remove a token from the named key. If the take is
+// successful, it returns true, otherwise false. It also returns the configured
+// limit, remaining tokens, and reset time.
+func (s *Store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN attempts to remove n tokens from the named key. The take is all or
+// nothing - if fewer than n tokens are available, no tokens are removed and the
+// take is unsuccessful. It returns the same values as Take.
+func (s *Store) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
+	resp, err := s.do(ctx, &request{Op: opTake, Key: key, N: n})
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	return resp.Tokens, resp.Remaining, resp.Reset, resp.OK, nil
+}
+
+// Get retrieves the information about the key, if any exists.
+func (s *Store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	resp, err := s.do(ctx, &request{Op: opGet, Key: key})
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Tokens, resp.Remaining, nil
+}
+
+// Set configures the bucket-specific tokens and interval.
+func (s *Store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	_, err := s.do(ctx, &request{Op: opSet, Key: key, N: tokens, Interval: interval})
+	return err
+}
+
+// Burst adds the provided value to the bucket's currently available tokens.
+func (s *Store) Burst(ctx context.Context, key string, tokens uint64) error {
+	_, err := s.do(ctx, &request{Op: opBurst, Key: key, N: tokens})
+	return err
+}
+
+// Refund returns tokens to the bucket at key, provided the bucket is still in
+// the interval that ends at reset.
+func (s *Store) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	_, err := s.do(ctx, &request{Op: opRefund, Key: key, N: tokens, Reset: reset})
+	return err
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, &request{Op: opDelete, Key: key})
+	return err
+}
+
+// Close stops the store and closes the local store. Once closed, the store
+// neither forwards requests nor serves them for other peers.
+func (s *Store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	s.client.CloseIdleConnections()
+	return s.local.Close(ctx)
+}
+
+// ServeHTTP serves the requests forwarded by other peers. Requests are always
+// applied to the local store, even if the peer sets disagree about the owner,
+// so that requests are never forwarded more than once.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, s.basePath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+	req.Op = strings.TrimPrefix(r.URL.Path, s.basePath)
+
+	// If the store is stopped, the caller should treat this peer as gone.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		http.Error(w, limiter.ErrStopped.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	resp, err := s.apply(r.Context(), &req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, limiter.ErrStopped):
+			code = http.StatusServiceUnavailable
+		case errors.Is(err, errUnsupported):
+			code = http.StatusNotImplemented
+		case errors.Is(err, errUnknownOp):
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// request is an operation forwarded to a peer. N is the number of tokens for
+// every operation which takes one.
+type request struct {
+	Op       string        `json:"-"`
+	Key      string        `json:"key"`
+	N        uint64        `json:"n,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Reset    uint64        `json:"reset,omitempty"`
+}
+
+// response is the result of an operation.
+type response struct {
+	Tokens    uint64 `json:"tokens"`
+	Remaining uint64 `json:"remaining"`
+	Reset     uint64 `json:"reset"`
+	OK        bool   `json:"ok"`
+}
+
+// errUnsupported is returned when the local store does not support an
+// operation, and errUnknownOp when the operation does not exist.
+var (
+	errUnsupported = errors.New("operation not supported by store")
+	errUnknownOp   = errors.New("unknown operation")
+)
+
+// do runs the request on the key's owner, or on the local store if this peer
+// owns the key, or the request can fall back and the owner can't be reached.
+func (s *Store) do(ctx context.Context, req *request) (*response, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return nil, limiter.ErrStopped
+	}
+
+	s.ringLock.RLock()
+	owner := s.ring.get(req.Key)
+	s.ringLock.RUnlock()
+
+	if owner == "" || owner == s.self {
+		return s.apply(ctx, req)
+	}
+
+	resp, err := s.forward(ctx, owner, req)
+	if errors.Is(err, errPeerUnreachable) && s.fallback && canFallback(req.Op) && ctx.Err() == nil {
+		return s.apply(ctx, req)
+	}
+	return resp, err
+}
+
+// canFallback reports whether the operation can be applied to the local store
+// when the owner can't be reached.
+func canFallback(op string) bool {
+	switch op {
+	case opTake, opGet:
+		return true
+	}
+	return false
+}
+
+// apply runs the request on the local store.
+func (s *Store) apply(ctx context.Context, req *request) (*response, error) {
+	var resp response
+	var err error
+
+	switch req.Op {
+	case opTake:
+		if req.N == 1 {
+			resp.Tokens, resp.Remaining, resp.Reset, resp.OK, err = s.local.Take(ctx, req.Key)
+			break
+		}
+		st, ok := s.local.(limiter.StoreWithTakeN)
+		if !ok {
+			return nil, fmt.Errorf("take n: %w", errUnsupported)
+		}
+		resp.Tokens, resp.Remaining, resp.Reset, resp.OK, err = st.TakeN(ctx, req.Key, req.N)
+	case opGet:
+		resp.Tokens, resp.Remaining, err = s.local.Get(ctx, req.Key)
+	case opSet:
+		err = s.local.Set(ctx, req.Key, req.N, req.Interval)
+	case opBurst:
+		err = s.local.Burst(ctx, req.Key, req.N)
+	case opRefund:
+		st, ok := s.local.(limiter.StoreWithRefund)
+		if !ok {
+			return nil, fmt.Errorf("refund: %w", errUnsupported)
+		}
+		err = st.Refund(ctx, req.Key, req.N, req.Reset)
+	case opDelete:
+		st, ok := s.local.(limiter.StoreWithDelete)
+		if !ok {
+			return nil, fmt.Errorf("delete: %w", errUnsupported)
+		}
+		err = st.Delete(ctx, req.Key)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnknownOp, req.Op)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// forward sends the request to the peer. It returns errPeerUnavailable if the
+// peer can't be reached, is stopped, or fails without a response, and
+// errPeerUnreachable if the connection to the peer failed before the request
+// was sent.
+func (s *Store) forward(ctx context.Context, peer string, req *request) (*response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+s.basePath+req.Op, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(r)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, fmt.Errorf("%w: %s: %s", errPeerUnreachable, peer, err)
+		}
+		return nil, fmt.Errorf("%w: %s: %s", errPeerUnavailable, peer, err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxRequestSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", errPeerUnavailable, peer, err)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+	case res.StatusCode == http.StatusServiceUnavailable, res.StatusCode == http.StatusBadGateway,
+		res.StatusCode == http.StatusGatewayTimeout:
+		return nil, fmt.Errorf("%w: %s: %s", errPeerUnavailable, peer, strings.TrimSpace(string(b)))
+	default:
+		return nil, fmt.Errorf("peer %s failed to %s: %s", peer, req.Op, strings.TrimSpace(string(b)))
+	}
+
+	var resp response
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from peer %s: %w", peer, err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,497 @@
+package peerstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/limitertest"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// peer is a store served by a test server.
+type peer struct {
+	srv   *httptest.Server
+	store *Store
+	local limiter.Store
+}
+
+// startPeers starts n peers which know about each other. Each peer has its own
+// memorystore with the given tokens and interval. The peers are stopped when
+// the test finishes.
+func startPeers(t testing.TB, n int, tokens uint64, interval time.Duration, c *Config) []*peer {
+	t.Helper()
+
+	peers := make([]*peer, n)
+	urls := make([]string, n)
+	for i := range peers {
+		p := new(peer)
+
+		// The server needs to exist before the store, so that the store knows its
+		// own URL.
+		var ready sync.WaitGroup
+		ready.Add(1)
+		p.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ready.Wait()
+			p.store.ServeHTTP(w, r)
+		}))
+		t.Cleanup(p.srv.Close)
+
+		local, err := memorystore.New(&memorystore.Config{
+			Tokens:   tokens,
+			Interval: interval,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.local = local
+
+		var config Config
+		if c != nil {
+			config = *c
+		}
+		config.Self = p.srv.URL
+		config.Local = local
+
+		if p.store, err = New(&config); err != nil {
+			t.Fatal(err)
+		}
+		ready.Done()
+		t.Cleanup(func() {
+			if err := p.store.Close(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+
+		peers[i] = p
+		urls[i] = p.srv.URL
+	}
+
+	for _, p := range peers {
+		p.store.SetPeers(urls...)
+	}
+	return peers
+}
+
+// owner returns the peer which owns the key.
+func owner(t testing.TB, peers []*peer, key string) *peer {
+	t.Helper()
+
+	s := peers[0].store
+	s.ringLock.RLock()
+	url := s.ring.get(key)
+	s.ringLock.RUnlock()
+
+	for _, p := range peers {
+		if p.srv.URL == url {
+			return p
+		}
+	}
+	t.Fatalf("no owner for %q", key)
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		c    *Config
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "missing_self",
+			c:    &Config{Peers: []string{"http://127.0.0.1:8080"}},
+		},
+		{
+			name: "relative_base_path",
+			c:    &Config{Self: "http://127.0.0.1:8080", BasePath: "limiter/"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := New(tc.c); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestRing(t *testing.T) {
+	t.Parallel()
+
+	if got, want := newRing(50, nil).get("key"), ""; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	peers := []string{"http://a", "http://b", "http://c"}
+	before := newRing(50, peers)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[before.get("key"+strconv.Itoa(i))]++
+	}
+	for _, peer := range peers {
+		if got := counts[peer]; got < 500 || got > 1500 {
+			t.Errorf("expected %s to own about 1000 keys, got %d", peer, got)
+		}
+	}
+
+	// Adding a peer only moves keys to the new peer.
+	after := newRing(50, append(peers, "http://d"))
+
+	var moved int
+	for i := 0; i < 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if b, a := before.get(key), after.get(key); a != b {
+			moved++
+			if a != "http://d" {
+				t.Errorf("expected %q to move to http://d, moved to %s", key, a)
+			}
+		}
+	}
+	if moved < 300 || moved > 1200 {
+		t.Errorf("expected about 750 keys to move, got %d", moved)
+	}
+
+	// The only points of these peers collide, and the same peer owns the point
+	// whatever the order of the peers.
+	a, b := "http://peer29685295", "http://peer32060020"
+	for _, peers := range [][]string{{a, b}, {b, a}} {
+		if got, want := newRing(1, peers).get("key"), a; got != want {
+			t.Errorf("%v: expected %q to be %q", peers, got, want)
+		}
+	}
+}
+
+func TestStore_forwarding(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peers := startPeers(t, 3, 5, time.Hour, nil)
+
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		o := owner(t, peers, key)
+
+		// Every peer takes from the owner's bucket.
+		for j, p := range peers {
+			if _, remaining, _, ok, err := p.store.Take(ctx, key); err != nil {
+				t.Fatal(err)
+			} else if !ok || remaining != uint64(4-j) {
+				t.Errorf("%s: expected take to succeed with %d remaining, got %d, %t", key, 4-j, remaining, ok)
+			}
+		}
+
+		for _, p := range peers {
+			if _, remaining, err := p.local.Get(ctx, key); err != nil {
+				t.Fatal(err)
+			} else if p == o && remaining != 2 {
+				t.Errorf("%s: expected owner to have 2 remaining, got %d", key, remaining)
+			} else if p != o && remaining != 0 {
+				t.Errorf("%s: expected non-owner to have no bucket, got %d", key, remaining)
+			}
+		}
+	}
+}
+
+func TestStore_SetPeers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peers := startPeers(t, 3, 1, time.Hour, nil)
+
+	// Start with two peers, so some keys move when the third joins.
+	for _, p := range peers {
+		p.store.SetPeers(peers[0].srv.URL, peers[1].srv.URL)
+	}
+
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		if _, _, _, ok, err := peers[0].store.Take(ctx, keys[i]); err != nil || !ok {
+			t.Fatalf("%s: expected take to succeed, got %t, %v", keys[i], ok, err)
+		}
+	}
+
+	for _, p := range peers {
+		p.store.SetPeers(peers[0].srv.URL, peers[1].srv.URL, peers[2].srv.URL)
+	}
+
+	// Keys which moved to the new peer start with a new bucket, and the others
+	// keep theirs.
+	var moved int
+	for _, key := range keys {
+		_, _, _, ok, err := peers[1].store.Take(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if owner(t, peers, key) == peers[2] {
+			moved++
+			if !ok {
+				t.Errorf("%s: expected take on new owner to succeed", key)
+			}
+		} else if ok {
+			t.Errorf("%s: expected take on old owner to be rejected", key)
+		}
+	}
+	if moved == 0 || moved == len(keys) {
+		t.Errorf("expected some keys to move, got %d", moved)
+	}
+
+	// A peer which leaves no longer receives requests.
+	for _, p := range peers {
+		p.store.SetPeers(peers[0].srv.URL, peers[1].srv.URL)
+	}
+	peers[2].srv.Close()
+	for _, key := range keys {
+		if _, _, _, _, err := peers[0].store.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStore_fallback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		disabled bool
+	}{
+		{
+			name: "enabled",
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			peers := startPeers(t, 2, 5, time.Hour, &Config{DisableFallback: tc.disabled})
+
+			// Find a key owned by the second peer, then stop it.
+			var key string
+			for i := 0; ; i++ {
+				key = "key" + strconv.Itoa(i)
+				if owner(t, peers, key) == peers[1] {
+					break
+				}
+			}
+			peers[1].srv.Close()
+
+			_, remaining, _, ok, err := peers[0].store.Take(ctx, key)
+			if tc.disabled {
+				if !errors.Is(err, errPeerUnavailable) {
+					t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || remaining != 4 {
+				t.Errorf("expected take to succeed with 4 remaining, got %d, %t", remaining, ok)
+			}
+			// Operations which change the owner's bucket don't fall back, since the
+			// local bucket is not the one the owner uses.
+			if err := peers[0].store.Set(ctx, key, 10, time.Hour); !errors.Is(err, errPeerUnavailable) {
+				t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+			}
+			if err := peers[0].store.Burst(ctx, key, 10); !errors.Is(err, errPeerUnavailable) {
+				t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+			}
+			if err := peers[0].store.Refund(ctx, key, 1, 0); !errors.Is(err, errPeerUnavailable) {
+				t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+			}
+			if err := peers[0].store.Delete(ctx, key); !errors.Is(err, errPeerUnavailable) {
+				t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+			}
+
+			if _, remaining, err := peers[0].local.Get(ctx, key); err != nil || remaining != 4 {
+				t.Errorf("expected local bucket with 4 remaining, got %d, %v", remaining, err)
+			}
+		})
+	}
+}
+
+func TestStore_timeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// The owner receives the request, but does not answer in time.
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	s, err := New(&Config{
+		Self:     "http://self",
+		Peers:    []string{srv.URL},
+		Tokens:   5,
+		Interval: time.Hour,
+		Client:   &http.Client{Timeout: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// The owner may have applied the take, so it is not applied locally too.
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, errPeerUnavailable) {
+		t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+	}
+	if _, remaining, err := s.local.Get(ctx, "key"); err != nil || remaining != 0 {
+		t.Errorf("expected no local bucket, got %d, %v", remaining, err)
+	}
+}
+
+func TestStore_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	peers := startPeers(t, 1, 5, time.Hour, nil)
+	url := peers[0].srv.URL + "/_limiter/"
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{
+			name:   "take",
+			method: http.MethodPost,
+			path:   "take",
+			body:   `{"key":"key","n":2}`,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "method",
+			method: http.MethodGet,
+			path:   "take",
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "invalid_body",
+			method: http.MethodPost,
+			path:   "take",
+			body:   `{`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "unknown_op",
+			method: http.MethodPost,
+			path:   "nope",
+			body:   `{"key":"key"}`,
+			code:   http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(tc.method, url+tc.path, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if got, want := res.StatusCode, tc.code; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peers := startPeers(t, 2, 5, time.Hour, nil)
+
+	if err := peers[1].store.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := peers[1].store.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := peers[1].store.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	// Closing the store closes the local store.
+	if _, _, _, _, err := peers[1].local.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	// Other peers treat a stopped peer as unavailable, and don't fall back, since
+	// the stopped peer answered.
+	for i := 0; ; i++ {
+		key := "key" + strconv.Itoa(i)
+		if owner(t, peers, key) == peers[1] {
+			if _, _, _, _, err := peers[0].store.Take(ctx, key); !errors.Is(err, errPeerUnavailable) {
+				t.Errorf("expected %v to be %v", err, errPeerUnavailable)
+			}
+			break
+		}
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		// Every store is one of its own group of peers, so that most of its keys
+		// are forwarded.
+		peers := startPeers(t, 3, 10, time.Hour, nil)
+		return peers[0].store
+	})
+
+	limitertest.RunSharedStoreTests(t, func(n int) []limiter.Store {
+		peers := startPeers(t, n, 10, time.Hour, nil)
+		stores := make([]limiter.Store, n)
+		for i, p := range peers {
+			stores[i] = p.store
+		}
+		return stores
+	})
+}
@@ -0,0 +1,29 @@
+package redisstore_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/redisstore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	store, err := redisstore.New(&redisstore.Config{
+		Addr:     "127.0.0.1:6379",
+		Tokens:   15,
+		Interval: time.Minute,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
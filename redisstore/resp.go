@@ -0,0 +1,202 @@
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sethvargo/go-limiter/internal/connpool"
+)
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// conn is a single connection to the server, which speaks RESP.
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// newConn wraps the network connection. The timeouts apply to commands whose
+// context has no deadline.
+func newConn(nc net.Conn, readTimeout, writeTimeout time.Duration) *conn {
+	return &conn{
+		nc: nc,
+		br: bufio.NewReader(nc),
+		bw: bufio.NewWriter(nc),
+
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// do sends the command and reads its reply. The context's deadline, if any,
+// applies to both. Otherwise, writing the command and reading the reply each
+// have their own timeout.
+func (c *conn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if err := c.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	if !hasDeadline {
+		if err := c.nc.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	return c.read()
+}
+
+// write writes the command as an array of bulk strings.
+func (c *conn) write(args []string) error {
+	c.bw.WriteByte('*')
+	c.bw.WriteString(strconv.Itoa(len(args)))
+	c.bw.WriteString("\r\n")
+	for _, arg := range args {
+		c.bw.WriteByte('$')
+		c.bw.WriteString(strconv.Itoa(len(arg)))
+		c.bw.WriteString("\r\n")
+		c.bw.WriteString(arg)
+		if _, err := c.bw.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads a single reply. Simple strings and bulk strings are returned as
+// string, integers as int64, and arrays as []interface{}. Error replies are
+// returned as a redisError reply, not an error, so that errors inside an array
+// do not abort reading it. Nil bulk strings and arrays are returned as nil.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", line[0])
+	}
+}
+
+// readLine reads a line terminated by CRLF, without the terminator.
+func (c *conn) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// Close closes the network connection.
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+// dialer returns a function which dials addr and authenticates.
+func dialer(addr, username, password string, db int, timeout, readTimeout, writeTimeout time.Duration) func(ctx context.Context) (*conn, error) {
+	return func(ctx context.Context) (*conn, error) {
+		nc, err := connpool.Dial(ctx, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		c := newConn(nc, readTimeout, writeTimeout)
+
+		var cmds [][]string
+		if password != "" {
+			if username != "" {
+				cmds = append(cmds, []string{"AUTH", username, password})
+			} else {
+				cmds = append(cmds, []string{"AUTH", password})
+			}
+		}
+		if db != 0 {
+			cmds = append(cmds, []string{"SELECT", strconv.Itoa(db)})
+		}
+
+		for _, cmd := range cmds {
+			reply, err := c.do(ctx, cmd...)
+			if err == nil {
+				err = replyErr(reply)
+			}
+			if err != nil {
+				c.Close()
+				return nil, fmt.Errorf("failed to %s: %w", cmd[0], err)
+			}
+		}
+		return c, nil
+	}
+}
+
+// replyErr returns the reply as an error if it is an error reply.
+func replyErr(reply interface{}) error {
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	return nil
+}
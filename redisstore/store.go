@@ -0,0 +1,421 @@
+// Package redisstore defines a store which keeps its buckets in Redis, so that
+// many servers can share the same limits. It speaks the Redis protocol (RESP)
+// directly, using only the standard library, and works with any server which
+// supports hashes and transactions.
+//
+// Each bucket is a hash holding the same state as a memorystore fixed window
+// bucket. Updates are optimistic: the bucket is read under WATCH, updated with
+// MULTI and EXEC, and retried a limited number of times if another client
+// changed it in between, so every take is atomic across all clients.
+//
+// Since the updates are optimistic, a single key which many clients take from
+// at once, such as a global limit, may change during every attempt to update
+// it. Once the retries run out, the take returns an error rather than a
+// decision, so callers should decide whether to admit requests on errors, and
+// such keys may need a larger MaxRetries.
+//
+// Decisions are made with the clients' clocks, which should be synchronized.
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/internal/connpool"
+	"github.com/sethvargo/go-limiter/internal/fixedwindow"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+// Fields of the hash which holds each bucket.
+const (
+	fieldTokens    = "tokens"
+	fieldInterval  = "interval"
+	fieldStart     = "start"
+	fieldTick      = "tick"
+	fieldAvailable = "available"
+)
+
+type store struct {
+	fixedwindow.Store
+
+	ttl    time.Duration
+	prefix string
+
+	pool *connpool.Pool[*conn]
+
+	stopped uint32
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Addr is the host and port of the Redis server. The default value is
+	// "127.0.0.1:6379".
+	Addr string
+
+	// Username and Password are used to authenticate with AUTH, if Password is
+	// set. Username is only needed for Redis ACLs.
+	Username string
+	Password string
+
+	// DB is the database to SELECT. The default value is 0.
+	DB int
+
+	// Tokens is the number of tokens to allow per interval. The default value is
+	// 1.
+	Tokens uint64
+
+	// Interval is the time interval upon which to enforce rate limiting. The
+	// default value is 1 second.
+	Interval time.Duration
+
+	// TTL is how long a bucket is kept after it was last changed. Like the
+	// sweep in memorystore, this should be at least as long as your longest
+	// interval. The default value is 12 hours.
+	TTL time.Duration
+
+	// KeyPrefix is prepended to every key in Redis. The default value is
+	// "limiter:".
+	KeyPrefix string
+
+	// PoolSize is the maximum number of connections to the server. The default
+	// value is 10.
+	PoolSize int
+
+	// DialTimeout is the timeout for connecting to the server. The default value
+	// is 5 seconds.
+	DialTimeout time.Duration
+
+	// ReadTimeout and WriteTimeout are the timeouts for reading a reply and
+	// writing a command, for operations whose context has no deadline. If the
+	// context has a deadline, it applies instead. The default values are 3
+	// seconds.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxRetries is the number of times an update is retried when another client
+	// changes the bucket at the same time. Retries wait for a short, growing,
+	// random time. Once the retries run out, the operation returns an error. A
+	// negative value disables retries. The default value is 10.
+	MaxRetries int
+
+	// Clock is the source of the current time. The default value is the system
+	// clock.
+	Clock limiter.Clock
+}
+
+// New creates a Redis-backed rate limiter that uses the fixed window algorithm.
+// Connections are made lazily, so New does not fail if the server is
+// unavailable.
+func New(c *Config) (limiter.Store, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	addr := "127.0.0.1:6379"
+	if c.Addr != "" {
+		addr = c.Addr
+	}
+
+	tokens := uint64(1)
+	if c.Tokens > 0 {
+		tokens = c.Tokens
+	}
+
+	interval := 1 * time.Second
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	ttl := 12 * time.Hour
+	if c.TTL > 0 {
+		ttl = c.TTL
+	}
+
+	prefix := "limiter:"
+	if c.KeyPrefix != "" {
+		prefix = c.KeyPrefix
+	}
+
+	poolSize := 10
+	if c.PoolSize > 0 {
+		poolSize = c.PoolSize
+	}
+
+	dialTimeout := 5 * time.Second
+	if c.DialTimeout > 0 {
+		dialTimeout = c.DialTimeout
+	}
+
+	readTimeout := 3 * time.Second
+	if c.ReadTimeout > 0 {
+		readTimeout = c.ReadTimeout
+	}
+
+	writeTimeout := 3 * time.Second
+	if c.WriteTimeout > 0 {
+		writeTimeout = c.WriteTimeout
+	}
+
+	maxRetries := 10
+	if c.MaxRetries > 0 {
+		maxRetries = c.MaxRetries
+	} else if c.MaxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	s := &store{
+		ttl:    ttl,
+		prefix: prefix,
+
+		pool: connpool.New(poolSize, dialer(addr, c.Username, c.Password, c.DB, dialTimeout, readTimeout, writeTimeout)),
+	}
+	s.Store = fixedwindow.Store{
+		Backend:    s,
+		Tokens:     tokens,
+		Interval:   interval,
+		MaxRetries: maxRetries,
+		Clock:      clock,
+	}
+	return s, nil
+}
+
+// Get retrieves the information about the key, if any exists.
+func (s *store) Get(ctx context.Context, key string) (tokens, remaining uint64, retErr error) {
+	retErr = s.withConn(ctx, func(c *conn) error {
+		b, exists, err := s.read(ctx, c, s.prefix+key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			tokens, remaining = b.MaxTokens, b.Available
+		}
+		return nil
+	})
+	return
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *store) Delete(ctx context.Context, key string) error {
+	return s.withConn(ctx, func(c *conn) error {
+		reply, err := c.do(ctx, "DEL", s.prefix+key)
+		if err != nil {
+			return err
+		}
+		return replyErr(reply)
+	})
+}
+
+// Close stops the store and closes the connections to the server. It does not
+// delete any buckets.
+func (s *store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	s.pool.Close()
+	return nil
+}
+
+// conn returns a connection from the pool, unless the store is stopped.
+func (s *store) conn(ctx context.Context) (*conn, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return nil, limiter.ErrStopped
+	}
+	return s.pool.Get(ctx)
+}
+
+// withConn runs fn with a connection from the pool. The connection is closed
+// instead of being reused if fn returns an error, since it may be left in the
+// middle of a reply or a transaction.
+func (s *store) withConn(ctx context.Context, fn func(c *conn) error) error {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	s.pool.Put(c, err)
+	return err
+}
+
+// Load watches the bucket at key and reads it. The connection is held until
+// the update ends.
+func (s *store) Load(ctx context.Context, key string) (fixedwindow.Bucket, bool, fixedwindow.Txn, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return fixedwindow.Bucket{}, false, nil, err
+	}
+
+	k := s.prefix + key
+	b, exists, err := s.watch(ctx, c, k)
+	if err != nil {
+		s.pool.Put(c, err)
+		return fixedwindow.Bucket{}, false, nil, err
+	}
+	return b, exists, &txn{store: s, conn: c, key: k}, nil
+}
+
+// watch watches the bucket at key, which must include the prefix, and reads
+// it.
+func (s *store) watch(ctx context.Context, c *conn, key string) (fixedwindow.Bucket, bool, error) {
+	if err := s.expect(ctx, c, "OK", "WATCH", key); err != nil {
+		return fixedwindow.Bucket{}, false, err
+	}
+	return s.read(ctx, c, key)
+}
+
+// txn is an update of a watched bucket.
+type txn struct {
+	store *store
+	conn  *conn
+	key   string
+}
+
+// CompareAndStore writes the bucket with MULTI and EXEC, which writes nothing
+// if the bucket changed since it was watched.
+func (t *txn) CompareAndStore(ctx context.Context, b fixedwindow.Bucket, _ uint64) error {
+	err := t.exec(ctx, b)
+
+	// A conflict leaves the connection ready for the next command.
+	if errors.Is(err, fixedwindow.ErrConflict) {
+		t.store.pool.Put(t.conn, nil)
+	} else {
+		t.store.pool.Put(t.conn, err)
+	}
+	return err
+}
+
+// exec writes the bucket and sets its TTL in a transaction.
+func (t *txn) exec(ctx context.Context, b fixedwindow.Bucket) error {
+	s, c := t.store, t.conn
+
+	if err := s.expect(ctx, c, "OK", "MULTI"); err != nil {
+		return err
+	}
+	if err := s.expect(ctx, c, "QUEUED", "HSET", t.key,
+		fieldTokens, strconv.FormatUint(b.MaxTokens, 10),
+		fieldInterval, strconv.FormatInt(int64(b.Interval), 10),
+		fieldStart, strconv.FormatUint(b.StartTime, 10),
+		fieldTick, strconv.FormatUint(b.LastTick, 10),
+		fieldAvailable, strconv.FormatUint(b.Available, 10),
+	); err != nil {
+		return err
+	}
+	if err := s.expect(ctx, c, "QUEUED", "PEXPIRE", t.key, strconv.FormatInt(s.ttl.Milliseconds(), 10)); err != nil {
+		return err
+	}
+
+	reply, err := c.do(ctx, "EXEC")
+	if err != nil {
+		return err
+	}
+	if err := replyErr(reply); err != nil {
+		return err
+	}
+
+	// A nil reply means a watched key changed, so nothing was written.
+	if reply == nil {
+		return fixedwindow.ErrConflict
+	}
+
+	replies, ok := reply.([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected EXEC reply %v", reply)
+	}
+	for _, r := range replies {
+		if err := replyErr(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort unwatches the bucket.
+func (t *txn) Abort(ctx context.Context) error {
+	err := t.store.expect(ctx, t.conn, "OK", "UNWATCH")
+	t.store.pool.Put(t.conn, err)
+	return err
+}
+
+// read reads the bucket at key, which must include the prefix. It reports
+// whether the bucket exists.
+func (s *store) read(ctx context.Context, c *conn, key string) (fixedwindow.Bucket, bool, error) {
+	reply, err := c.do(ctx, "HMGET", key, fieldTokens, fieldInterval, fieldStart, fieldTick, fieldAvailable)
+	if err != nil {
+		return fixedwindow.Bucket{}, false, err
+	}
+	if err := replyErr(reply); err != nil {
+		return fixedwindow.Bucket{}, false, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 5 {
+		return fixedwindow.Bucket{}, false, fmt.Errorf("unexpected HMGET reply %v", reply)
+	}
+
+	// A bucket which doesn't exist has no fields.
+	if values[0] == nil {
+		return fixedwindow.Bucket{}, false, nil
+	}
+
+	var nums [5]uint64
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			return fixedwindow.Bucket{}, false, fmt.Errorf("bucket %q is missing fields", key)
+		}
+		if i == 1 {
+			n, err := strconv.ParseInt(str, 10, 64)
+			if err != nil || n <= 0 {
+				return fixedwindow.Bucket{}, false, fmt.Errorf("bucket %q has invalid interval %q", key, str)
+			}
+			nums[i] = uint64(n)
+			continue
+		}
+
+		n, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return fixedwindow.Bucket{}, false, fmt.Errorf("bucket %q has invalid field: %w", key, err)
+		}
+		nums[i] = n
+	}
+
+	return fixedwindow.Bucket{
+		MaxTokens: nums[0],
+		Interval:  time.Duration(nums[1]),
+		StartTime: nums[2],
+		LastTick:  nums[3],
+		Available: nums[4],
+	}, true, nil
+}
+
+// expect sends the command and returns an error unless the reply is want.
+func (s *store) expect(ctx context.Context, c *conn, want string, args ...string) error {
+	reply, err := c.do(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if err := replyErr(reply); err != nil {
+		return err
+	}
+	if reply != want {
+		return fmt.Errorf("unexpected %s reply %v", args[0], reply)
+	}
+	return nil
+}
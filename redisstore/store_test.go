@@ -0,0 +1,296 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/internal/fakeredis"
+	"github.com/sethvargo/go-limiter/limitertest"
+)
+
+// startServer starts a fake Redis server, and stops it when the test finishes.
+func startServer(t testing.TB, password string) *fakeredis.Server {
+	t.Helper()
+
+	srv, err := fakeredis.Start(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv
+}
+
+// newStore creates a store, and closes it when the test finishes.
+func newStore(t testing.TB, c *Config) limiter.Store {
+	t.Helper()
+
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return s
+}
+
+func TestStore_TTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t, "")
+
+	s := newStore(t, &Config{
+		Addr:      srv.Addr(),
+		TTL:       time.Minute,
+		KeyPrefix: "test:",
+	})
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.(*store).pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*store).pool.Put(c, nil)
+
+	reply, err := c.do(ctx, "PTTL", "test:key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := reply.(int64); !ok || ttl <= 0 || ttl > time.Minute.Milliseconds() {
+		t.Errorf("expected TTL of at most 1 minute, got %v", reply)
+	}
+}
+
+func TestStore_auth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t, "hunter2")
+
+	cases := []struct {
+		name     string
+		password string
+		err      bool
+	}{
+		{
+			name:     "valid",
+			password: "hunter2",
+		},
+		{
+			name:     "invalid",
+			password: "wrong",
+			err:      true,
+		},
+		{
+			name: "missing",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newStore(t, &Config{
+				Addr:     srv.Addr(),
+				Password: tc.password,
+				DB:       2,
+			})
+
+			_, _, _, _, err := s.Take(ctx, "key")
+			if got, want := err != nil, tc.err; got != want {
+				t.Errorf("expected error to be %t, got %v", want, err)
+			}
+		})
+	}
+}
+
+func TestStore_unavailable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t, "")
+	addr := srv.Addr()
+
+	s := newStore(t, &Config{
+		Addr:        addr,
+		DialTimeout: time.Second,
+	})
+	if _, _, _, _, err := s.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the server is gone, every operation fails instead of hanging, and
+	// the broken connection is not reused.
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+	}
+}
+
+func TestStore_maxRetries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name       string
+		maxRetries int
+		attempts   int
+	}{
+		{
+			name:       "retries",
+			maxRetries: 2,
+			attempts:   3,
+		},
+		{
+			name:       "disabled",
+			maxRetries: -1,
+			attempts:   1,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := startServer(t, "")
+			s := newStore(t, &Config{
+				Addr:       srv.Addr(),
+				MaxRetries: tc.maxRetries,
+			})
+
+			// An update which keeps conflicting gives up instead of retrying
+			// forever.
+			srv.AbortExec(true)
+			if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+				t.Error("expected error")
+			}
+			if got, want := srv.Aborted(), tc.attempts; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			srv.AbortExec(false)
+			if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+				t.Errorf("expected take to succeed, got %t, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStore_readTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// The server accepts connections, but never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	s := newStore(t, &Config{
+		Addr:        ln.Addr().String(),
+		ReadTimeout: 50 * time.Millisecond,
+	})
+
+	// Without a deadline on the context, the read timeout applies.
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestStore_invalidBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := startServer(t, "")
+
+	s := newStore(t, &Config{
+		Addr: srv.Addr(),
+	})
+
+	c, err := s.(*store).pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.do(ctx, "HSET", "limiter:key", fieldTokens, "10", fieldInterval, "nope"); err != nil {
+		t.Fatal(err)
+	}
+	s.(*store).pool.Put(c, nil)
+
+	if _, _, err := s.Get(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	srv := startServer(t, "")
+
+	var lock sync.Mutex
+	var n int
+
+	// Every group of stores needs its own keys.
+	newStores := func(count int) []limiter.Store {
+		lock.Lock()
+		n++
+		prefix := "conformance:" + strconv.Itoa(n) + ":"
+		lock.Unlock()
+
+		stores := make([]limiter.Store, count)
+		for i := range stores {
+			s, err := New(&Config{
+				Addr:      srv.Addr(),
+				Tokens:    10,
+				Interval:  time.Hour,
+				KeyPrefix: prefix,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores[i] = s
+		}
+		return stores
+	}
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		return newStores(1)[0]
+	})
+	limitertest.RunSharedStoreTests(t, newStores)
+}
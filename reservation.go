@@ -0,0 +1,77 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Reservation is the result of taking tokens from a store with the option to
+// give them back later. Reservations are useful when the tokens must be taken
+// before expensive work begins, but the work may be aborted (for example, if
+// upstream validation fails) and should not count against the limit.
+type Reservation struct {
+	// Tokens, Remaining, Reset, and OK are the values returned by the take. See
+	// Store.Take for their meaning. If OK is false, no tokens were taken and
+	// Cancel does nothing.
+	Tokens    uint64
+	Remaining uint64
+	Reset     uint64
+	OK        bool
+
+	store StoreWithRefund
+	key   string
+	n     uint64
+
+	canceled uint32
+}
+
+// Reserve takes a token from the given key and returns a reservation which can
+// be canceled to return the token. The store must implement StoreWithRefund.
+//
+// Callers must check the reservation's OK field to determine whether the take
+// was successful.
+func Reserve(ctx context.Context, s Store, key string) (*Reservation, error) {
+	return ReserveN(ctx, s, key, 1)
+}
+
+// ReserveN is like Reserve, but takes n tokens at once. The store must also
+// implement StoreWithTakeN, unless n is 1.
+func ReserveN(ctx context.Context, s Store, key string, n uint64) (*Reservation, error) {
+	rs, ok := s.(StoreWithRefund)
+	if !ok {
+		return nil, fmt.Errorf("store does not support refunds: %w", errors.ErrUnsupported)
+	}
+
+	tokens, remaining, reset, ok, err := TakeN(ctx, s, key, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reservation{
+		Tokens:    tokens,
+		Remaining: remaining,
+		Reset:     reset,
+		OK:        ok,
+
+		store: rs,
+		key:   key,
+		n:     n,
+	}, nil
+}
+
+// Cancel returns the reserved tokens to the store. Tokens are only restored if
+// the bucket is still in the same interval as when they were taken; after the
+// bucket resets, there is nothing to give back. Cancel is safe to call more
+// than once, but only the first call has any effect.
+func (r *Reservation) Cancel(ctx context.Context) error {
+	if !r.OK {
+		return nil
+	}
+
+	if !atomic.CompareAndSwapUint32(&r.canceled, 0, 1) {
+		return nil
+	}
+	return r.store.Refund(ctx, r.key, r.n, r.Reset)
+}
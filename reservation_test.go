@@ -0,0 +1,123 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+	"github.com/sethvargo/go-limiter/noopstore"
+)
+
+func TestReserve(t *testing.T) {
+	t.Parallel()
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   2,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		r, err := limiter.Reserve(ctx, s, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.OK {
+			t.Fatal("expected ok")
+		}
+		if got, want := r.Remaining, uint64(1); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+
+		// Canceling more than once only refunds once.
+		for i := 0; i < 2; i++ {
+			if err := r.Cancel(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, remaining, err := s.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := remaining, uint64(2); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	})
+
+	t.Run("cancel_unsuccessful", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   5,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if _, err := limiter.ReserveN(ctx, s, "key", 4); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := limiter.ReserveN(ctx, s, "key", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.OK {
+			t.Fatal("expected reservation to be rejected")
+		}
+
+		// Nothing was taken, so nothing should be given back.
+		if err := r.Cancel(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		_, remaining, err := s.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := remaining, uint64(1); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := noopstore.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := limiter.Reserve(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, got := limiter.Reserve(ctx, &takeOnlyStore{s}, "key"); !errors.Is(got, errors.ErrUnsupported) {
+			t.Errorf("expected %v to be %v", got, errors.ErrUnsupported)
+		}
+	})
+}
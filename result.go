@@ -0,0 +1,60 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Result is the outcome of a take, as returned by Allow and AllowN. It carries
+// the same information as the values returned by Store.Take, with the reset
+// time converted to a time.Time.
+type Result struct {
+	// Limit is the configured limit for the key.
+	Limit uint64
+
+	// Remaining is the number of tokens remaining for the key.
+	Remaining uint64
+
+	// ResetAt is the time at which new tokens will be available.
+	ResetAt time.Time
+
+	// RetryAfter is how long the caller should wait before trying again. It is
+	// zero if the take was allowed.
+	RetryAfter time.Duration
+
+	// Allowed is true if the take was successful. If it is false, the caller
+	// should NOT service the request.
+	Allowed bool
+}
+
+// Allow takes a token from the given key and returns the outcome as a Result.
+// It works with any Store.
+func Allow(ctx context.Context, s Store, key string) (Result, error) {
+	return AllowN(ctx, s, key, 1)
+}
+
+// AllowN is like Allow, but takes n tokens at once. The store must implement
+// StoreWithTakeN, unless n is 1.
+func AllowN(ctx context.Context, s Store, key string, n uint64) (Result, error) {
+	tokens, remaining, reset, ok, err := TakeN(ctx, s, key, n)
+	if err != nil {
+		return Result{}, err
+	}
+	return NewResult(tokens, remaining, reset, ok, time.Now()), nil
+}
+
+// NewResult builds a Result from the values returned by Store.Take, as of the
+// given time. It is useful for stores and wrappers which call Take directly.
+func NewResult(tokens, remaining, reset uint64, ok bool, now time.Time) Result {
+	r := Result{
+		Limit:     tokens,
+		Remaining: remaining,
+		ResetAt:   time.Unix(0, int64(reset)),
+		Allowed:   ok,
+	}
+
+	if !ok {
+		r.RetryAfter = max(r.ResetAt.Sub(now), 0)
+	}
+	return r
+}
@@ -0,0 +1,123 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store, err := memorystore.New(&memorystore.Config{
+		Tokens:   1,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	result, err := limiter.Allow(ctx, store, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Fatal("expected take to be allowed")
+	}
+	if got, want := result.Limit, uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := result.Remaining, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := result.RetryAfter, time.Duration(0); got != want {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+	if until := time.Until(result.ResetAt); until <= 0 || until > time.Hour {
+		t.Errorf("expected reset to be within the hour, got %s", until)
+	}
+
+	result, err = limiter.Allow(ctx, store, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatal("expected take to be rejected")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Hour {
+		t.Errorf("expected retry after to be within the hour, got %s", result.RetryAfter)
+	}
+
+	// Weighted takes require StoreWithTakeN.
+	if _, err := limiter.AllowN(ctx, &takeOnlyStore{store}, "key", 2); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected %v to be %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestNewResult(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(100, 0)
+
+	cases := []struct {
+		name       string
+		reset      time.Time
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{
+			name:       "allowed",
+			reset:      now.Add(time.Second),
+			ok:         true,
+			retryAfter: 0,
+		},
+		{
+			name:       "rejected",
+			reset:      now.Add(time.Second),
+			ok:         false,
+			retryAfter: time.Second,
+		},
+		{
+			name:       "rejected_past_reset",
+			reset:      now.Add(-time.Second),
+			ok:         false,
+			retryAfter: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			result := limiter.NewResult(5, 3, uint64(tc.reset.UnixNano()), tc.ok, now)
+			if got, want := result.Limit, uint64(5); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := result.Remaining, uint64(3); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := result.ResetAt, tc.reset; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+			if got, want := result.Allowed, tc.ok; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+			if got, want := result.RetryAfter, tc.retryAfter; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ErrQueueFull is the error returned by WaitShaped when the key's queue has no
+// room for another request.
+var ErrQueueFull = fmt.Errorf("queue is full")
+
+// Shaper is an interface for limiters which shape traffic instead of rejecting
+// it. Rather than refusing requests which exceed the rate, a Shaper tells the
+// caller how long to wait so that requests proceed at a constant rate. Requests
+// are only rejected once too many are already waiting.
+//
+// See the note about keys on the Store interface documentation.
+type Shaper interface {
+	// Delay reserves the next slot for the given key, returning:
+	//
+	// - how long the caller must wait before proceeding
+	// - whether a slot was reserved
+	// - any errors that occurred - these should be backend errors
+	//
+	// If "ok" is false, the queue is full, no slot was reserved, and the delay is
+	// the time until a slot may become available. The caller should NOT service
+	// the request.
+	//
+	// Once a slot is reserved, it is consumed whether or not the caller waits for
+	// it.
+	Delay(ctx context.Context, key string) (delay time.Duration, ok bool, err error)
+
+	// Close terminates the shaper and cleans up any data structures or
+	// connections that may remain open. After a shaper is stopped, Delay() should
+	// always return ErrStopped.
+	Close(ctx context.Context) error
+}
+
+// WaitShaped reserves a slot for the key and blocks until it arrives. It returns
+// ErrQueueFull if the key's queue is full, and the context's error if the
+// context is canceled before the slot arrives.
+func WaitShaped(ctx context.Context, s Shaper, key string) error {
+	delay, ok, err := s.Delay(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrQueueFull
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
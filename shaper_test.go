@@ -0,0 +1,49 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/leakybucket"
+)
+
+func TestWaitShaped(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s, err := leakybucket.New(&leakybucket.Config{
+		Rate:     20,
+		Interval: time.Second,
+		MaxQueue: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := limiter.WaitShaped(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := time.Since(start), 40*time.Millisecond; got < want {
+		t.Errorf("expected second request to wait at least %s, waited %s", want, got)
+	}
+
+	// Fill the queue.
+	if _, ok, err := s.Delay(ctx, "key"); err != nil || !ok {
+		t.Fatalf("expected slot, got %t (%v)", ok, err)
+	}
+	if got, want := limiter.WaitShaped(ctx, s, "key"), limiter.ErrQueueFull; !errors.Is(got, want) {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/sqlstore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	// Open the database with any driver, for example github.com/lib/pq.
+	db, err := sql.Open("postgres", "postgres://localhost/myapp")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	config := &sqlstore.Config{
+		Dialect:  sqlstore.DialectPostgres,
+		Tokens:   15,
+		Interval: time.Minute,
+	}
+
+	// Create the table, if it does not already exist.
+	if err := sqlstore.Migrate(ctx, db, config); err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := sqlstore.New(db, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
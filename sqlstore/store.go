@@ -0,0 +1,554 @@
+// Package sqlstore defines a store which keeps its buckets in a SQL database
+// via database/sql, so that services which already run Postgres, MySQL, or
+// SQLite can share limits without running Redis.
+//
+// Each bucket is a row holding the same state as a memorystore fixed window
+// bucket. Every update runs in a transaction which locks the row (with SELECT
+// ... FOR UPDATE on Postgres and MySQL, and the database lock on SQLite), so
+// takes are atomic across all clients. New rows are created with an upsert
+// which ignores conflicts, and the update is retried if another client created
+// the row first, or if SQLite reports that the database is locked, up to
+// MaxRetries times.
+//
+// Keys are stored with a prefix: "k:" followed by the key, or, for keys which
+// would not fit in the 255 byte MySQL key column, "h:" followed by the key's
+// SHA-256 hash, in every dialect. A key can't collide with the hash of another.
+// On MySQL, the connection must
+// not set clientFoundRows, which would report a conflicting insert as a
+// success.
+//
+// The table can be created with Migrate. Decisions are made with the clients'
+// clocks, which should be synchronized.
+package sqlstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/internal/fixedwindow"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+// Dialect is the SQL variant spoken by the database.
+type Dialect uint8
+
+const (
+	// DialectPostgres is PostgreSQL, and compatible databases such as
+	// CockroachDB.
+	DialectPostgres Dialect = iota + 1
+
+	// DialectMySQL is MySQL or MariaDB.
+	DialectMySQL
+
+	// DialectSQLite is SQLite.
+	DialectSQLite
+)
+
+const (
+	// maxKeyLength is the length of the MySQL key column, which stored keys must
+	// fit in.
+	maxKeyLength = 255
+
+	// rawKeyPrefix marks keys which are stored as they are, and hashedKeyPrefix
+	// marks keys which were hashed because they were too long.
+	rawKeyPrefix    = "k:"
+	hashedKeyPrefix = "h:"
+)
+
+// tableRe matches a table name, which may be qualified with a schema. Table
+// names are interpolated into the queries, so nothing else is permitted.
+var tableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+type store struct {
+	fixedwindow.Store
+
+	db      *sql.DB
+	clock   limiter.Clock
+	queries *queries
+	dialect Dialect
+
+	sweepInterval time.Duration
+	sweepMinTTL   uint64
+
+	stopped uint32
+	stopCh  chan struct{}
+}
+
+// Config is used as input to New and Migrate. It defines the behavior of the
+// store.
+type Config struct {
+	// Dialect is the SQL variant spoken by the database. This value is required.
+	Dialect Dialect
+
+	// Table is the name of the table which holds the buckets. It may be qualified
+	// with a schema. The default value is "limiter_buckets".
+	Table string
+
+	// Tokens is the number of tokens to allow per interval. The default value is
+	// 1.
+	Tokens uint64
+
+	// Interval is the time interval upon which to enforce rate limiting. The
+	// default value is 1 second.
+	Interval time.Duration
+
+	// SweepInterval is the rate at which to delete stale rows. The default value
+	// is 6 hours.
+	SweepInterval time.Duration
+
+	// SweepMinTTL is the minimum amount of time a row must be unchanged before it
+	// is deleted. Like memorystore, this should be at least as high as your
+	// longest interval. The default value is 12 hours.
+	SweepMinTTL time.Duration
+
+	// DisablePurge disables deleting stale rows, for example because another
+	// process deletes them. WARNING: without it, the table grows without bound.
+	DisablePurge bool
+
+	// MaxRetries is the number of times an update is retried when another
+	// client created the bucket first, or the database is locked, before giving
+	// up with an error. A negative value disables retries. The default value is
+	// 10.
+	MaxRetries int
+
+	// Clock is the source of the current time. The default value is the system
+	// clock.
+	Clock limiter.Clock
+}
+
+// New creates a rate limiter backed by the database, which uses the fixed
+// window algorithm. The table must already exist; see Migrate. Closing the
+// store does not close the database.
+func New(db *sql.DB, c *Config) (limiter.Store, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database cannot be nil")
+	}
+	if c == nil {
+		c = new(Config)
+	}
+
+	q, err := newQueries(c)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := uint64(1)
+	if c.Tokens > 0 {
+		tokens = c.Tokens
+	}
+
+	interval := 1 * time.Second
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	sweepInterval := 6 * time.Hour
+	if c.SweepInterval > 0 {
+		sweepInterval = c.SweepInterval
+	}
+
+	sweepMinTTL := 12 * time.Hour
+	if c.SweepMinTTL > 0 {
+		sweepMinTTL = c.SweepMinTTL
+	}
+
+	maxRetries := 10
+	if c.MaxRetries > 0 {
+		maxRetries = c.MaxRetries
+	} else if c.MaxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	s := &store{
+		db:      db,
+		clock:   clock,
+		queries: q,
+		dialect: c.Dialect,
+
+		sweepInterval: sweepInterval,
+		sweepMinTTL:   uint64(sweepMinTTL),
+
+		stopCh: make(chan struct{}),
+	}
+	s.Store = fixedwindow.Store{
+		Backend:    s,
+		Tokens:     tokens,
+		Interval:   interval,
+		MaxRetries: maxRetries,
+		Clock:      clock,
+	}
+
+	if !c.DisablePurge {
+		go s.purge()
+	}
+
+	return s, nil
+}
+
+// Migrate creates the table and its index, if they do not already exist. Only
+// the Dialect and Table fields of the config are used.
+func Migrate(ctx context.Context, db *sql.DB, c *Config) error {
+	if db == nil {
+		return fmt.Errorf("database cannot be nil")
+	}
+	if c == nil {
+		c = new(Config)
+	}
+
+	q, err := newQueries(c)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range q.migrate {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get retrieves the information about the key, if any exists.
+func (s *store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, limiter.ErrStopped
+	}
+
+	var tokens, available int64
+	if err := s.db.QueryRowContext(ctx, s.queries.get, rowKey(key)).Scan(&tokens, &available); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("failed to get bucket: %w", err)
+	}
+	return uint64(tokens), uint64(available), nil
+}
+
+// Delete removes the bucket for the key, if one exists.
+func (s *store) Delete(ctx context.Context, key string) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if _, err := s.db.ExecContext(ctx, s.queries.delete, rowKey(key)); err != nil {
+		return fmt.Errorf("failed to delete bucket: %w", err)
+	}
+	return nil
+}
+
+// Close stops the store and the purge. It does not close the database or
+// delete any rows.
+func (s *store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	// Close the channel to prevent future purging.
+	close(s.stopCh)
+	return nil
+}
+
+// Load reads the bucket at key in a transaction, which locks its row on
+// Postgres and MySQL.
+func (s *store) Load(ctx context.Context, key string) (fixedwindow.Bucket, bool, fixedwindow.Txn, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return fixedwindow.Bucket{}, false, nil, limiter.ErrStopped
+	}
+
+	k := rowKey(key)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fixedwindow.Bucket{}, false, nil, s.conflict(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+
+	var tokens, interval, startTime, lastTick, available int64
+	if err := tx.QueryRowContext(ctx, s.queries.selectForUpdate, k).
+		Scan(&tokens, &interval, &startTime, &lastTick, &available); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			return fixedwindow.Bucket{}, false, nil, s.conflict(fmt.Errorf("failed to read bucket: %w", err))
+		}
+		return fixedwindow.Bucket{}, false, &txn{store: s, tx: tx, key: k}, nil
+	}
+
+	if interval <= 0 {
+		tx.Rollback()
+		return fixedwindow.Bucket{}, false, nil, fmt.Errorf("bucket %q has invalid interval %d", key, interval)
+	}
+
+	b := fixedwindow.Bucket{
+		MaxTokens: uint64(tokens),
+		Interval:  time.Duration(interval),
+		StartTime: uint64(startTime),
+		LastTick:  uint64(lastTick),
+		Available: uint64(available),
+	}
+	return b, true, &txn{store: s, tx: tx, key: k, exists: true}, nil
+}
+
+// conflict returns fixedwindow.ErrConflict instead of SQLite's "database is
+// locked", which it returns instead of waiting when a transaction which has
+// read can't take the write lock, so that the update is retried.
+func (s *store) conflict(err error) error {
+	if s.dialect != DialectSQLite {
+		return err
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "database is locked") || strings.Contains(msg, "SQLITE_BUSY") {
+		return fmt.Errorf("%w: %s", fixedwindow.ErrConflict, msg)
+	}
+	return err
+}
+
+// txn is an update of a bucket which was read in a transaction.
+type txn struct {
+	store  *store
+	tx     *sql.Tx
+	key    string
+	exists bool
+}
+
+// CompareAndStore writes the bucket and commits the transaction. If the bucket
+// did not exist and another client created it first, nothing is written.
+func (t *txn) CompareAndStore(ctx context.Context, b fixedwindow.Bucket, now uint64) error {
+	defer t.tx.Rollback()
+
+	if err := t.write(ctx, b, now); err != nil {
+		return t.store.conflict(err)
+	}
+	if err := t.tx.Commit(); err != nil {
+		return t.store.conflict(fmt.Errorf("failed to commit transaction: %w", err))
+	}
+	return nil
+}
+
+// write updates the bucket's row, or inserts it if it did not exist.
+func (t *txn) write(ctx context.Context, b fixedwindow.Bucket, now uint64) error {
+	args := []interface{}{
+		toInt64(b.MaxTokens),
+		int64(b.Interval),
+		toInt64(b.StartTime),
+		toInt64(b.LastTick),
+		toInt64(b.Available),
+		toInt64(now),
+		t.key,
+	}
+
+	if t.exists {
+		if _, err := t.tx.ExecContext(ctx, t.store.queries.update, args...); err != nil {
+			return fmt.Errorf("failed to update bucket: %w", err)
+		}
+		return nil
+	}
+
+	// The key goes first in the insert.
+	args = append([]interface{}{t.key}, args[:len(args)-1]...)
+	result, err := t.tx.ExecContext(ctx, t.store.queries.insert, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	// Another client created the bucket since it was read, so start again with
+	// their bucket.
+	if n == 0 {
+		return fixedwindow.ErrConflict
+	}
+	return nil
+}
+
+// Abort commits the transaction, which changed nothing.
+func (t *txn) Abort(_ context.Context) error {
+	if err := t.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// purge continually deletes the rows which have not changed for SweepMinTTL on
+// the sweep interval.
+func (s *store) purge() {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		// A failed sweep is retried on the next tick.
+		_ = s.sweep(context.Background())
+	}
+}
+
+// sweep deletes the rows which have not changed for longer than the minimum
+// TTL.
+func (s *store) sweep(ctx context.Context) error {
+	now := s.clock.Now()
+	if now < s.sweepMinTTL {
+		return nil
+	}
+
+	if _, err := s.db.ExecContext(ctx, s.queries.sweep, toInt64(now-s.sweepMinTTL)); err != nil {
+		return fmt.Errorf("failed to delete stale buckets: %w", err)
+	}
+	return nil
+}
+
+// queries are the statements for a dialect and table.
+type queries struct {
+	migrate         []string
+	get             string
+	selectForUpdate string
+	insert          string
+	update          string
+	delete          string
+	sweep           string
+}
+
+// newQueries builds the statements for the config's dialect and table.
+func newQueries(c *Config) (*queries, error) {
+	table := "limiter_buckets"
+	if c.Table != "" {
+		table = c.Table
+	}
+	if !tableRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+
+	// Indexes are created in the table's schema, so they can't be qualified.
+	index := table[strings.LastIndex(table, ".")+1:] + "_updated_at_idx"
+
+	const columns = "tokens, interval_ns, start_time, last_tick, available"
+
+	var q *queries
+	switch c.Dialect {
+	case DialectPostgres:
+		q = &queries{
+			migrate: []string{
+				"CREATE TABLE IF NOT EXISTS " + table + " (" +
+					"bucket_key TEXT PRIMARY KEY, " +
+					"tokens BIGINT NOT NULL, " +
+					"interval_ns BIGINT NOT NULL, " +
+					"start_time BIGINT NOT NULL, " +
+					"last_tick BIGINT NOT NULL, " +
+					"available BIGINT NOT NULL, " +
+					"updated_at BIGINT NOT NULL)",
+				"CREATE INDEX IF NOT EXISTS " + index + " ON " + table + " (updated_at)",
+			},
+			get:             "SELECT tokens, available FROM " + table + " WHERE bucket_key = $1",
+			selectForUpdate: "SELECT " + columns + " FROM " + table + " WHERE bucket_key = $1 FOR UPDATE",
+			insert: "INSERT INTO " + table + " (bucket_key, " + columns + ", updated_at) " +
+				"VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (bucket_key) DO NOTHING",
+			update: "UPDATE " + table + " SET tokens = $1, interval_ns = $2, start_time = $3, " +
+				"last_tick = $4, available = $5, updated_at = $6 WHERE bucket_key = $7",
+			delete: "DELETE FROM " + table + " WHERE bucket_key = $1",
+			sweep:  "DELETE FROM " + table + " WHERE updated_at < $1",
+		}
+
+	case DialectMySQL, DialectSQLite:
+		q = &queries{
+			get:             "SELECT tokens, available FROM " + table + " WHERE bucket_key = ?",
+			selectForUpdate: "SELECT " + columns + " FROM " + table + " WHERE bucket_key = ?",
+			insert: " INTO " + table + " (bucket_key, " + columns + ", updated_at) " +
+				"VALUES (?, ?, ?, ?, ?, ?, ?)",
+			update: "UPDATE " + table + " SET tokens = ?, interval_ns = ?, start_time = ?, " +
+				"last_tick = ?, available = ?, updated_at = ? WHERE bucket_key = ?",
+			delete: "DELETE FROM " + table + " WHERE bucket_key = ?",
+			sweep:  "DELETE FROM " + table + " WHERE updated_at < ?",
+		}
+
+		if c.Dialect == DialectMySQL {
+			// Text columns can't be primary keys in MySQL, and it has no CREATE INDEX
+			// IF NOT EXISTS, so the index is created with the table.
+			q.migrate = []string{
+				"CREATE TABLE IF NOT EXISTS " + table + " (" +
+					"bucket_key VARCHAR(255) PRIMARY KEY, " +
+					"tokens BIGINT NOT NULL, " +
+					"interval_ns BIGINT NOT NULL, " +
+					"start_time BIGINT NOT NULL, " +
+					"last_tick BIGINT NOT NULL, " +
+					"available BIGINT NOT NULL, " +
+					"updated_at BIGINT NOT NULL, " +
+					"INDEX " + index + " (updated_at))",
+			}
+			// INSERT IGNORE would also turn errors such as truncated keys into
+			// warnings, so conflicts are ignored with an update which changes
+			// nothing, and affects no rows.
+			q.selectForUpdate += " FOR UPDATE"
+			q.insert = "INSERT" + q.insert + " ON DUPLICATE KEY UPDATE bucket_key = bucket_key"
+		} else {
+			// SQLite has no row locks. Its transactions hold the database lock
+			// instead.
+			q.migrate = []string{
+				"CREATE TABLE IF NOT EXISTS " + table + " (" +
+					"bucket_key TEXT PRIMARY KEY, " +
+					"tokens INTEGER NOT NULL, " +
+					"interval_ns INTEGER NOT NULL, " +
+					"start_time INTEGER NOT NULL, " +
+					"last_tick INTEGER NOT NULL, " +
+					"available INTEGER NOT NULL, " +
+					"updated_at INTEGER NOT NULL)",
+				"CREATE INDEX IF NOT EXISTS " + index + " ON " + table + " (updated_at)",
+			}
+			q.insert = "INSERT OR IGNORE" + q.insert
+		}
+
+	case 0:
+		return nil, fmt.Errorf("missing dialect")
+	default:
+		return nil, fmt.Errorf("unknown dialect %d", c.Dialect)
+	}
+
+	return q, nil
+}
+
+// rowKey returns the key of the bucket's row. Keys which are too long are
+// replaced by their hash. Both kinds are prefixed, so that they can't collide.
+func rowKey(key string) string {
+	if len(rawKeyPrefix)+len(key) <= maxKeyLength {
+		return rawKeyPrefix + key
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hashedKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// toInt64 converts the value to a signed integer for the database, saturating
+// at math.MaxInt64.
+func toInt64(v uint64) int64 {
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(v)
+}
@@ -0,0 +1,480 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/internal/fakesql"
+	"github.com/sethvargo/go-limiter/limitertest"
+)
+
+var dialects = []struct {
+	name    string
+	dialect Dialect
+}{
+	{name: "postgres", dialect: DialectPostgres},
+	{name: "mysql", dialect: DialectMySQL},
+	{name: "sqlite", dialect: DialectSQLite},
+}
+
+var databaseID uint64
+
+// openDB opens a new, empty fake database which locks like the dialect, and
+// closes it when the test finishes.
+func openDB(t testing.TB, dialect Dialect) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("%s-%d", t.Name(), atomic.AddUint64(&databaseID, 1))
+	if dialect == DialectSQLite {
+		dsn = "sqlite:" + dsn
+	}
+	db, err := sql.Open("fakesql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+// newStore migrates the database and creates a store, and closes it when the
+// test finishes.
+func newStore(t testing.TB, db *sql.DB, c *Config) limiter.Store {
+	t.Helper()
+
+	if err := Migrate(context.Background(), db, c); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(db, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return s
+}
+
+// rows returns the number of rows for the key.
+func rows(t testing.TB, db *sql.DB, key string) int {
+	t.Helper()
+
+	var n int
+	err := db.QueryRowContext(context.Background(),
+		"SELECT tokens FROM limiter_buckets WHERE bucket_key = ?", key).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 1
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	db := openDB(t, DialectPostgres)
+
+	cases := []struct {
+		name string
+		db   *sql.DB
+		c    *Config
+	}{
+		{
+			name: "nil_db",
+			c:    &Config{Dialect: DialectPostgres},
+		},
+		{
+			name: "missing_dialect",
+			db:   db,
+			c:    &Config{},
+		},
+		{
+			name: "unknown_dialect",
+			db:   db,
+			c:    &Config{Dialect: 99},
+		},
+		{
+			name: "invalid_table",
+			db:   db,
+			c:    &Config{Dialect: DialectPostgres, Table: "buckets; DROP TABLE users"},
+		},
+		{
+			name: "invalid_schema",
+			db:   db,
+			c:    &Config{Dialect: DialectPostgres, Table: "a.b.c"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := New(tc.db, tc.c); err == nil {
+				t.Error("expected error from New")
+			}
+			if err := Migrate(context.Background(), tc.db, tc.c); err == nil {
+				t.Error("expected error from Migrate")
+			}
+		})
+	}
+}
+
+func TestNewQueries(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		dialect Dialect
+		table   string
+		want    []string
+	}{
+		{
+			name:    "postgres",
+			dialect: DialectPostgres,
+			table:   "limits.buckets",
+			want: []string{
+				"CREATE INDEX IF NOT EXISTS buckets_updated_at_idx ON limits.buckets (updated_at)",
+				"WHERE bucket_key = $1 FOR UPDATE",
+				"ON CONFLICT (bucket_key) DO NOTHING",
+			},
+		},
+		{
+			name:    "mysql",
+			dialect: DialectMySQL,
+			want: []string{
+				"bucket_key VARCHAR(255) PRIMARY KEY",
+				"INDEX limiter_buckets_updated_at_idx (updated_at)",
+				"WHERE bucket_key = ? FOR UPDATE",
+				"INSERT INTO limiter_buckets",
+				"ON DUPLICATE KEY UPDATE bucket_key = bucket_key",
+			},
+		},
+		{
+			name:    "sqlite",
+			dialect: DialectSQLite,
+			want: []string{
+				"CREATE INDEX IF NOT EXISTS limiter_buckets_updated_at_idx ON limiter_buckets (updated_at)",
+				"INSERT OR IGNORE INTO limiter_buckets",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			q, err := newQueries(&Config{Dialect: tc.dialect, Table: tc.table})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			all := strings.Join(append(q.migrate,
+				q.get, q.selectForUpdate, q.insert, q.update, q.delete, q.sweep), "\n")
+			for _, want := range tc.want {
+				if !strings.Contains(all, want) {
+					t.Errorf("expected queries to contain %q:\n%s", want, all)
+				}
+			}
+
+			if tc.dialect == DialectSQLite && strings.Contains(all, "FOR UPDATE") {
+				t.Errorf("expected no FOR UPDATE:\n%s", all)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range dialects {
+		d := d
+
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := openDB(t, d.dialect)
+			c := &Config{Dialect: d.dialect, Table: "buckets"}
+
+			// Migrating is idempotent.
+			for i := 0; i < 2; i++ {
+				if err := Migrate(context.Background(), db, c); err != nil {
+					t.Fatalf("%d: %s", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStore_longKey(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range dialects {
+		d := d
+
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			db := openDB(t, d.dialect)
+
+			s := newStore(t, db, &Config{
+				Dialect:  d.dialect,
+				Tokens:   1,
+				Interval: time.Hour,
+			})
+
+			// The keys differ only after the first 255 bytes, which is all MySQL
+			// keeps of a key.
+			prefix := strings.Repeat("k", 255)
+			a, b := prefix+"a", prefix+"b"
+
+			if _, _, _, ok, err := s.Take(ctx, a); err != nil || !ok {
+				t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+			}
+			if _, _, _, ok, err := s.Take(ctx, a); err != nil || ok {
+				t.Fatalf("expected take to be rejected, got %t, %v", ok, err)
+			}
+			if _, _, _, ok, err := s.Take(ctx, b); err != nil || !ok {
+				t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+			}
+
+			if tokens, remaining, err := s.Get(ctx, a); err != nil {
+				t.Fatal(err)
+			} else if tokens != 1 || remaining != 0 {
+				t.Errorf("expected 1 token with 0 remaining, got %d, %d", tokens, remaining)
+			}
+
+			if err := s.(limiter.StoreWithDelete).Delete(ctx, a); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := rows(t, db, rowKey(a)), 0; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+			if got, want := rows(t, db, rowKey(b)), 1; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+
+			// A key which looks like the stored form of a hashed key is its own
+			// bucket.
+			if _, _, _, ok, err := s.Take(ctx, rowKey(b)); err != nil || !ok {
+				t.Fatalf("expected take to succeed, got %t, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStore_insertConflict(t *testing.T) {
+	t.Parallel()
+
+	// Only the dialects which lock rows let another client create the row while
+	// the take runs.
+	for _, d := range dialects[:2] {
+		d := d
+
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			dsn := fmt.Sprintf("%s-%d", t.Name(), atomic.AddUint64(&databaseID, 1))
+			db, err := sql.Open("fakesql", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+
+			s := newStore(t, db, &Config{
+				Dialect:  d.dialect,
+				Tokens:   10,
+				Interval: time.Hour,
+			})
+
+			// Another client creates the bucket, empty, but has not committed, so
+			// the take doesn't see the row and blocks on creating it.
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO limiter_buckets "+
+				"(bucket_key, tokens, interval_ns, start_time, last_tick, available, updated_at) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?)", rowKey("key"), 10, int64(time.Hour), time.Now().UnixNano(), 0, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			type result struct {
+				ok  bool
+				err error
+			}
+			doneCh := make(chan result, 1)
+			go func() {
+				_, _, _, ok, err := s.Take(ctx, "key")
+				doneCh <- result{ok: ok, err: err}
+			}()
+
+			for fakesql.Waiting(dsn) == 0 {
+				runtime.Gosched()
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The take starts again with the other client's bucket.
+			r := <-doneCh
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if r.ok {
+				t.Error("expected take to be rejected")
+			}
+		})
+	}
+}
+
+func TestStore_busy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := openDB(t, DialectSQLite)
+
+	s := newStore(t, db, &Config{
+		Dialect:    DialectSQLite,
+		MaxRetries: 2,
+	})
+
+	// Another transaction holds the write lock, so the update gives up once it
+	// has retried.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM limiter_buckets WHERE bucket_key = ?", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+		t.Errorf("expected take to succeed, got %t, %v", ok, err)
+	}
+}
+
+func TestStore_sweep(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := openDB(t, DialectSQLite)
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+
+	s := newStore(t, db, &Config{
+		Dialect:     DialectSQLite,
+		Interval:    time.Minute,
+		SweepMinTTL: time.Hour,
+		Clock:       clock,
+	})
+
+	if _, _, _, _, err := s.Take(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Minute)
+	if _, _, _, _, err := s.Take(ctx, "fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(31 * time.Minute)
+	if err := s.(*store).sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := rows(t, db, rowKey("stale")), 0; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := rows(t, db, rowKey("fresh")), 1; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_invalidBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db := openDB(t, DialectSQLite)
+
+	s := newStore(t, db, &Config{
+		Dialect: DialectSQLite,
+	})
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO limiter_buckets "+
+		"(bucket_key, tokens, interval_ns, start_time, last_tick, available, updated_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?)", rowKey("key"), 10, 0, 0, 0, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := s.Take(ctx, "key"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range dialects {
+		d := d
+
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Every group of stores needs its own database.
+			newStores := func(n int) []limiter.Store {
+				c := &Config{
+					Dialect:  d.dialect,
+					Tokens:   10,
+					Interval: time.Hour,
+				}
+
+				db := openDB(t, d.dialect)
+				if err := Migrate(context.Background(), db, c); err != nil {
+					t.Fatal(err)
+				}
+
+				stores := make([]limiter.Store, n)
+				for i := range stores {
+					s, err := New(db, c)
+					if err != nil {
+						t.Fatal(err)
+					}
+					stores[i] = s
+				}
+				return stores
+			}
+
+			limitertest.RunStoreTests(t, func() limiter.Store {
+				return newStores(1)[0]
+			})
+			limitertest.RunSharedStoreTests(t, newStores)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package limiter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 )
@@ -56,3 +57,57 @@ type Store interface {
 	// zero values.
 	Close(ctx context.Context) error
 }
+
+// StoreWithTakeN is an optional interface implemented by stores that support
+// weighted takes. Callers can type-assert a Store to this interface to consume
+// more than one token per request (for example, to charge a bulk operation more
+// than a single read).
+type StoreWithTakeN interface {
+	Store
+
+	// TakeN takes n tokens from the given key if available. It returns the same
+	// values as Take. The take is atomic: either all n tokens are taken or none
+	// are. If there are fewer than n tokens available, "ok" is false and the
+	// bucket is unchanged.
+	TakeN(ctx context.Context, key string, n uint64) (tokens, remaining, reset uint64, ok bool, err error)
+}
+
+// StoreWithRefund is an optional interface implemented by stores that can
+// return previously-taken tokens to a bucket. It is used to implement
+// reservations that can be canceled.
+type StoreWithRefund interface {
+	Store
+
+	// Refund returns n tokens to the given key. The reset value must be the one
+	// returned by the take being refunded. If the bucket has already moved past
+	// that interval, it has been replenished already and the refund does
+	// nothing. Refunding a key that does not exist is not an error.
+	Refund(ctx context.Context, key string, n, reset uint64) error
+}
+
+// StoreWithDelete is an optional interface implemented by stores that can
+// forget a single key without closing the entire store.
+type StoreWithDelete interface {
+	Store
+
+	// Delete removes any bucket and configuration for the key. The next take for
+	// the key behaves as if the key had never been seen, starting a full bucket
+	// with the store's default limits. Deleting a key that does not exist is not
+	// an error. Stoppable stores should return ErrStopped after Close.
+	Delete(ctx context.Context, key string) error
+}
+
+// TakeN takes n tokens from the store, using TakeN if the store supports
+// weighted takes. It returns an error wrapping errors.ErrUnsupported if n is
+// greater than one and the store does not implement StoreWithTakeN.
+func TakeN(ctx context.Context, s Store, key string, n uint64) (tokens, remaining, reset uint64, ok bool, err error) {
+	if n == 1 {
+		return s.Take(ctx, key)
+	}
+
+	sn, ok := s.(StoreWithTakeN)
+	if !ok {
+		return 0, 0, 0, false, fmt.Errorf("store does not support weighted takes: %w", errors.ErrUnsupported)
+	}
+	return sn.TakeN(ctx, key, n)
+}
@@ -0,0 +1,42 @@
+package tieredstore_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sethvargo/go-limiter/redisstore"
+	"github.com/sethvargo/go-limiter/tieredstore"
+)
+
+func ExampleNew() {
+	ctx := context.Background()
+
+	remote, err := redisstore.New(&redisstore.Config{
+		Addr:     "127.0.0.1:6379",
+		Tokens:   1000,
+		Interval: time.Minute,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Lease 20 tokens at a time from Redis, and admit up to 50 takes per key
+	// while Redis is unavailable.
+	store, err := tieredstore.New(&tieredstore.Config{
+		Remote:       remote,
+		BatchSize:    20,
+		SyncInterval: 5 * time.Second,
+		ErrorBudget:  50,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close(ctx)
+
+	limit, remaining, reset, ok, err := store.Take(ctx, "my-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _, _, _ = limit, remaining, reset, ok
+}
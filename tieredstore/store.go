@@ -0,0 +1,748 @@
+// Package tieredstore defines a store which serves most takes from memory, in
+// front of a shared remote store such as redisstore, so that most takes do not
+// need a network round-trip.
+//
+// Instead of taking a single token from the remote store for every take, the
+// store leases a batch of tokens from it with TakeN into a local memorystore
+// bucket, and serves takes from that bucket until it runs out. Only one take
+// per key leases from the remote store at a time, and the others wait for it.
+// Leases end when the remote bucket resets, or after SyncInterval, whichever is
+// first. Tokens which were leased but not used are then returned to the remote
+// store with Refund, if it supports it, so that other servers can use them.
+//
+// Leased tokens can't be used by other servers, so a store holding a lease may
+// cause another to reject a take which the remote store alone would have
+// permitted. Smaller batches and sync intervals make this less likely, at the
+// cost of more remote calls.
+//
+// The store never admits more than the remote store permits, except when the
+// remote store fails: then, up to ErrorBudget tokens per key are admitted on
+// credit, and taken from the remote store once it recovers.
+package tieredstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+var (
+	_ limiter.StoreWithTakeN  = (*store)(nil)
+	_ limiter.StoreWithRefund = (*store)(nil)
+	_ limiter.StoreWithDelete = (*store)(nil)
+)
+
+// localStore is the memorystore which holds the leased tokens.
+type localStore interface {
+	limiter.StoreWithTakeN
+	limiter.StoreWithDelete
+}
+
+type store struct {
+	remote       limiter.StoreWithTakeN
+	local        localStore
+	batchSize    uint64
+	syncInterval time.Duration
+	errorBudget  uint64
+	clock        limiter.Clock
+
+	data     map[string]*lease
+	dataLock sync.RWMutex
+
+	stopped uint32
+	stopCh  chan struct{}
+}
+
+// lease is the state of the remote bucket for a key, as of the last remote
+// call. The leased tokens themselves are kept in the local store, in a bucket
+// which only holds tokens while reset is in the future. The lock guards the
+// fields and the key's local bucket, but is not held during remote calls.
+type lease struct {
+	lock sync.Mutex
+
+	// reset is the remote bucket's reset time, after which the leased tokens are
+	// void, and expires is when they must be returned.
+	reset   uint64
+	expires uint64
+
+	// limit and remaining are the remote bucket's limit and remaining tokens, as
+	// of the last remote call.
+	limit     uint64
+	remaining uint64
+
+	// rejected is when the remote store last had too few tokens for a take,
+	// plus SyncInterval, or the reset time if that is earlier. Until then, takes
+	// which need more than remaining are rejected without a remote call.
+	rejected uint64
+
+	// debt is the number of tokens admitted on credit while the remote store was
+	// failing, which have not been taken from it yet.
+	debt uint64
+
+	// call is the remote call which is leasing tokens or settling the debt, if
+	// one is running.
+	call *call
+
+	// gen changes whenever the remote bucket is replaced with Set, so that calls
+	// which started before then discard their tokens.
+	gen uint64
+
+	// deleted is set when the lease is removed from the map, so that takes which
+	// found it before then look it up again.
+	deleted bool
+}
+
+// call is a remote call for a key, which concurrent takes wait for instead of
+// making their own.
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// Config is used as input to New. It defines the behavior of the store.
+type Config struct {
+	// Remote is the shared store, which must implement limiter.StoreWithTakeN.
+	// Its limits apply across every server. Closing the tiered store closes it.
+	// This value is required.
+	Remote limiter.Store
+
+	// BatchSize is the number of tokens leased from the remote store at a time.
+	// If fewer are available, the remainder is leased. The default value is 10.
+	BatchSize uint64
+
+	// SyncInterval is the longest a lease is held before its unused tokens are
+	// returned to the remote store. The default value is 1 second.
+	SyncInterval time.Duration
+
+	// ErrorBudget is the number of tokens per key which may be admitted without
+	// the remote store, while it is failing. They are taken from the remote store
+	// once it recovers, but it may not have enough left, so each server may
+	// over-admit up to ErrorBudget tokens per key for each outage. The default
+	// value is 0, which returns the remote store's errors instead.
+	ErrorBudget uint64
+
+	// Clock is the source of the current time. It should match the remote
+	// store's clock. The default value is the system clock.
+	Clock limiter.Clock
+}
+
+// New creates a tiered store in front of the remote store.
+func New(c *Config) (limiter.Store, error) {
+	if c == nil {
+		c = new(Config)
+	}
+
+	if c.Remote == nil {
+		return nil, fmt.Errorf("remote store is required")
+	}
+	remote, ok := c.Remote.(limiter.StoreWithTakeN)
+	if !ok {
+		return nil, fmt.Errorf("remote store must implement limiter.StoreWithTakeN")
+	}
+
+	batchSize := uint64(10)
+	if c.BatchSize > 0 {
+		batchSize = c.BatchSize
+	}
+
+	syncInterval := 1 * time.Second
+	if c.SyncInterval > 0 {
+		syncInterval = c.SyncInterval
+	}
+
+	var clock limiter.Clock = limiter.SystemClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	// The local buckets are created with Set and removed by the sync, so the
+	// store's own limits and purge are not used.
+	local, err := memorystore.New(&memorystore.Config{
+		DisablePurge: true,
+		Clock:        clock,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local store: %w", err)
+	}
+
+	s := &store{
+		remote:       remote,
+		local:        local.(localStore),
+		batchSize:    batchSize,
+		syncInterval: syncInterval,
+		errorBudget:  c.ErrorBudget,
+		clock:        clock,
+
+		data:   make(map[string]*lease),
+		stopCh: make(chan struct{}),
+	}
+
+	go s.purge()
+
+	return s, nil
+}
+
+// Take attempts to remove a token from the named key. If the take is
+// successful, it returns true, otherwise false. It also returns the remote
+// limit, the tokens remaining on the remote store and in the lease, and the
+// reset time.
+func (s *store) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return s.TakeN(ctx, key, 1)
+}
+
+// TakeN attempts to remove n tokens from the named key. The take is all or
+// nothing - if fewer than n tokens are available, no tokens are removed and the
+// take is unsuccessful. It returns the same values as Take.
+func (s *store) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, 0, false, limiter.ErrStopped
+	}
+
+	l := s.lock(key)
+	defer func() { l.lock.Unlock() }()
+
+	for waited := false; ; waited = true {
+		// The lease may have been removed while waiting for a remote call.
+		if l.deleted {
+			l.lock.Unlock()
+			l = s.lock(key)
+		}
+
+		now := s.clock.Now()
+		available, ok, err := s.takeLocal(ctx, key, l, n, now)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		if ok {
+			return l.limit, l.remaining + available, l.reset, true, nil
+		}
+
+		// The remote call which was waited for, or a recent one which was
+		// rejected, found too few tokens for the take, so another would too.
+		if (waited || now < l.rejected) && now < l.reset && l.remaining < n-available {
+			return l.limit, l.remaining + available, l.reset, false, nil
+		}
+
+		// Another take is already calling the remote store, so wait for it and try
+		// its tokens.
+		if c := l.call; c != nil {
+			if err := s.wait(ctx, l, c); err != nil {
+				return s.credit(ctx, l, n, available, now, err)
+			}
+			continue
+		}
+
+		if err := s.fill(ctx, key, l, n-available); err != nil {
+			return s.credit(ctx, l, n, available, now, err)
+		}
+		available, ok, err = s.takeLocal(ctx, key, l, n, s.clock.Now())
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return l.limit, l.remaining + available, l.reset, ok, nil
+	}
+}
+
+// Get retrieves the information about the key from the remote store, counting
+// the tokens leased by this store as remaining.
+func (s *store) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return 0, 0, limiter.ErrStopped
+	}
+
+	tokens, remaining, err := s.remote.Get(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if l, ok := s.lookup(key); ok {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		if !l.deleted && s.clock.Now() < l.reset {
+			_, available, err := s.local.Get(ctx, key)
+			if err != nil {
+				return 0, 0, err
+			}
+			remaining += available
+		}
+	}
+	return tokens, remaining, nil
+}
+
+// Set configures the bucket-specific tokens and interval on the remote store,
+// and discards the lease for the key, since the remote bucket is refilled.
+func (s *store) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if err := s.remote.Set(ctx, key, tokens, interval); err != nil {
+		return err
+	}
+
+	if l, ok := s.lookup(key); ok {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.gen++
+		if err := s.clear(ctx, key, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Burst adds the provided value to the remote bucket's currently available
+// tokens.
+func (s *store) Burst(ctx context.Context, key string, tokens uint64) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if err := s.remote.Burst(ctx, key, tokens); err != nil {
+		return err
+	}
+	s.unreject(key)
+	return nil
+}
+
+// Refund returns tokens for the key, provided the bucket is still in the
+// interval that ends at reset. Tokens taken from the current lease are returned
+// to it, and others to the remote store, if it supports refunds.
+func (s *store) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if l, ok := s.lookup(key); ok {
+		l.lock.Lock()
+		if !l.deleted && reset == l.reset && s.clock.Now() < l.reset {
+			err := s.local.Burst(ctx, key, tokens)
+			l.lock.Unlock()
+			return err
+		}
+		l.lock.Unlock()
+	}
+
+	if rs, ok := s.remote.(limiter.StoreWithRefund); ok {
+		if err := rs.Refund(ctx, key, tokens, reset); err != nil {
+			return err
+		}
+		s.unreject(key)
+	}
+	return nil
+}
+
+// Delete removes the bucket for the key from the remote store, if it supports
+// deletes, and discards the lease and any debt for the key.
+func (s *store) Delete(ctx context.Context, key string) error {
+	// If the store is stopped, all requests are rejected.
+	if atomic.LoadUint32(&s.stopped) == 1 {
+		return limiter.ErrStopped
+	}
+
+	if ds, ok := s.remote.(limiter.StoreWithDelete); ok {
+		if err := ds.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	if l, ok := s.lookup(key); ok {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		if !l.deleted {
+			return s.remove(ctx, key, l)
+		}
+	}
+	return nil
+}
+
+// Close stops the store, returns the unused leased tokens and settles debts
+// with the remote store where possible, and closes the local and remote stores.
+func (s *store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&s.stopped, 0, 1) {
+		return nil
+	}
+
+	// Close the channel to prevent future syncing.
+	close(s.stopCh)
+
+	s.dataLock.Lock()
+	data := s.data
+	s.data = make(map[string]*lease)
+	s.dataLock.Unlock()
+
+	// Returning tokens is best-effort, since the leases end soon anyway.
+	for key, l := range data {
+		_ = s.release(ctx, key, l)
+
+		l.lock.Lock()
+		if !l.deleted && l.call == nil && l.debt > 0 {
+			_ = s.fill(ctx, key, l, 0)
+		}
+		l.deleted = true
+		l.lock.Unlock()
+	}
+
+	var merr error
+	if err := s.local.Close(ctx); err != nil {
+		merr = errors.Join(merr, fmt.Errorf("failed to close local store: %w", err))
+	}
+	if err := s.remote.Close(ctx); err != nil {
+		merr = errors.Join(merr, fmt.Errorf("failed to close remote store: %w", err))
+	}
+	return merr
+}
+
+// lookup returns the lease for the key, if there is one.
+func (s *store) lookup(key string) (*lease, bool) {
+	s.dataLock.RLock()
+	l, ok := s.data[key]
+	s.dataLock.RUnlock()
+	return l, ok
+}
+
+// lock returns the locked lease for the key, creating it if it does not exist.
+func (s *store) lock(key string) *lease {
+	for {
+		l, ok := s.lookup(key)
+		if !ok {
+			s.dataLock.Lock()
+			if l, ok = s.data[key]; !ok {
+				l = new(lease)
+				s.data[key] = l
+			}
+			s.dataLock.Unlock()
+		}
+
+		l.lock.Lock()
+		if !l.deleted {
+			return l
+		}
+		l.lock.Unlock()
+	}
+}
+
+// unreject forgets that the remote store rejected a take for the key, after
+// tokens were added to it, so that the next take which needs them asks it again.
+func (s *store) unreject(key string) {
+	if l, ok := s.lookup(key); ok {
+		l.lock.Lock()
+		l.rejected = 0
+		l.lock.Unlock()
+	}
+}
+
+// takeLocal takes n tokens from the lease, if it holds enough. It returns the
+// leased tokens left. It must be called with the lease locked.
+func (s *store) takeLocal(ctx context.Context, key string, l *lease, n, now uint64) (uint64, bool, error) {
+	// The local bucket only exists while the lease is valid.
+	if l.deleted || now >= l.reset {
+		return 0, false, nil
+	}
+
+	_, available, _, ok, err := s.local.TakeN(ctx, key, n)
+	if err != nil {
+		return 0, false, err
+	}
+	return available, ok, nil
+}
+
+// credit admits a take of n tokens on credit after the remote call failed with
+// err, if the error budget allows, or returns err. It must be called with the
+// lease locked.
+func (s *store) credit(ctx context.Context, l *lease, n, available, now uint64, err error) (uint64, uint64, uint64, bool, error) {
+	if l.debt+n > s.errorBudget || ctx.Err() != nil {
+		return 0, 0, 0, false, err
+	}
+
+	l.debt += n
+	reset := l.reset
+	if reset <= now {
+		reset = now + uint64(s.syncInterval)
+	}
+	return l.limit, l.remaining + available, reset, true, nil
+}
+
+// wait waits for the remote call to finish, and returns its error. It must be
+// called with the lease locked, and unlocks it while waiting.
+func (s *store) wait(ctx context.Context, l *lease, c *call) error {
+	l.lock.Unlock()
+	defer l.lock.Lock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fill settles the debt for the key, and then, if need is not zero, leases
+// enough tokens from the remote store for a take of need more tokens, if they
+// are available. It must be called with the lease locked, and no call running.
+// The lease is unlocked during the remote calls, and concurrent takes wait for
+// them.
+func (s *store) fill(ctx context.Context, key string, l *lease, need uint64) error {
+	c := &call{done: make(chan struct{})}
+	l.call = c
+	gen, debt := l.gen, l.debt
+
+	want := s.batchSize
+	if want < need {
+		want = need
+	}
+
+	l.lock.Unlock()
+	settled, limit, remaining, reset, leased, err := s.fetch(ctx, key, debt, need, want)
+	l.lock.Lock()
+
+	l.call = nil
+	c.err = err
+	close(c.done)
+
+	if l.deleted {
+		return err
+	}
+	l.debt -= min(settled, l.debt)
+
+	// The remote bucket was not read.
+	if reset == 0 {
+		return err
+	}
+
+	// Tokens leased before the remote bucket was replaced are void.
+	if l.gen != gen {
+		return errors.Join(err, s.observe(ctx, key, l, limit, remaining, reset, 0))
+	}
+	if oerr := s.observe(ctx, key, l, limit, remaining, reset, leased); oerr != nil {
+		return errors.Join(err, oerr)
+	}
+
+	// Remember that the remote store had too few tokens, so that takes which
+	// need as many are rejected locally until the window ends or the lease
+	// would be synced.
+	if err == nil && need > 0 && leased == 0 && remaining < need {
+		l.rejected = min(l.reset, s.clock.Now()+uint64(s.syncInterval))
+	}
+	return err
+}
+
+// fetch takes the debt from the remote store, and then leases want tokens from
+// it, or the remainder if fewer are available, unless it is less than need. It
+// returns the debt settled, the state of the remote bucket, and the tokens
+// leased. It makes remote calls, so it must be called with the lease unlocked.
+func (s *store) fetch(ctx context.Context, key string, debt, need, want uint64) (settled, limit, remaining, reset, leased uint64, retErr error) {
+	// If the remote store does not have enough for the debt, it takes what is
+	// left, and the rest is forgiven.
+	if debt > 0 {
+		var ok bool
+		limit, remaining, reset, ok, retErr = s.remote.TakeN(ctx, key, debt)
+		if retErr != nil {
+			return
+		}
+		if !ok && remaining > 0 {
+			if limit, remaining, reset, _, retErr = s.remote.TakeN(ctx, key, remaining); retErr != nil {
+				return
+			}
+		}
+		settled = debt
+	}
+
+	if need == 0 {
+		return
+	}
+
+	for {
+		var ok bool
+		limit, remaining, reset, ok, retErr = s.remote.TakeN(ctx, key, want)
+		if retErr != nil {
+			return
+		}
+		if ok {
+			leased = want
+			return
+		}
+
+		// Fewer tokens are available than the batch size, so lease the remainder,
+		// unless it is too small for the take. The remote bucket may change in the
+		// meantime, so try again with the new remainder.
+		if remaining < need || remaining >= want {
+			return
+		}
+		want = remaining
+	}
+}
+
+// observe records the state of the remote bucket, and adds the leased tokens to
+// the local bucket. A new remote window starts a new, empty local bucket, which
+// ends with the window. It must be called with the lease locked.
+func (s *store) observe(ctx context.Context, key string, l *lease, limit, remaining, reset, leased uint64) error {
+	l.limit, l.remaining = limit, remaining
+
+	now := s.clock.Now()
+	if reset != l.reset {
+		if err := s.clear(ctx, key, l); err != nil {
+			return err
+		}
+		if reset <= now {
+			return nil
+		}
+		if err := s.local.Set(ctx, key, 0, time.Duration(reset-now)); err != nil {
+			return err
+		}
+		l.reset = reset
+	}
+
+	if leased == 0 || now >= l.reset {
+		return nil
+	}
+	if err := s.local.Burst(ctx, key, leased); err != nil {
+		return err
+	}
+	l.expires = now + uint64(s.syncInterval)
+	return nil
+}
+
+// clear ends the lease, forgets any rejection, and removes its local bucket.
+// It must be called with the lease locked.
+func (s *store) clear(ctx context.Context, key string, l *lease) error {
+	l.reset, l.expires, l.rejected = 0, 0, 0
+	return s.local.Delete(ctx, key)
+}
+
+// remove removes the lease from the map, and its local bucket. It must be
+// called with the lease locked.
+func (s *store) remove(ctx context.Context, key string, l *lease) error {
+	s.dataLock.Lock()
+	delete(s.data, key)
+	s.dataLock.Unlock()
+
+	l.deleted = true
+	return s.clear(ctx, key, l)
+}
+
+// release returns the unused tokens of the lease to the remote store, if it
+// supports refunds, and ends the lease. If the refund fails, the tokens are
+// put back, since they are still valid until the remote bucket resets. It locks
+// the lease, but not during the refund.
+func (s *store) release(ctx context.Context, key string, l *lease) error {
+	l.lock.Lock()
+	now := s.clock.Now()
+	l.expires = 0
+
+	// Tokens from a remote window which has ended can't be returned.
+	if l.deleted || now >= l.reset {
+		l.lock.Unlock()
+		return nil
+	}
+
+	// Take the unused tokens out of the local bucket, so that takes can't use
+	// them while they are returned.
+	_, available, err := s.local.Get(ctx, key)
+	if err == nil && available > 0 {
+		_, _, _, _, err = s.local.TakeN(ctx, key, available)
+	}
+	gen, reset := l.gen, l.reset
+	l.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	rs, ok := s.remote.(limiter.StoreWithRefund)
+	if !ok || available == 0 {
+		return nil
+	}
+	if err := rs.Refund(ctx, key, available, reset); err != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		if !l.deleted && l.gen == gen && l.reset == reset && s.clock.Now() < reset {
+			_ = s.local.Burst(ctx, key, available)
+		}
+		return err
+	}
+	return nil
+}
+
+// purge continually syncs the leases which have expired, and removes the
+// leases which hold nothing.
+func (s *store) purge() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		s.sync(context.Background())
+	}
+}
+
+// sync returns the unused tokens of expired leases, settles debts, and removes
+// the leases which hold nothing and don't remember a rejection. Leases with a remote call running are left for
+// the next sync.
+func (s *store) sync(ctx context.Context) {
+	s.dataLock.RLock()
+	keys := make([]string, 0, len(s.data))
+	leases := make([]*lease, 0, len(s.data))
+	for k, l := range s.data {
+		keys = append(keys, k)
+		leases = append(leases, l)
+	}
+	s.dataLock.RUnlock()
+
+	for i, l := range leases {
+		l.lock.Lock()
+		now := s.clock.Now()
+		expired := now >= l.reset || now >= l.expires
+		skip := l.deleted || l.call != nil
+		l.lock.Unlock()
+		if skip {
+			continue
+		}
+
+		// Failures are retried on the next sync.
+		released := !expired || s.release(ctx, keys[i], l) == nil
+
+		l.lock.Lock()
+		if l.deleted || l.call != nil {
+			l.lock.Unlock()
+			continue
+		}
+		if expired && released && l.debt > 0 {
+			_ = s.fill(ctx, keys[i], l, 0)
+		}
+		if !l.deleted && l.call == nil && l.debt == 0 && s.clock.Now() >= l.rejected && s.empty(ctx, keys[i], l) {
+			_ = s.remove(ctx, keys[i], l)
+		}
+		l.lock.Unlock()
+	}
+}
+
+// empty reports whether the lease holds no tokens. It must be called with the
+// lease locked.
+func (s *store) empty(ctx context.Context, key string, l *lease) bool {
+	if s.clock.Now() >= l.reset {
+		return true
+	}
+	_, available, err := s.local.Get(ctx, key)
+	return err == nil && available == 0
+}
@@ -0,0 +1,547 @@
+package tieredstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/fakeclock"
+	"github.com/sethvargo/go-limiter/limitertest"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+var errUnavailable = errors.New("remote unavailable")
+
+// remote wraps a memorystore as a remote store which counts its takes, can be
+// made to fail or to wait, and is not closed when the tiered store is closed,
+// so that it can be shared and inspected.
+type remote struct {
+	limiter.Store
+
+	takes   uint64
+	failing uint32
+	closed  uint32
+
+	// If gate is set, TakeN and Refund signal entered, and wait for gate to be
+	// closed.
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+// newRemote creates a remote store, and closes it when the test finishes.
+func newRemote(t testing.TB, c *memorystore.Config) *remote {
+	t.Helper()
+
+	s, err := memorystore.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return &remote{Store: s}
+}
+
+func (r *remote) err() error {
+	if r.gate != nil {
+		r.entered <- struct{}{}
+		<-r.gate
+	}
+	if atomic.LoadUint32(&r.failing) == 1 {
+		return errUnavailable
+	}
+	return nil
+}
+
+func (r *remote) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	return r.TakeN(ctx, key, 1)
+}
+
+func (r *remote) TakeN(ctx context.Context, key string, n uint64) (uint64, uint64, uint64, bool, error) {
+	if err := r.err(); err != nil {
+		return 0, 0, 0, false, err
+	}
+	atomic.AddUint64(&r.takes, 1)
+	return r.Store.(limiter.StoreWithTakeN).TakeN(ctx, key, n)
+}
+
+func (r *remote) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&r.failing) == 1 {
+		return 0, 0, errUnavailable
+	}
+	return r.Store.Get(ctx, key)
+}
+
+func (r *remote) Refund(ctx context.Context, key string, tokens, reset uint64) error {
+	if err := r.err(); err != nil {
+		return err
+	}
+	return r.Store.(limiter.StoreWithRefund).Refund(ctx, key, tokens, reset)
+}
+
+func (r *remote) Delete(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&r.failing) == 1 {
+		return errUnavailable
+	}
+	return r.Store.(limiter.StoreWithDelete).Delete(ctx, key)
+}
+
+func (r *remote) Close(ctx context.Context) error {
+	atomic.StoreUint32(&r.closed, 1)
+	return nil
+}
+
+// newStore creates a tiered store, and closes it when the test finishes.
+func newStore(t testing.TB, c *Config) limiter.Store {
+	t.Helper()
+
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return s
+}
+
+// take takes a token and checks the result.
+func take(t testing.TB, s limiter.Store, wantOK bool, wantRemaining uint64) {
+	t.Helper()
+
+	_, remaining, _, ok, err := s.Take(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ok, wantOK; got != want {
+		t.Errorf("expected %t to be %t", got, want)
+	}
+	if got, want := remaining, wantRemaining; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+// remaining returns the tokens remaining for the key on the remote store.
+func remaining(t testing.TB, r *remote) uint64 {
+	t.Helper()
+
+	_, remaining, err := r.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remaining
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		c    *Config
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "missing_remote",
+			c:    &Config{BatchSize: 5},
+		},
+		{
+			name: "remote_without_take_n",
+			c: &Config{
+				Remote: struct{ limiter.Store }{newRemote(t, nil)},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := New(tc.c); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestStore_batching(t *testing.T) {
+	t.Parallel()
+
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10})
+
+	for i := uint64(0); i < 25; i++ {
+		take(t, s, true, 99-i)
+	}
+
+	// Only every tenth take goes to the remote store.
+	if got, want := atomic.LoadUint64(&r.takes), uint64(3); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := remaining(t, r), uint64(70); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// The lease counts as remaining.
+	if _, got, err := s.Get(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	} else if want := uint64(75); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_partialBatch(t *testing.T) {
+	t.Parallel()
+
+	r := newRemote(t, &memorystore.Config{Tokens: 4, Interval: time.Hour})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10})
+
+	// Fewer tokens than the batch size are left, so the remainder is leased.
+	for i := uint64(0); i < 4; i++ {
+		take(t, s, true, 3-i)
+	}
+	take(t, s, false, 0)
+
+	if got, want := remaining(t, r), uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_singleFlight(t *testing.T) {
+	t.Parallel()
+
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour})
+	r.gate, r.entered = make(chan struct{}), make(chan struct{}, 10)
+	s := newStore(t, &Config{Remote: r, BatchSize: 10})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, ok, err := s.Take(context.Background(), "key"); err != nil || !ok {
+				t.Errorf("expected take to succeed, got %t, %v", ok, err)
+			}
+		}()
+	}
+
+	// The first take leases a batch, and the others wait for it instead of
+	// leasing their own.
+	<-r.entered
+	close(r.gate)
+	wg.Wait()
+
+	if got, want := atomic.LoadUint64(&r.takes), uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_slowRemote(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10, SyncInterval: time.Hour})
+
+	_, _, reset, _, err := s.Take(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refund for an earlier window goes to the remote store, which is slow.
+	r.gate, r.entered = make(chan struct{}), make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		done <- s.(limiter.StoreWithRefund).Refund(ctx, "key", 1, reset-1)
+	}()
+	<-r.entered
+
+	// Takes from the lease don't wait for the remote call.
+	take(t, s, true, 98)
+
+	close(r.gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_sync(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour, Clock: clock})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10, SyncInterval: time.Minute, Clock: clock})
+
+	take(t, s, true, 99)
+	take(t, s, true, 98)
+
+	// Syncing before the lease expires changes nothing.
+	s.(*store).sync(ctx)
+	if got, want := remaining(t, r), uint64(90); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Once the lease expires, its unused tokens are returned, and it is removed.
+	clock.Advance(time.Minute)
+	s.(*store).sync(ctx)
+	if got, want := remaining(t, r), uint64(98); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := len(s.(*store).data), 0; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// A take after the lease expired leases a new batch.
+	take(t, s, true, 97)
+	if got, want := atomic.LoadUint64(&r.takes), uint64(2); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_rejected(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+	r := newRemote(t, &memorystore.Config{Tokens: 2, Interval: time.Hour, Clock: clock})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10, SyncInterval: time.Minute, Clock: clock})
+
+	take(t, s, true, 1)
+	take(t, s, true, 0)
+	takes := atomic.LoadUint64(&r.takes)
+
+	// Once the remote store rejects a take, later takes are rejected locally.
+	for i := 0; i < 10; i++ {
+		take(t, s, false, 0)
+	}
+	if got, want := atomic.LoadUint64(&r.takes)-takes, uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// The rejection survives a sync, and is forgotten after the sync interval.
+	s.(*store).sync(ctx)
+	take(t, s, false, 0)
+	if got, want := atomic.LoadUint64(&r.takes)-takes, uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	clock.Advance(time.Minute)
+	for i := 0; i < 10; i++ {
+		take(t, s, false, 0)
+	}
+	if got, want := atomic.LoadUint64(&r.takes)-takes, uint64(2); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Tokens added to the remote store end the rejection.
+	if err := s.Burst(ctx, "key", 1); err != nil {
+		t.Fatal(err)
+	}
+	take(t, s, true, 0)
+}
+
+func TestStore_remoteReset(t *testing.T) {
+	t.Parallel()
+
+	clock := fakeclock.New(time.Unix(1700000000, 0))
+	r := newRemote(t, &memorystore.Config{Tokens: 10, Interval: time.Minute, Clock: clock})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10, SyncInterval: time.Hour, Clock: clock})
+
+	for i := uint64(0); i < 10; i++ {
+		take(t, s, true, 9-i)
+	}
+	take(t, s, false, 0)
+
+	// The lease ends with the remote window, before the sync interval, and the
+	// next window is leased.
+	clock.Advance(time.Minute)
+	take(t, s, true, 9)
+}
+
+func TestStore_errorBudget(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		budget uint64
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "budget",
+			budget: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := newRemote(t, &memorystore.Config{Tokens: 10, Interval: time.Hour})
+			s := newStore(t, &Config{Remote: r, BatchSize: 2, ErrorBudget: tc.budget})
+
+			// Use up the lease, then fail the remote store.
+			take(t, s, true, 9)
+			take(t, s, true, 8)
+			atomic.StoreUint32(&r.failing, 1)
+
+			// Up to the budget is admitted on credit.
+			for i := uint64(0); i < tc.budget; i++ {
+				if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+					t.Fatalf("%d: expected take to succeed, got %t, %v", i, ok, err)
+				}
+			}
+			if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, errUnavailable) {
+				t.Errorf("expected %v to be %v", err, errUnavailable)
+			}
+
+			// Once the remote store recovers, the debt is taken from it.
+			atomic.StoreUint32(&r.failing, 0)
+			take(t, s, true, 8-tc.budget-1)
+			if got, want := remaining(t, r), 8-tc.budget-2; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStore_errorBudget_forgiven(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r := newRemote(t, &memorystore.Config{Tokens: 3, Interval: time.Hour})
+	s := newStore(t, &Config{Remote: r, BatchSize: 1, ErrorBudget: 5})
+
+	atomic.StoreUint32(&r.failing, 1)
+	for i := 0; i < 5; i++ {
+		if _, _, _, ok, err := s.Take(ctx, "key"); err != nil || !ok {
+			t.Fatalf("%d: expected take to succeed, got %t, %v", i, ok, err)
+		}
+	}
+
+	// The remote store can only cover some of the debt, so it takes what is
+	// left, and the over-admission is bounded by the budget.
+	atomic.StoreUint32(&r.failing, 0)
+	take(t, s, false, 0)
+	if got, want := remaining(t, r), uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_Refund(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour})
+	s := newStore(t, &Config{Remote: r, BatchSize: 10, SyncInterval: time.Hour})
+
+	_, _, reset, _, err := s.Take(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens from the lease are returned to it, without a remote call.
+	if err := s.(limiter.StoreWithRefund).Refund(ctx, "key", 1, reset); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		take(t, s, true, 99-i)
+	}
+	if got, want := atomic.LoadUint64(&r.takes), uint64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r := newRemote(t, &memorystore.Config{Tokens: 100, Interval: time.Hour})
+
+	s, err := New(&Config{Remote: r, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	take(t, s, true, 99)
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := s.Take(ctx, "key"); !errors.Is(err, limiter.ErrStopped) {
+		t.Errorf("expected %v to be %v", err, limiter.ErrStopped)
+	}
+
+	// Closing returns the unused tokens, and closes the remote store.
+	if got, want := remaining(t, r), uint64(99); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := atomic.LoadUint32(&r.closed), uint32(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestStore_conformance(t *testing.T) {
+	t.Parallel()
+
+	limitertest.RunStoreTests(t, func() limiter.Store {
+		r, err := memorystore.New(&memorystore.Config{
+			Tokens:   10,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := New(&Config{
+			Remote:    r,
+			BatchSize: 4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+
+	limitertest.RunSharedStoreTests(t, func(n int) []limiter.Store {
+		r := newRemote(t, &memorystore.Config{
+			Tokens:   10,
+			Interval: time.Hour,
+		})
+
+		// Leases of one token at a time, so that no store holds tokens which the
+		// checks expect another to take.
+		stores := make([]limiter.Store, n)
+		for i := range stores {
+			s, err := New(&Config{
+				Remote:    r,
+				BatchSize: 1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores[i] = s
+		}
+		return stores
+	})
+}
@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ErrWaitExceedsDeadline is the error returned by Wait and WaitN when the
+// context's deadline is earlier than the earliest time at which tokens could
+// become available.
+var ErrWaitExceedsDeadline = fmt.Errorf("wait would exceed context deadline")
+
+// minWaitBackoff is the shortest time Wait sleeps between takes. It stops a
+// store which returns a reset time in the past from causing a busy loop.
+const minWaitBackoff = 10 * time.Millisecond
+
+// Wait blocks until a token can be taken from the given key. It calls Take on
+// the store and, if the take is unsuccessful, sleeps until the reset time
+// returned by the store before trying again. Wait always sleeps for a short
+// minimum time, even if the reset time has already passed.
+//
+// Wait returns early with the context's error if the context is canceled. If
+// the context has a deadline and that deadline is before the reset time, Wait
+// returns ErrWaitExceedsDeadline immediately instead of sleeping. Any error
+// returned by the store is returned to the caller.
+func Wait(ctx context.Context, s Store, key string) error {
+	return WaitN(ctx, s, key, 1)
+}
+
+// WaitN is like Wait, but blocks until n tokens can be taken at once. The store
+// must implement StoreWithTakeN, unless n is 1.
+func WaitN(ctx context.Context, s Store, key string, n uint64) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tokens, _, reset, ok, err := TakeN(ctx, s, key, n)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		// If the bucket can never hold enough tokens, waiting will not help.
+		if tokens < n {
+			return fmt.Errorf("cannot wait for %d tokens, limit is %d", n, tokens)
+		}
+
+		wait := time.Until(time.Unix(0, int64(reset)))
+		if wait < minWaitBackoff {
+			wait = minWaitBackoff
+		}
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(time.Now().Add(wait)) {
+			return ErrWaitExceedsDeadline
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
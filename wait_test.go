@@ -0,0 +1,258 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/memorystore"
+	"github.com/sethvargo/go-limiter/noopstore"
+)
+
+// takeOnlyStore hides any optional interfaces implemented by the wrapped store.
+type takeOnlyStore struct {
+	limiter.Store
+}
+
+// staleStore rejects every take with a reset time in the past, and counts the
+// number of takes.
+type staleStore struct {
+	limiter.Store
+	takes int
+}
+
+func (s *staleStore) Take(_ context.Context, _ string) (uint64, uint64, uint64, bool, error) {
+	s.takes++
+	return 5, 0, 0, false, nil
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+
+	t.Run("noop", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := noopstore.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			if err := limiter.Wait(ctx, s, "key"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("blocks_until_reset", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   1,
+			Interval: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if err := limiter.Wait(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, reset, ok, err := s.Take(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("expected bucket to be exhausted")
+		}
+
+		if err := limiter.Wait(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if now := uint64(time.Now().UnixNano()); now < reset {
+			t.Errorf("expected wait to return after %d, returned at %d", reset, now)
+		}
+	})
+
+	t.Run("deadline_before_reset", func(t *testing.T) {
+		t.Parallel()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   1,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := limiter.Wait(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := limiter.Wait(ctx, s, "key"), limiter.ErrWaitExceedsDeadline; !errors.Is(got, want) {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   1,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := limiter.Wait(ctx, s, "key"); err != nil {
+			t.Fatal(err)
+		}
+
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if got, want := limiter.Wait(ctx, s, "key"), context.Canceled; !errors.Is(got, want) {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := limiter.Wait(ctx, s, "key"), limiter.ErrStopped; !errors.Is(got, want) {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+	})
+}
+
+func TestWaitN(t *testing.T) {
+	t.Parallel()
+
+	t.Run("weighted", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   5,
+			Interval: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		// Only one take of 3 fits in a single interval, so the second call must
+		// wait for the next tick.
+		for i := 0; i < 2; i++ {
+			if err := limiter.WaitN(ctx, s, "key", 3); err != nil {
+				t.Fatal(err)
+			}
+
+			_, remaining, err := s.Get(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := remaining, uint64(2); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		}
+	})
+
+	t.Run("exceeds_limit", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := memorystore.New(&memorystore.Config{
+			Tokens:   5,
+			Interval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if err := limiter.WaitN(ctx, s, "key", 6); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+
+		s, err := noopstore.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := limiter.WaitN(ctx, &takeOnlyStore{s}, "key", 2), errors.ErrUnsupported; !errors.Is(got, want) {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+
+		// A single token does not require weighted takes.
+		if err := limiter.WaitN(ctx, &takeOnlyStore{s}, "key", 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stale_reset", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		// A reset time in the past must not cause a busy loop.
+		s := new(staleStore)
+		if got, want := limiter.WaitN(ctx, s, "key", 1), limiter.ErrWaitExceedsDeadline; !errors.Is(got, want) {
+			t.Errorf("expected %v to be %v", got, want)
+		}
+		if s.takes > 10 {
+			t.Errorf("expected at most 10 takes, got %d", s.takes)
+		}
+	})
+}